@@ -0,0 +1,335 @@
+// Package audit records the destructive actions of a purge run, such as
+// document resets and removals, conflict deletions and purges, to an append-only audit
+// trail kept in a file or a CouchDB database.
+//
+// Each record carries the SHA-256 hash of the record before it, so removing
+// or editing a record breaks the chain and is detected by Verify.
+package audit
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "os"
+    "os/user"
+    "sync"
+    "time"
+)
+
+// Actions recorded by the purge pipeline.
+const (
+    ActionReset           = "reset"
+    ActionRemove          = "remove"
+    ActionDeleteConflicts = "delete_conflicts"
+    ActionPurge           = "purge"
+)
+
+// Record describes one destructive action on one document.
+type Record struct {
+    Time              time.Time `json:"time"`
+    Operator          string    `json:"operator"`
+    Instance          string    `json:"instance"`
+    Database          string    `json:"database"`
+    DocID             string    `json:"docID"`
+    Action            string    `json:"action"`
+    Revisions         []string  `json:"revisions,omitempty"`
+    RevisionsAffected int       `json:"revisionsAffected"`
+
+    // PrevHash is the Hash of the previous record, empty for the first one.
+    PrevHash string `json:"prevHash"`
+    // Hash is the SHA-256 of the record with Hash itself left empty.
+    Hash string `json:"hash"`
+}
+
+// Logger writes audit records.
+//
+// Example usage:
+//
+//     auditor, err := audit.NewFileLogger("audit.jsonl", audit.DefaultOperator())
+//     if err != nil {
+//         log.Fatalf("Failed to open audit log: %v", err)
+//     }
+//     defer auditor.Close()
+//     auditor.Log(audit.Record{Instance: "10.0.0.1:5984", Database: "mydb", DocID: "doc1", Action: audit.ActionReset})
+//
+type Logger interface {
+    Log(rec Record) error
+    Close() error
+}
+
+// DefaultOperator returns the name of the user running the process, or
+// "unknown" if it cannot be determined.
+func DefaultOperator() string {
+    if current, err := user.Current(); err == nil && current.Username != "" {
+        return current.Username
+    }
+    if name := os.Getenv("USER"); name != "" {
+        return name
+    }
+    return "unknown"
+}
+
+// chain holds the state shared by the Logger implementations: the operator
+// stamped on every record and the hash of the last record written.
+type chain struct {
+    mu       sync.Mutex
+    operator string
+    last     string
+}
+
+// next fills in the time, operator and hashes of rec, linking it to the
+// previous record.
+func (c *chain) next(rec Record) (Record, error) {
+    if rec.Time.IsZero() {
+        rec.Time = time.Now().UTC()
+    }
+    if rec.Operator == "" {
+        rec.Operator = c.operator
+    }
+    rec.PrevHash = c.last
+    hash, err := hashRecord(rec)
+    if err != nil {
+        return rec, err
+    }
+    rec.Hash = hash
+    return rec, nil
+}
+
+// hashRecord returns the SHA-256 of rec encoded as JSON with Hash empty.
+func hashRecord(rec Record) (string, error) {
+    rec.Hash = ""
+    content, err := json.Marshal(rec)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(content)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks that records form an unbroken hash chain, returning an error
+// naming the first record that does not.
+func Verify(records []Record) error {
+    prev := ""
+    for i, rec := range records {
+        if rec.PrevHash != prev {
+            return fmt.Errorf("record %d does not follow the previous record", i+1)
+        }
+        hash, err := hashRecord(rec)
+        if err != nil {
+            return err
+        }
+        if rec.Hash != hash {
+            return fmt.Errorf("record %d has been modified", i+1)
+        }
+        prev = rec.Hash
+    }
+    return nil
+}
+
+// FileLogger appends audit records to a file as JSON lines.
+type FileLogger struct {
+    chain
+    file *os.File
+}
+
+// NewFileLogger opens, or creates, the audit file at path. Records appended
+// to an existing file continue its hash chain.
+func NewFileLogger(path, operator string) (*FileLogger, error) {
+    records, err := ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, err
+    }
+
+    l := &FileLogger{chain: chain{operator: operator}, file: file}
+    if len(records) > 0 {
+        l.last = records[len(records)-1].Hash
+    }
+    return l, nil
+}
+
+// Log appends rec to the file.
+func (l *FileLogger) Log(rec Record) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    rec, err := l.next(rec)
+    if err != nil {
+        return err
+    }
+    content, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+    if _, err := l.file.Write(append(content, '\n')); err != nil {
+        return err
+    }
+    l.last = rec.Hash
+    return nil
+}
+
+// Close closes the file.
+func (l *FileLogger) Close() error {
+    return l.file.Close()
+}
+
+// ReadFile reads the records of an audit file written by FileLogger.
+func ReadFile(path string) ([]Record, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var records []Record
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        var rec Record
+        if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+            return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+        }
+        records = append(records, rec)
+    }
+    return records, scanner.Err()
+}
+
+// DocumentStore creates, reads and lists documents, as couchdb.CouchDBClient
+// does.
+type DocumentStore interface {
+    CreateDocument(doc map[string]interface{}) error
+    GetDocument(docID string) (map[string]interface{}, error)
+    SaveDocument(doc map[string]interface{}) (string, error)
+    AllDocuments() ([]map[string]interface{}, error)
+}
+
+// tipDocID is the local document in which DatabaseLogger records the hash
+// and sequence number of the newest record, so that a new logger need not
+// read every record to find where the chain ends. Local documents are not
+// replicated and are not listed with the records.
+const tipDocID = "_local/audit-tip"
+
+// DatabaseLogger writes each audit record as a document of a CouchDB
+// database.
+type DatabaseLogger struct {
+    chain
+    db DocumentStore
+
+    // seq is the number of records in the chain, and tipRev the revision of
+    // the tip document.
+    seq    int
+    tipRev string
+}
+
+// NewDatabaseLogger returns a Logger creating its records in db. Records
+// continue the hash chain of those already in db, whose end is read from the
+// tip document. Only a database written before the tip was recorded has its
+// records read to find it, once.
+func NewDatabaseLogger(db DocumentStore, operator string) (*DatabaseLogger, error) {
+    l := &DatabaseLogger{chain: chain{operator: operator}, db: db}
+
+    tip, err := db.GetDocument(tipDocID)
+    if err == nil {
+        l.last, _ = tip["hash"].(string)
+        seq, _ := tip["seq"].(float64)
+        l.seq = int(seq)
+        l.tipRev, _ = tip["_rev"].(string)
+        return l, nil
+    }
+    if !errors.Is(err, couchdb.ErrNotFound) {
+        return nil, fmt.Errorf("failed to read audit chain tip: %w", err)
+    }
+
+    docs, err := db.AllDocuments()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read audit records: %w", err)
+    }
+    records := make([]Record, 0, len(docs))
+    for _, doc := range docs {
+        content, err := json.Marshal(doc)
+        if err != nil {
+            return nil, err
+        }
+        var rec Record
+        if err := json.Unmarshal(content, &rec); err != nil {
+            return nil, fmt.Errorf("malformed audit record %v: %v", doc["_id"], err)
+        }
+        records = append(records, rec)
+    }
+    l.last = chainTip(records)
+    l.seq = len(records)
+    return l, nil
+}
+
+// chainTip returns the hash of the newest record, the one no other record
+// follows. Documents come back in _id order, which says nothing about when
+// they were written, so the tip is found from the PrevHash links. If there
+// are several, as when a chain was restarted, the latest is used.
+func chainTip(records []Record) string {
+    followed := make(map[string]bool, len(records))
+    for _, rec := range records {
+        followed[rec.PrevHash] = true
+    }
+    var tip *Record
+    for i, rec := range records {
+        if followed[rec.Hash] {
+            continue
+        }
+        if tip == nil || rec.Time.After(tip.Time) {
+            tip = &records[i]
+        }
+    }
+    if tip == nil {
+        return ""
+    }
+    return tip.Hash
+}
+
+// Log creates a document for rec. Its _id is the record's hash.
+func (l *DatabaseLogger) Log(rec Record) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    rec, err := l.next(rec)
+    if err != nil {
+        return err
+    }
+    content, err := json.Marshal(rec)
+    if err != nil {
+        return err
+    }
+    var doc map[string]interface{}
+    if err := json.Unmarshal(content, &doc); err != nil {
+        return err
+    }
+    doc["_id"] = rec.Hash
+    if err := l.db.CreateDocument(doc); err != nil {
+        return fmt.Errorf("failed to write audit record: %w", err)
+    }
+    l.last = rec.Hash
+    l.seq++
+
+    tip := map[string]interface{}{"_id": tipDocID, "hash": rec.Hash, "seq": l.seq}
+    if l.tipRev != "" {
+        tip["_rev"] = l.tipRev
+    }
+    rev, err := l.db.SaveDocument(tip)
+    if err != nil {
+        return fmt.Errorf("failed to record audit chain tip: %w", err)
+    }
+    l.tipRev = rev
+    return nil
+}
+
+// Close does nothing; the database needs no closing.
+func (l *DatabaseLogger) Close() error {
+    return nil
+}
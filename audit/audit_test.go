@@ -0,0 +1,157 @@
+package audit
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "path/filepath"
+    "testing"
+)
+
+// TestFileLoggerChain writes records across two loggers on the same file and
+// checks the chain verifies, then that editing a record is detected.
+func TestFileLoggerChain(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+    for _, docID := range []string{"doc1", "doc2"} {
+        auditor, err := NewFileLogger(path, "alice")
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        if err := auditor.Log(Record{Instance: "10.0.0.1:5984", Database: "testdb", DocID: docID, Action: ActionReset}); err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        auditor.Close()
+    }
+
+    records, err := ReadFile(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if len(records) != 2 || records[1].PrevHash != records[0].Hash || records[0].Operator != "alice" {
+        t.Fatalf("Expected 2 chained records by alice, got %+v", records)
+    }
+    if err := Verify(records); err != nil {
+        t.Errorf("Expected the chain to verify, got %v", err)
+    }
+
+    records[0].DocID = "other"
+    if err := Verify(records); err == nil {
+        t.Errorf("Expected an edited record to be detected")
+    }
+    if err := Verify(records[1:]); err == nil {
+        t.Errorf("Expected a removed record to be detected")
+    }
+}
+
+// fakeDB records the documents created in it, and the local tip document
+// apart from them. listed counts the calls to AllDocuments.
+type fakeDB struct {
+    docs   []map[string]interface{}
+    tip    map[string]interface{}
+    listed int
+}
+
+func (f *fakeDB) CreateDocument(doc map[string]interface{}) error {
+    f.docs = append(f.docs, doc)
+    return nil
+}
+
+func (f *fakeDB) GetDocument(docID string) (map[string]interface{}, error) {
+    if f.tip == nil {
+        return nil, fmt.Errorf("document %s: %w", docID, couchdb.ErrNotFound)
+    }
+    return f.tip, nil
+}
+
+func (f *fakeDB) SaveDocument(doc map[string]interface{}) (string, error) {
+    if f.tip != nil && doc["_rev"] != f.tip["_rev"] {
+        return "", couchdb.ErrRevisionChanged
+    }
+    // Round-trip through JSON, as CouchDB would, so numbers come back as
+    // float64
+    content, _ := json.Marshal(doc)
+    json.Unmarshal(content, &f.tip)
+    f.tip["_rev"] = fmt.Sprintf("0-%d", int(f.tip["seq"].(float64)))
+    return f.tip["_rev"].(string), nil
+}
+
+func (f *fakeDB) AllDocuments() ([]map[string]interface{}, error) {
+    f.listed++
+    return f.docs, nil
+}
+
+// TestDatabaseLogger checks that records are created as documents keyed by
+// their hash.
+func TestDatabaseLogger(t *testing.T) {
+    db := &fakeDB{}
+    auditor, err := NewDatabaseLogger(db, "bob")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if err := auditor.Log(Record{DocID: "doc1", Action: ActionPurge, Revisions: []string{"2-a"}, RevisionsAffected: 1}); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if len(db.docs) != 1 {
+        t.Fatalf("Expected 1 document, got %d", len(db.docs))
+    }
+    doc := db.docs[0]
+    if doc["_id"] != doc["hash"] || doc["operator"] != "bob" || doc["action"] != ActionPurge {
+        t.Errorf("Expected a purge record by bob keyed by its hash, got %v", doc)
+    }
+}
+
+// TestDefaultOperator checks an operator name is always returned.
+func TestDefaultOperator(t *testing.T) {
+    t.Setenv("USER", "")
+    if DefaultOperator() == "" {
+        t.Errorf("Expected a non-empty operator")
+    }
+}
+
+// TestDatabaseLoggerContinuesChain checks that a new DatabaseLogger links its
+// first record to the newest record already in the database, whatever order
+// the documents are listed in.
+func TestDatabaseLoggerContinuesChain(t *testing.T) {
+    db := &fakeDB{}
+    first, err := NewDatabaseLogger(db, "bob")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    for _, docID := range []string{"doc1", "doc2", "doc3"} {
+        if err := first.Log(Record{DocID: docID, Action: ActionReset}); err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+    }
+    newest := db.docs[2]["hash"]
+    db.docs[0], db.docs[2] = db.docs[2], db.docs[0]
+
+    second, err := NewDatabaseLogger(db, "bob")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if err := second.Log(Record{DocID: "doc4", Action: ActionReset}); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if prev := db.docs[3]["prevHash"]; prev != newest {
+        t.Errorf("Expected the new record to follow %v, got %v", newest, prev)
+    }
+    if db.listed != 1 || db.tip["hash"] != db.docs[3]["hash"] || db.tip["seq"] != float64(4) {
+        t.Errorf("Expected the tip document to be used after the first logger, got %d listings and tip %v", db.listed, db.tip)
+    }
+
+    // A database written before the tip was recorded is read once to find it
+    db.tip = nil
+    newest = db.docs[3]["hash"]
+    third, err := NewDatabaseLogger(db, "bob")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if err := third.Log(Record{DocID: "doc5", Action: ActionReset}); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if prev := db.docs[4]["prevHash"]; prev != newest || db.listed != 2 || db.tip["seq"] != float64(5) {
+        t.Errorf("Expected the new record to follow %v as record 5, got %v and tip %v", newest, prev, db.tip)
+    }
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/config"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "github.com/pradeep-sanjaya/couch-revision-purge/network"
+    "net"
+    "time"
+)
+
+// runBuildIndex implements the build-index subcommand, which installs the
+// rev_filter design document and builds its index without deleting anything,
+// so a later purge run with the same views does not have to wait for it:
+//
+//     couch-revision-purge build-index -dbname=mydb (-host=10.0.0.5 | -hosts=hosts.txt) [-view=...]
+//
+// The design document is only replaced if its views differ. CouchDB keys
+// index files by the views' definitions, so the purge run recreating an
+// identical design document reuses the index built here.
+func runBuildIndex(args []string) error {
+    fs := flag.NewFlagSet("build-index", flag.ExitOnError)
+    configFile := fs.String("config", "config.json", "Path to the configuration file")
+    dbName := fs.String("dbname", "", "CouchDB database name")
+    host := fs.String("host", "", "CouchDB host, optionally with :port")
+    hostsFile := fs.String("hosts", "", "Read CouchDB instances from a hosts file")
+    mapFile := fs.String("map-file", "", "Path to a JavaScript file with the map function for the high_rev_gen view")
+    reduceFile := fs.String("reduce-file", "", "Path to a JavaScript file with an optional reduce function for the high_rev_gen view")
+    var extraViews viewFlags
+    fs.Var(&extraViews, "view", "Additional candidate view, as name=map-file or the name of a built-in view (conflicts); may be repeated")
+    onlyConflicts := fs.Bool("only-conflicts", false, "Build the index used by an --only-conflicts run")
+    fs.Parse(args)
+
+    if *dbName == "" || (*host == "") == (*hostsFile == "") {
+        return fmt.Errorf("usage: build-index -dbname=<db> (-host=<host[:port]> | -hosts=<file>) [-map-file=<file>] [-view=<view>]")
+    }
+
+    cfg, err := config.LoadConfig(*configFile)
+    if err != nil {
+        return fmt.Errorf("failed to load configuration: %v", err)
+    }
+    clientOpts, err := clientOptions(cfg)
+    if err != nil {
+        return err
+    }
+    views, err := candidateViews(*mapFile, *reduceFile, extraViews)
+    if err != nil {
+        return err
+    }
+    if *onlyConflicts {
+        views = conflictViews()
+    }
+
+    var instances []string
+    if *hostsFile != "" {
+        instances, err = network.ReadHostsFile(*hostsFile, cfg.CouchDBPort)
+        if err != nil {
+            return fmt.Errorf("failed to read hosts file: %v", err)
+        }
+    } else if _, _, err := net.SplitHostPort(*host); err == nil {
+        instances = []string{*host}
+    } else {
+        instances = []string{net.JoinHostPort(*host, cfg.CouchDBPort)}
+    }
+
+    designDoc := designDocument(views)
+    failed := 0
+    for _, instance := range instances {
+        ip, port, err := net.SplitHostPort(instance)
+        if err == nil {
+            client := couchdb.NewCouchDBClient(couchdb.BuildBaseURL(cfg.CouchDBScheme, ip, port, cfg.CouchDBPathPrefix), *dbName, clientOpts)
+            err = buildIndex(client, instance, designDoc, views[0].name)
+        }
+        if err != nil {
+            fmt.Printf("Failed to build the index on %s: %v\n", instance, err)
+            failed++
+        }
+    }
+    if failed > 0 {
+        return fmt.Errorf("failed on %d of %d instances", failed, len(instances))
+    }
+    return nil
+}
+
+// buildIndex installs designDoc as rev_filter on instance, unless an identical
+// one is already there, and waits for its index to be built by querying
+// viewName.
+func buildIndex(client couchdb.CouchDB, instance string, designDoc map[string]interface{}, viewName string) error {
+    existing, err := client.GetDesignDocument("rev_filter")
+    if err != nil && !errors.Is(err, couchdb.ErrNotFound) {
+        return fmt.Errorf("failed to fetch existing design document: %w", err)
+    }
+    if diff := couchdb.DiffDesignDocuments(existing, designDoc); len(diff) > 0 || existing == nil {
+        if existing != nil {
+            if _, err := client.CheckAndDeleteDesignDocument("rev_filter"); err != nil {
+                return fmt.Errorf("failed to delete existing design document: %w", err)
+            }
+        }
+        if _, err := client.CreateDesignDocument("rev_filter", designDoc); err != nil {
+            return fmt.Errorf("failed to create design document: %w", err)
+        }
+        fmt.Printf("Installed design document rev_filter on %s\n", instance)
+    }
+
+    start := time.Now()
+    if err := client.BuildIndex("rev_filter", viewName); err != nil {
+        if couchdb.IsTimeout(err) {
+            return fmt.Errorf("index still building on the server when the request timed out; raise requestTimeout to wait for it: %w", err)
+        }
+        return err
+    }
+    fmt.Printf("Index of rev_filter on %s is up to date after %s\n", instance, time.Since(start).Round(time.Second))
+    return nil
+}
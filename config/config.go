@@ -2,14 +2,152 @@ package config
 
 import (
     "encoding/json"
+    "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+    "net"
     "os"
+    "strconv"
+    "strings"
+    "time"
 )
 
+// Duration is a time.Duration that is read from JSON as a string such as "30s".
+type Duration struct {
+    time.Duration
+}
+
+// UnmarshalJSON parses a duration string using time.ParseDuration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    d.Duration = parsed
+    return nil
+}
+
 type Config struct {
     LogFile     string `json:"logfile"`
     CIDR        string `json:"cidr"`
     CouchDBPort string `json:"couchdbPort"`
     APIEndpoint string `json:"apiEndpoint"`
+    ScanRetries int    `json:"scanRetries"`
+
+    // APIEndpoints lists further Pulse API endpoints, such as one per region,
+    // whose expected instances are added to those of APIEndpoint.
+    APIEndpoints []string `json:"apiEndpoints"`
+
+    // ExcludeIPs and ExcludeCIDRs are skipped while scanning CIDR, without
+    // being dialed.
+    ExcludeIPs   []string `json:"excludeIPs"`
+    ExcludeCIDRs []string `json:"excludeCIDRs"`
+
+    CouchDBScheme     string `json:"couchdbScheme"`
+    CouchDBPathPrefix string `json:"couchdbPathPrefix"`
+
+    // HTTPProtocol is the HTTP version spoken to CouchDB over TLS: auto (the
+    // default), http1 or http2.
+    HTTPProtocol string `json:"httpProtocol"`
+
+    // Gzip requests gzip-compressed responses from CouchDB. Without it
+    // responses are never compressed.
+    Gzip bool `json:"gzip"`
+
+    // Socks5Proxy is the host:port of a SOCKS5 proxy, such as an ssh -D
+    // tunnel through a jump host, to reach CouchDB through. Scanning still
+    // dials directly, so use a hosts file for nodes only reachable this way.
+    Socks5Proxy string `json:"socks5Proxy"`
+
+    // ClientCertFile and ClientKeyFile are the PEM-encoded client
+    // certificate and private key presented to CouchDB servers that require
+    // mutual TLS. Both or neither must be set.
+    ClientCertFile string `json:"clientCertFile"`
+    ClientKeyFile  string `json:"clientKeyFile"`
+
+    // MaxResponseBytes bounds the size of a CouchDB response body. Zero uses
+    // a 256 MiB default and a negative value removes the limit.
+    MaxResponseBytes int64 `json:"maxResponseBytes"`
+
+    // RequestTimeout bounds each HTTP request made to CouchDB. It is separate
+    // from the short dial timeout used while scanning.
+    RequestTimeout Duration `json:"requestTimeout"`
+
+    // LatencyThreshold slows down requests to a node whose 95th percentile
+    // response time climbs above it, such as "500ms". Zero disables it.
+    LatencyThreshold Duration `json:"latencyThreshold"`
+
+    // ConflictMinGenerationAge keeps conflict revisions that are fewer than
+    // this many generations behind the current revision. Zero deletes all.
+    ConflictMinGenerationAge int `json:"conflictMinGenerationAge"`
+
+    // CredentialsFile points to a file holding the CouchDB credentials, either
+    // as "username:password" or as JSON {"user": "...", "pass": "..."}.
+    CredentialsFile string `json:"credentialsFile"`
+
+    // WriteQuorum is the number of cluster nodes that must acknowledge each
+    // document write or delete. Zero uses the server default.
+    WriteQuorum int `json:"writeQuorum"`
+
+    // ConditionalDeletes skips documents that changed between discovery and
+    // deletion instead of deleting revisions of a newer version.
+    ConditionalDeletes bool `json:"conditionalDeletes"`
+
+    // CompactionThreshold is the minimum fragmentation ratio (0 to 1) at which
+    // a database is compacted. Zero always compacts.
+    CompactionThreshold float64 `json:"compactionThreshold"`
+
+    // CompactionMaxWait bounds how long --wait-compaction waits for
+    // compaction to finish. Zero waits up to an hour.
+    CompactionMaxWait Duration `json:"compactionMaxWait"`
+
+    // APITimeout bounds each request to the Pulse API; APIRetries is the
+    // number of extra attempts after a timeout or server error.
+    APITimeout Duration `json:"apiTimeout"`
+    APIRetries int      `json:"apiRetries"`
+
+    // AuditFile, if set, is a file every reset, conflict deletion and purge
+    // is recorded to. AuditURL and AuditDatabase instead record them as
+    // documents of a CouchDB database. AuditOperator names who ran the tool
+    // in each record and defaults to the current user.
+    AuditFile     string `json:"auditFile"`
+    AuditURL      string `json:"auditURL"`
+    AuditDatabase string `json:"auditDatabase"`
+    AuditOperator string `json:"auditOperator"`
+
+    // LogTarget is where the log is written: file (the default, see LogFile),
+    // stdout or syslog.
+    LogTarget string `json:"logTarget"`
+
+    // LogLevel is the minimum level written to the log file: debug, info,
+    // warn or error. Empty means info. The --log-level flag overrides it.
+    LogLevel string `json:"logLevel"`
+
+    // SafeDBPrefix, when set, is a guard for testing against production
+    // clusters: databases whose name does not start with it, such as
+    // "sandbox_", are skipped instead of purged or deleted.
+    SafeDBPrefix string `json:"safeDBPrefix"`
+
+    // RevsLimits sets _revs_limit, the number of revisions CouchDB keeps per
+    // document, for each named database before it is purged. Databases not in
+    // the map get DefaultRevsLimit; zero leaves the server's setting alone.
+    RevsLimits       map[string]int `json:"revsLimits"`
+    DefaultRevsLimit int            `json:"defaultRevsLimit"`
+
+    // WarnRevCount warns about, and counts, every live document whose
+    // revision generation reaches this value, read from the _changes feed
+    // before purging. Zero disables the warning.
+    WarnRevCount int `json:"warnRevCount"`
+
+    // MaxDocCountDrop is a data-loss tripwire: the fraction (0 to 1) of a
+    // database's doc_count that may disappear while it is processed, beyond
+    // the documents the run removes on purpose. A bigger drop fails the
+    // instance before compaction and aborts the rest of the run. Zero
+    // disables the check.
+    MaxDocCountDrop float64 `json:"maxDocCountDrop"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -27,4 +165,157 @@ func LoadConfig(filename string) (*Config, error) {
     }
 
     return config, nil
-}
\ No newline at end of file
+}
+
+// Validate checks the configuration for values that would otherwise fail
+// later with a confusing error.
+func (c *Config) Validate() error {
+    if c.CouchDBScheme != "" && c.CouchDBScheme != "http" && c.CouchDBScheme != "https" {
+        return fmt.Errorf("couchdbScheme must be http or https, got %q", c.CouchDBScheme)
+    }
+    switch c.HTTPProtocol {
+    case "", "auto", "http1", "http2":
+    default:
+        return fmt.Errorf("httpProtocol must be auto, http1 or http2, got %q", c.HTTPProtocol)
+    }
+    if c.CouchDBPathPrefix != "" && !strings.HasPrefix(c.CouchDBPathPrefix, "/") {
+        return fmt.Errorf("couchdbPathPrefix must start with /, got %q", c.CouchDBPathPrefix)
+    }
+    if c.CouchDBPort != "" {
+        port, err := strconv.Atoi(c.CouchDBPort)
+        if err != nil || port < 1 || port > 65535 {
+            return fmt.Errorf("couchdbPort must be a number from 1 to 65535, got %q", c.CouchDBPort)
+        }
+    }
+    if c.Socks5Proxy != "" {
+        if _, _, err := net.SplitHostPort(c.Socks5Proxy); err != nil {
+            return fmt.Errorf("socks5Proxy must be host:port, got %q", c.Socks5Proxy)
+        }
+    }
+    if c.CIDR != "" {
+        if _, _, err := net.ParseCIDR(c.CIDR); err != nil {
+            return fmt.Errorf("cidr: %v", err)
+        }
+    }
+    for _, ip := range c.ExcludeIPs {
+        if net.ParseIP(ip) == nil {
+            return fmt.Errorf("excludeIPs: invalid IP address %q", ip)
+        }
+    }
+    for _, cidr := range c.ExcludeCIDRs {
+        if _, _, err := net.ParseCIDR(cidr); err != nil {
+            return fmt.Errorf("excludeCIDRs: %v", err)
+        }
+    }
+    if c.ConflictMinGenerationAge < 0 {
+        return fmt.Errorf("conflictMinGenerationAge must not be negative, got %d", c.ConflictMinGenerationAge)
+    }
+    if c.WriteQuorum < 0 {
+        return fmt.Errorf("writeQuorum must not be negative, got %d", c.WriteQuorum)
+    }
+    if c.CompactionThreshold < 0 || c.CompactionThreshold > 1 {
+        return fmt.Errorf("compactionThreshold must be between 0 and 1, got %g", c.CompactionThreshold)
+    }
+    if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+        return fmt.Errorf("clientCertFile and clientKeyFile must be set together")
+    }
+    if c.MaxDocCountDrop < 0 || c.MaxDocCountDrop > 1 {
+        return fmt.Errorf("maxDocCountDrop must be between 0 and 1, got %g", c.MaxDocCountDrop)
+    }
+    if c.RequestTimeout.Duration < 0 {
+        return fmt.Errorf("requestTimeout must not be negative, got %s", c.RequestTimeout)
+    }
+    if c.WarnRevCount < 0 {
+        return fmt.Errorf("warnRevCount must not be negative, got %d", c.WarnRevCount)
+    }
+    if c.WarnRevCount == 1 {
+        return fmt.Errorf("warnRevCount of 1 would warn about every document; use 0 to disable it")
+    }
+    if c.DefaultRevsLimit < 0 {
+        return fmt.Errorf("defaultRevsLimit must not be negative, got %d", c.DefaultRevsLimit)
+    }
+    for dbName, limit := range c.RevsLimits {
+        if limit <= 0 {
+            return fmt.Errorf("revsLimits[%q] must be positive, got %d", dbName, limit)
+        }
+    }
+    switch c.LogTarget {
+    case "", "file", "stdout", "syslog":
+    default:
+        return fmt.Errorf("logTarget must be file, stdout or syslog, got %q", c.LogTarget)
+    }
+    if (c.AuditURL == "") != (c.AuditDatabase == "") {
+        return fmt.Errorf("auditURL and auditDatabase must be set together")
+    }
+    if c.AuditFile != "" && c.AuditURL != "" {
+        return fmt.Errorf("auditFile and auditURL are mutually exclusive")
+    }
+    if c.CompactionMaxWait.Duration < 0 {
+        return fmt.Errorf("compactionMaxWait must not be negative, got %s", c.CompactionMaxWait)
+    }
+    if c.LatencyThreshold.Duration < 0 {
+        return fmt.Errorf("latencyThreshold must not be negative, got %s", c.LatencyThreshold)
+    }
+    if c.LogLevel != "" {
+        if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+            return fmt.Errorf("logLevel: %v", err)
+        }
+    }
+    return nil
+}
+
+// Endpoints returns every configured Pulse API endpoint: APIEndpoint, if set,
+// followed by APIEndpoints.
+func (c *Config) Endpoints() []string {
+    var endpoints []string
+    if c.APIEndpoint != "" {
+        endpoints = append(endpoints, c.APIEndpoint)
+    }
+    return append(endpoints, c.APIEndpoints...)
+}
+
+// AllowsDatabase reports whether dbName may be changed: always, unless
+// SafeDBPrefix is set and dbName does not start with it.
+func (c *Config) AllowsDatabase(dbName string) bool {
+    return strings.HasPrefix(dbName, c.SafeDBPrefix)
+}
+
+// RevsLimitFor returns the _revs_limit to set on dbName: its entry in
+// RevsLimits, else DefaultRevsLimit. Zero means leave it unchanged.
+func (c *Config) RevsLimitFor(dbName string) int {
+    if limit, ok := c.RevsLimits[dbName]; ok {
+        return limit
+    }
+    return c.DefaultRevsLimit
+}
+
+// LoadCredentials reads a username and password from filename. The file holds
+// either a single "username:password" line or a JSON object with "user" and
+// "pass" fields.
+func LoadCredentials(filename string) (string, string, error) {
+    content, err := os.ReadFile(filename)
+    if err != nil {
+        return "", "", fmt.Errorf("failed to read credentials file: %v", err)
+    }
+
+    text := strings.TrimSpace(string(content))
+    if strings.HasPrefix(text, "{") {
+        var creds struct {
+            User string `json:"user"`
+            Pass string `json:"pass"`
+        }
+        if err := json.Unmarshal([]byte(text), &creds); err != nil {
+            return "", "", fmt.Errorf("malformed credentials file %s: %v", filename, err)
+        }
+        if creds.User == "" {
+            return "", "", fmt.Errorf("malformed credentials file %s: user is empty", filename)
+        }
+        return creds.User, creds.Pass, nil
+    }
+
+    user, pass, found := strings.Cut(text, ":")
+    if !found || user == "" || strings.Contains(pass, "\n") {
+        return "", "", fmt.Errorf("malformed credentials file %s: expected username:password", filename)
+    }
+    return user, pass, nil
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// TestLoadCredentials reads credentials files in both supported formats and
+// checks that malformed files are rejected.
+func TestLoadCredentials(t *testing.T) {
+    tests := []struct {
+        name     string
+        content  string
+        user     string
+        pass     string
+        hasError bool
+    }{
+        {"plain", "admin:secret\n", "admin", "secret", false},
+        {"plain with colon in password", "admin:se:cret", "admin", "se:cret", false},
+        {"plain empty password", "admin:", "admin", "", false},
+        {"json", `{"user": "admin", "pass": "secret"}`, "admin", "secret", false},
+        {"json surrounded by whitespace", "\n  {\"user\": \"admin\", \"pass\": \"secret\"}\n", "admin", "secret", false},
+        {"missing separator", "admin", "", "", true},
+        {"empty user", ":secret", "", "", true},
+        {"several lines", "admin:secret\nother:line", "", "", true},
+        {"empty file", "", "", "", true},
+        {"malformed json", `{"user": "admin"`, "", "", true},
+        {"json without user", `{"pass": "secret"}`, "", "", true},
+    }
+
+    dir := t.TempDir()
+    for _, tt := range tests {
+        filename := filepath.Join(dir, "credentials")
+        if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+
+        user, pass, err := LoadCredentials(filename)
+        if tt.hasError {
+            if err == nil {
+                t.Errorf("%s: expected an error, got user %q", tt.name, user)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: expected no error, got %v", tt.name, err)
+            continue
+        }
+        if user != tt.user || pass != tt.pass {
+            t.Errorf("%s: expected %q/%q, got %q/%q", tt.name, tt.user, tt.pass, user, pass)
+        }
+    }
+
+    if _, _, err := LoadCredentials(filepath.Join(dir, "missing")); err == nil {
+        t.Errorf("Expected an error for a missing file")
+    }
+}
+
+// TestValidateWarnRevCount checks the accepted values of warnRevCount.
+func TestValidateWarnRevCount(t *testing.T) {
+    for count, valid := range map[int]bool{-1: false, 0: true, 1: false, 2: true, 500: true} {
+        err := (&Config{WarnRevCount: count}).Validate()
+        if valid && err != nil {
+            t.Errorf("warnRevCount %d: expected no error, got %v", count, err)
+        }
+        if !valid && err == nil {
+            t.Errorf("warnRevCount %d: expected an error", count)
+        }
+    }
+}
+
+// TestValidateClientCert checks that a client certificate and key are only
+// accepted together.
+func TestValidateClientCert(t *testing.T) {
+    if err := (&Config{ClientCertFile: "client.pem", ClientKeyFile: "client.key"}).Validate(); err != nil {
+        t.Errorf("Expected no error, got %v", err)
+    }
+    if err := (&Config{ClientCertFile: "client.pem"}).Validate(); err == nil {
+        t.Errorf("Expected an error for a certificate without a key")
+    }
+}
+
+// TestValidateCouchDBPort checks that only ports from 1 to 65535 are accepted.
+func TestValidateCouchDBPort(t *testing.T) {
+    tests := []struct {
+        port  string
+        valid bool
+    }{
+        {"", true},
+        {"5984", true},
+        {"1", true},
+        {"65535", true},
+        {"5984a", false},
+        {"0", false},
+        {"65536", false},
+        {"-1", false},
+        {" 5984", false},
+        {"http", false},
+    }
+
+    for _, tt := range tests {
+        err := (&Config{CouchDBPort: tt.port}).Validate()
+        if tt.valid && err != nil {
+            t.Errorf("port %q: expected no error, got %v", tt.port, err)
+        }
+        if !tt.valid && err == nil {
+            t.Errorf("port %q: expected an error", tt.port)
+        }
+    }
+}
+
+// TestValidateSchemeAndPathPrefix checks the accepted values of couchdbScheme
+// and couchdbPathPrefix.
+func TestValidateSchemeAndPathPrefix(t *testing.T) {
+    tests := []struct {
+        scheme     string
+        pathPrefix string
+        valid      bool
+    }{
+        {"", "", true},
+        {"http", "", true},
+        {"https", "/couchdb", true},
+        {"", "/couchdb/", true},
+        {"ftp", "", false},
+        {"HTTPS", "", false},
+        {"http", "couchdb", false},
+    }
+
+    for _, tt := range tests {
+        err := (&Config{CouchDBScheme: tt.scheme, CouchDBPathPrefix: tt.pathPrefix}).Validate()
+        if tt.valid && err != nil {
+            t.Errorf("scheme %q, path prefix %q: expected no error, got %v", tt.scheme, tt.pathPrefix, err)
+        }
+        if !tt.valid && err == nil {
+            t.Errorf("scheme %q, path prefix %q: expected an error", tt.scheme, tt.pathPrefix)
+        }
+    }
+}
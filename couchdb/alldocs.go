@@ -0,0 +1,116 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// AllDocsRow is a single row of an _all_docs response. Keys that do not
+// exist come back with Error set to "not_found" and no ID.
+type AllDocsRow struct {
+    ID    string `json:"id"`
+    Key   string `json:"key"`
+    Value struct {
+        Rev     string `json:"rev"`
+        Deleted bool   `json:"deleted,omitempty"`
+    } `json:"value"`
+    Doc   map[string]interface{} `json:"doc,omitempty"`
+    Error string                 `json:"error,omitempty"`
+}
+
+// AllDocsResponse represents the structure of an _all_docs response.
+type AllDocsResponse struct {
+    TotalRows int          `json:"total_rows"`
+    Offset    int          `json:"offset"`
+    Rows      []AllDocsRow `json:"rows"`
+}
+
+// Missing returns the keys that were not found.
+func (r *AllDocsResponse) Missing() []string {
+    var missing []string
+    for _, row := range r.Rows {
+        if row.Error == "not_found" {
+            missing = append(missing, row.Key)
+        }
+    }
+    return missing
+}
+
+// GetDocsByKeys fetches the documents with the given IDs in a single
+// _all_docs request. With includeDocs each found row carries the document
+// body in Doc.
+func (c *CouchDBClient) GetDocsByKeys(keys []string, includeDocs bool) (*AllDocsResponse, error) {
+    url := c.dbURL() + "/_all_docs"
+    if includeDocs {
+        url += "?include_docs=true"
+    }
+
+    payload, err := json.Marshal(map[string]interface{}{"keys": keys})
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := c.HTTPClient.Post(url, "application/json", bytes.NewBuffer(payload))
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch documents: %s", string(body))
+    }
+
+    var response AllDocsResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, err
+    }
+
+    return &response, nil
+}
+
+// AllDocuments returns the body of every document in the database, leaving
+// out design documents.
+func (c *CouchDBClient) AllDocuments() ([]map[string]interface{}, error) {
+    resp, err := c.HTTPClient.Get(c.dbURL() + "/_all_docs?include_docs=true")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch documents: %s", string(body))
+    }
+
+    var response AllDocsResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, err
+    }
+
+    var docs []map[string]interface{}
+    for _, row := range response.Rows {
+        if row.Doc != nil && !strings.HasPrefix(row.ID, "_design/") {
+            docs = append(docs, row.Doc)
+        }
+    }
+    return docs, nil
+}
@@ -0,0 +1,87 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// AuthMode is how a node treats requests without credentials.
+type AuthMode int
+
+const (
+    // AuthRequired means anonymous requests are not admins, so admin
+    // endpoints need credentials.
+    AuthRequired AuthMode = iota
+    // AuthAdminParty means every request, anonymous or not, is an admin,
+    // as on CouchDB 2.x nodes that have no admin configured.
+    AuthAdminParty
+)
+
+// String returns a description of the mode for log messages.
+func (m AuthMode) String() string {
+    switch m {
+    case AuthRequired:
+        return "authentication required"
+    case AuthAdminParty:
+        return "admin party"
+    }
+    return fmt.Sprintf("AuthMode(%d)", int(m))
+}
+
+// anonymousKey marks a request context whose request must be sent without
+// the client's credentials.
+type anonymousKey struct{}
+
+// anonymous reports whether req is to be sent without credentials.
+func anonymous(req *http.Request) bool {
+    value, _ := req.Context().Value(anonymousKey{}).(bool)
+    return value
+}
+
+// DetectAuthMode asks /_session, without credentials, which roles an
+// anonymous request has. A node that makes anonymous requests admins is in
+// admin party.
+func (c *CouchDBClient) DetectAuthMode() (AuthMode, error) {
+    ctx := context.WithValue(context.Background(), anonymousKey{}, true)
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/_session", nil)
+    if err != nil {
+        return AuthRequired, err
+    }
+    req.Header.Set("Accept", "application/json")
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return AuthRequired, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return AuthRequired, err
+    }
+
+    // With require_valid_user set, even /_session refuses anonymous requests.
+    if resp.StatusCode == http.StatusUnauthorized {
+        return AuthRequired, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return AuthRequired, fmt.Errorf("failed to fetch session: %s", string(body))
+    }
+
+    var session struct {
+        UserCtx struct {
+            Roles []string `json:"roles"`
+        } `json:"userCtx"`
+    }
+    if err := json.Unmarshal(body, &session); err != nil {
+        return AuthRequired, err
+    }
+    for _, role := range session.UserCtx.Roles {
+        if role == "_admin" {
+            return AuthAdminParty, nil
+        }
+    }
+    return AuthRequired, nil
+}
@@ -0,0 +1,203 @@
+package couchdb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// ResetStrategy selects how ResetDocument resets a document.
+type ResetStrategy int
+
+const (
+    // ResetRecreate deletes every revision of the document and recreates it
+    // as a new document. Its revision history starts over, so replicas that
+    // still hold the old history see a conflict.
+    ResetRecreate ResetStrategy = iota
+    // ResetBulkDocs purges the document and writes its current revision
+    // back with _bulk_docs and new_edits=false, with a history of only that
+    // revision, and a tombstone on top of every other leaf. Revision IDs are
+    // preserved, so replication converges, and running it twice writes the
+    // same revisions. It needs _purge, so CouchDB 2.3 or later.
+    ResetBulkDocs
+    // ResetRemove deletes every revision of the document like ResetRecreate,
+    // then purges it instead of recreating it. The document is gone
+    // afterwards, history and all. It is selected with --no-recreate rather
+    // than by name, so that it is never chosen by accident.
+    ResetRemove
+)
+
+// ParseResetStrategy converts a strategy name, "recreate" or "bulk-docs", to
+// a ResetStrategy.
+func ParseResetStrategy(name string) (ResetStrategy, error) {
+    switch name {
+    case "", "recreate":
+        return ResetRecreate, nil
+    case "bulk-docs":
+        return ResetBulkDocs, nil
+    }
+    return ResetRecreate, fmt.Errorf("unknown reset strategy %q, expected recreate or bulk-docs", name)
+}
+
+// RewriteDocument drops the revision history of a document while keeping
+// its revision ID: it purges every leaf, then writes the document back at
+// revision rev with _bulk_docs and new_edits=false, its _revisions listing
+// rev alone. Writing it without the purge would be a no-op, as CouchDB
+// already has rev and merges the history. Every other leaf is deleted by a
+// tombstone on top of it, so replicas still holding it converge. The
+// tombstone revision IDs are derived from the revisions they delete, so the
+// rewrite is idempotent. It returns the number of leaf revisions deleted.
+func (c *CouchDBClient) RewriteDocument(docID, rev string) (int, error) {
+    leaves, err := c.leafRevisions(docID)
+    if err != nil {
+        return 0, err
+    }
+
+    url := withQuery(c.documentURL(docID), neturl.Values{"rev": {rev}, "revs": {"true"}})
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return 0, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return 0, fmt.Errorf("document %s at %s: %w", docID, rev, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("failed to fetch document revision: %s", string(body))
+    }
+
+    var doc map[string]interface{}
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return 0, err
+    }
+
+    gen, err := RevGeneration(rev)
+    if err != nil {
+        return 0, err
+    }
+    doc["_revisions"] = map[string]interface{}{"start": gen, "ids": []string{revHash(rev)}}
+    docs := []map[string]interface{}{doc}
+
+    for _, leaf := range leaves {
+        if leaf == rev {
+            continue
+        }
+        leafGen, err := RevGeneration(leaf)
+        if err != nil {
+            return 0, err
+        }
+        tombstone := tombstoneHash(docID, leaf)
+        docs = append(docs, map[string]interface{}{
+            "_id":        docID,
+            "_rev":       fmt.Sprintf("%d-%s", leafGen+1, tombstone),
+            "_deleted":   true,
+            "_revisions": map[string]interface{}{"start": leafGen + 1, "ids": []string{tombstone, revHash(leaf)}},
+        })
+    }
+
+    if _, err := c.PurgeDocuments(map[string][]string{docID: leaves}); err != nil {
+        return 0, fmt.Errorf("failed to purge document history: %w", err)
+    }
+    if err := c.bulkDocsNoNewEdits(docs); err != nil {
+        return 0, err
+    }
+    return len(docs) - 1, nil
+}
+
+// leafRevisions returns the winning revision of a document followed by its
+// conflicting leaf revisions.
+func (c *CouchDBClient) leafRevisions(docID string) ([]string, error) {
+    url := withQuery(c.documentURL(docID), neturl.Values{"conflicts": {"true"}})
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("document %s: %w", docID, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch document: %s", string(body))
+    }
+
+    var doc struct {
+        Rev       string   `json:"_rev"`
+        Conflicts []string `json:"_conflicts"`
+    }
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return nil, err
+    }
+    return append([]string{doc.Rev}, doc.Conflicts...), nil
+}
+
+// bulkDocsNoNewEdits writes docs exactly as given, revision IDs included,
+// with _bulk_docs and new_edits=false.
+func (c *CouchDBClient) bulkDocsNoNewEdits(docs []map[string]interface{}) error {
+    url := c.withWriteQuorum(c.dbURL() + "/_bulk_docs")
+
+    payload, err := json.Marshal(map[string]interface{}{"docs": docs, "new_edits": false})
+    if err != nil {
+        return err
+    }
+
+    resp, err := c.HTTPClient.Post(url, "application/json", bytes.NewBuffer(payload))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    if resp.StatusCode != http.StatusCreated {
+        return fmt.Errorf("failed to write documents: %s", string(body))
+    }
+
+    var results []struct {
+        ID     string `json:"id"`
+        Error  string `json:"error"`
+        Reason string `json:"reason"`
+    }
+    if err := json.Unmarshal(body, &results); err != nil {
+        return err
+    }
+    for _, result := range results {
+        if result.Error != "" {
+            return fmt.Errorf("failed to write document %s: %s: %s", result.ID, result.Error, result.Reason)
+        }
+    }
+    return nil
+}
+
+// revHash returns the hash part of a revision ID such as "3-abc".
+func revHash(rev string) string {
+    _, hash, _ := strings.Cut(rev, "-")
+    return hash
+}
+
+// tombstoneHash derives the hash of the tombstone written on top of rev, so
+// deleting the same revision twice produces the same tombstone.
+func tombstoneHash(docID, rev string) string {
+    sum := md5.Sum([]byte(docID + "\x00" + rev + "\x00deleted"))
+    return hex.EncodeToString(sum[:])
+}
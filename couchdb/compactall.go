@@ -0,0 +1,166 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pradeep-sanjaya/couch-revision-purge/logger"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CompactAllOptions configures CompactAll.
+type CompactAllOptions struct {
+    // Concurrency is the number of databases whose compaction is triggered
+    // at once. Values below 1 mean one at a time.
+    Concurrency int
+
+    // IncludeSystem also compacts system databases, whose names start with
+    // an underscore, such as _users and _replicator.
+    IncludeSystem bool
+
+    // Jitter, when positive, delays the start of each database's compaction
+    // by a random time up to Jitter, so concurrent workers do not all hit the
+    // cluster at once.
+    Jitter time.Duration
+
+    // Allow, when set, reports whether a database may be compacted; those it
+    // rejects are left out, like a --db-allowlist would.
+    Allow func(dbName string) bool
+
+    // Threshold is the fragmentation ratio a database must reach to be
+    // compacted. Zero compacts every database.
+    Threshold float64
+
+    // QuiesceWindow, when positive, waits for each database's update_seq to
+    // stay unchanged for a whole window before compacting it, and skips the
+    // database if it never does.
+    QuiesceWindow time.Duration
+
+    // sleep, when set, replaces time.Sleep for the jitter.
+    sleep func(time.Duration)
+}
+
+// forDatabase returns a client for the database dbName on the same instance,
+// sharing c's HTTP client and settings.
+func (c *CouchDBClient) forDatabase(dbName string) *CouchDBClient {
+    return &CouchDBClient{
+        BaseURL:     c.BaseURL,
+        DBName:      dbName,
+        HTTPClient:  c.HTTPClient,
+        WriteQuorum: c.WriteQuorum,
+
+        ConditionalDeletes: c.ConditionalDeletes,
+        VerifyResets:       c.VerifyResets,
+        ResetStrategy:      c.ResetStrategy,
+        Output:             c.Output,
+    }
+}
+
+// CompactAll triggers compaction of the other databases on the instance, the
+// client's own being left out, opts.Concurrency at a time, logging each one.
+// Databases opts.Allow rejects, or below opts.Threshold, are skipped. A
+// failure on one database does not stop the others. It returns the number of databases
+// compaction was triggered on and an error joining the failures, if any.
+// Compaction itself carries on in the background on the server.
+func (c *CouchDBClient) CompactAll(opts CompactAllOptions, logger *logger.Logger) (int, error) {
+    names, err := c.ListDatabases()
+    if err != nil {
+        return 0, fmt.Errorf("failed to list databases: %w", err)
+    }
+    var databases []string
+    for _, name := range names {
+        if name == c.DBName || (!opts.IncludeSystem && strings.HasPrefix(name, "_")) {
+            continue
+        }
+        if opts.Allow != nil && !opts.Allow(name) {
+            logger.Debugf("Skipping compaction of database %s: not allowed by the configuration", name)
+            continue
+        }
+        databases = append(databases, name)
+    }
+
+    concurrency := opts.Concurrency
+    if concurrency < 1 {
+        concurrency = 1
+    }
+
+    var (
+        mu        sync.Mutex
+        wg        sync.WaitGroup
+        compacted int
+        errs      []error
+    )
+    sem := make(chan struct{}, concurrency)
+    for i, name := range databases {
+        sem <- struct{}{}
+        wg.Add(1)
+        go func(i int, name string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            if delay := jitterDelay(opts.Jitter); delay > 0 {
+                if opts.sleep != nil {
+                    opts.sleep(delay)
+                } else {
+                    time.Sleep(delay)
+                }
+            }
+            compact, err := c.forDatabase(name).compactIfNeeded(opts, logger)
+
+            mu.Lock()
+            defer mu.Unlock()
+            if err != nil {
+                logger.Errorf("Failed to compact database %s (%d of %d): %v", name, i+1, len(databases), err)
+                errs = append(errs, fmt.Errorf("%s: %w", name, err))
+                return
+            }
+            if !compact {
+                return
+            }
+            compacted++
+            logger.Printf("Compaction of database %s triggered (%d of %d)", name, i+1, len(databases))
+        }(i, name)
+    }
+    wg.Wait()
+    return compacted, errors.Join(errs...)
+}
+
+// jitterDelay returns a random delay in [0, max), or zero if max is not
+// positive.
+func jitterDelay(max time.Duration) time.Duration {
+    if max <= 0 {
+        return 0
+    }
+    return time.Duration(rand.Int63n(int64(max)))
+}
+
+// compactIfNeeded triggers compaction of c's database if its fragmentation
+// reaches opts.Threshold and, with opts.QuiesceWindow, once writes to it have
+// stopped. It reports whether compaction was triggered.
+func (c *CouchDBClient) compactIfNeeded(opts CompactAllOptions, logger *logger.Logger) (bool, error) {
+    if opts.Threshold > 0 {
+        needed, ratio, err := c.NeedsCompaction(opts.Threshold)
+        if err != nil {
+            return false, fmt.Errorf("failed to check fragmentation: %w", err)
+        }
+        if !needed {
+            logger.Printf("Skipping compaction of database %s: fragmentation %.1f%% is below the %.1f%% threshold", c.DBName, ratio*100, opts.Threshold*100)
+            return false, nil
+        }
+    }
+    if opts.QuiesceWindow > 0 {
+        err := c.WaitForQuiescence(opts.QuiesceWindow)
+        if errors.Is(err, ErrNotQuiescent) {
+            logger.Warnf("Skipping compaction of database %s: %v", c.DBName, err)
+            return false, nil
+        }
+        if err != nil {
+            return false, fmt.Errorf("failed to wait for writes to stop: %w", err)
+        }
+    }
+    if _, err := c.CompactDatabase(); err != nil {
+        return false, err
+    }
+    return true, nil
+}
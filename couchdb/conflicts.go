@@ -0,0 +1,101 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+)
+
+// ConflictDoc is a document with live conflicts, as found by GetAllConflicts.
+type ConflictDoc struct {
+    ID        string   `json:"id"`
+    Rev       string   `json:"rev"`
+    Conflicts []string `json:"conflicts"`
+}
+
+// GetAllConflicts reads every document in the database through _all_docs
+// with conflicts=true, pageSize documents at a time, and returns the ones
+// with live conflicts. Unlike the candidate views it does not depend on what
+// a map function emits. Only the IDs and revisions of conflicted documents are
+// kept, so memory use is bounded by a page of bodies rather than the
+// database. pageSize must be positive.
+func (c *CouchDBClient) GetAllConflicts(pageSize int) ([]ConflictDoc, error) {
+    if pageSize <= 0 {
+        return nil, fmt.Errorf("page size must be positive, got %d", pageSize)
+    }
+    var conflicted []ConflictDoc
+    startKey := ""
+    for {
+        query := neturl.Values{
+            "conflicts":    {"true"},
+            "include_docs": {"true"},
+            "limit":        {strconv.Itoa(pageSize)},
+        }
+        if startKey != "" {
+            key, err := json.Marshal(startKey)
+            if err != nil {
+                return nil, err
+            }
+            query.Set("startkey", string(key))
+            query.Set("skip", "1")
+        }
+        resp, err := c.HTTPClient.Get(withQuery(c.dbURL()+"/_all_docs", query))
+        if err != nil {
+            return nil, err
+        }
+        body, err := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+
+        if resp.StatusCode == http.StatusNotFound {
+            return nil, fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+        }
+        if resp.StatusCode != http.StatusOK {
+            return nil, fmt.Errorf("failed to fetch conflicts: %s", string(body))
+        }
+
+        var page struct {
+            Rows []struct {
+                ID  string `json:"id"`
+                Doc struct {
+                    Rev       string   `json:"_rev"`
+                    Conflicts []string `json:"_conflicts"`
+                } `json:"doc"`
+            } `json:"rows"`
+        }
+        if err := json.Unmarshal(body, &page); err != nil {
+            return nil, err
+        }
+        for _, row := range page.Rows {
+            if len(row.Doc.Conflicts) > 0 {
+                conflicted = append(conflicted, ConflictDoc{ID: row.ID, Rev: row.Doc.Rev, Conflicts: row.Doc.Conflicts})
+            }
+        }
+        if len(page.Rows) < pageSize {
+            return conflicted, nil
+        }
+        startKey = page.Rows[len(page.Rows)-1].ID
+    }
+}
+
+// ResolveConflicts finds every document with live conflicts with
+// GetAllConflicts and deletes its losing revisions, leaving the winning one,
+// as HandleQueryResponse does for the deleted conflicts of view rows. opts
+// applies as it does there, except that Seen is ignored: a document whose
+// deleted conflicts were handled may still have live ones.
+func (c *CouchDBClient) ResolveConflicts(pageSize int, opts HandleOptions) (HandleResult, error) {
+    conflicted, err := c.GetAllConflicts(pageSize)
+    if err != nil {
+        return HandleResult{}, err
+    }
+    candidates := make([]Document, 0, len(conflicted))
+    for _, doc := range conflicted {
+        candidates = append(candidates, Document{ID: doc.ID, Rev: doc.Rev, Conflicts: doc.Conflicts})
+    }
+    return c.handleDocuments(candidates, func(doc Document) []string { return doc.Conflicts }, opts)
+}
@@ -1,21 +1,119 @@
 package couchdb
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"mime"
 	"github.com/pradeep-sanjaya/couch-revision-purge/logger"
 	"net"
-	"time"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// ErrNotFound is returned when CouchDB responds with 404 Not Found, for example
+// because the database or document does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrRevisionChanged is returned by conditional operations when a document's
+// current revision no longer matches the revision it was read at.
+var ErrRevisionChanged = errors.New("document revision changed")
+
+// ErrNotCouchDB is returned when a server answers, but not as CouchDB, for
+// example because another web server is listening on the port.
+var ErrNotCouchDB = errors.New("not a CouchDB instance")
+
+// ErrDocumentMismatch is returned when a recreated document does not read back
+// with the body that was written.
+var ErrDocumentMismatch = errors.New("document does not match what was written")
+
+// ErrUnauthorized is returned when CouchDB responds with 401 Unauthorized or
+// 403 Forbidden, typically because an endpoint requires admin credentials.
+var ErrUnauthorized = errors.New("not authorized")
+
+// ErrResponseTooLarge is returned when reading a response body larger than
+// the client's maximum response size.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// CouchDB is the set of operations the purge pipeline performs against a
+// CouchDB database. *CouchDBClient implements it; tests can supply a fake.
+type CouchDB interface {
+    ServerVersion() (string, error)
+    ActiveReplications() ([]Replication, error)
+    GetChanges(opts ChangesOptions) (*ChangesResponse, error)
+    ResetDocument(docID string, logger *logger.Logger, validate DocumentValidator) (*ResetResult, error)
+    CheckAndDeleteDesignDocument(designDocName string) (string, error)
+    CreateDesignDocument(designDocName string, designDoc map[string]interface{}) (string, error)
+    QueryDesignDocument(designDocName string) (string, error)
+    QueryDesignDocumentPage(designDocName, viewName string, limit int, bookmark string) (string, string, error)
+    QueryDesignDocumentKeys(designDocName, viewName string, keys []string) (string, error)
+    HandleQueryResponse(queryResponse []byte, opts HandleOptions) (HandleResult, error)
+    ResolveConflicts(pageSize int, opts HandleOptions) (HandleResult, error)
+    CompactDatabase() (string, error)
+    CompactAll(opts CompactAllOptions, logger *logger.Logger) (int, error)
+    WaitForCompaction(interval, maxWait time.Duration, logger *logger.Logger) error
+    WaitForQuiescence(window time.Duration) error
+    CleanupViews() (string, error)
+    GetSecurity() (map[string]interface{}, error)
+    SetSecurity(security map[string]interface{}) error
+    FindDeletedDocuments(pageSize int) (map[string][]string, error)
+    FindDocsOverRevCount(threshold, pageSize int) ([]DocRevCount, error)
+    PurgeDocuments(revs map[string][]string) (*PurgeResponse, error)
+    NeedsCompaction(threshold float64) (bool, float64, error)
+    GetDatabaseInfo() (*DatabaseInfo, error)
+    CreateDatabase() error
+    SetRevsLimit(limit int) error
+    EnsureFullCommit() error
+    ClusterSetupState() (string, error)
+    DetectAuthMode() (AuthMode, error)
+    Up() error
+    GetDesignDocument(designDocName string) (map[string]interface{}, error)
+    DesignDocumentETag(designDocName string) string
+    RememberDesignDocument(designDocName, etag string, designDoc map[string]interface{})
+    BuildIndex(designDocName, viewName string) error
+}
+
 // CouchDBClient is a client for interacting with a CouchDB instance.
 type CouchDBClient struct {
-    BaseURL string
-    DBName  string
+    BaseURL    string
+    DBName     string
+    HTTPClient *http.Client
+
+    // WriteQuorum is sent as the w parameter on document writes and deletes.
+    // CouchDB answers 202 Accepted instead of 200/201 when the quorum is not
+    // met, which the write methods treat as a failure. Zero uses the server
+    // default.
+    WriteQuorum int
+
+    // ConditionalDeletes makes destructive operations confirm the document is
+    // still at the revision it was read at before deleting anything.
+    ConditionalDeletes bool
+
+    // VerifyResets makes ResetDocument re-read a recreated document and
+    // compare it with the original, at the cost of an extra read.
+    VerifyResets bool
+
+    // ResetStrategy selects how ResetDocument resets a document.
+    ResetStrategy ResetStrategy
+
+    // Output receives progress messages about individual revisions and
+    // conflicts. NewCouchDBClient sets it to os.Stdout unless overridden.
+    Output io.Writer
+
+    // designs holds the design documents read so far, by URL.
+    designs designCache
 }
 
 // Document represents a document returned from a CouchDB query, including potential conflicts.
@@ -23,19 +121,145 @@ type Document struct {
     ID              string   `json:"_id"`
     Rev             string   `json:"_rev"`
     DeletedConflicts []string `json:"_deleted_conflicts,omitempty"`
+    Conflicts        []string `json:"_conflicts,omitempty"`
 }
 
-// QueryResponse represents the structure of a CouchDB query response.
+// QueryResponse represents the structure of a CouchDB query response. Keys
+// and values are kept as emitted, so views of any shape can be read.
 type QueryResponse struct {
     TotalRows int `json:"total_rows"`
     Offset    int `json:"offset"`
-    Rows      []struct {
-        ID    string   `json:"id"`
-        Key   string   `json:"key"`
-        Value Document `json:"value"`
-    } `json:"rows"`
+    Rows      []ViewRow `json:"rows"`
+}
+
+// ViewRow is one row of a view query.
+type ViewRow struct {
+    ID    string          `json:"id"`
+    Key   json.RawMessage `json:"key"`
+    Value ViewValue       `json:"value"`
 }
 
+// Document returns the document the row refers to: the one emitted as its
+// value, if any. When the value is not a document, or lacks an _id, the ID
+// is taken from the row's id and, for rows without one such as those of a
+// reduced view, from the key if it is a string. The ID is empty if none of
+// these gives one.
+func (r ViewRow) Document() Document {
+    doc := r.Value.Document()
+    if doc.ID == "" {
+        doc.ID = r.ID
+    }
+    if doc.ID == "" {
+        json.Unmarshal(r.Key, &doc.ID)
+    }
+    return doc
+}
+
+// ViewValue is the value a view emitted for a row. The JSON is kept as it
+// is in Raw and, when it is an object such as the whole document, decoded
+// into Fields so any emitted field can be inspected.
+type ViewValue struct {
+    Raw    json.RawMessage
+    Fields map[string]interface{}
+}
+
+// UnmarshalJSON keeps data and decodes it into Fields if it is an object.
+func (v *ViewValue) UnmarshalJSON(data []byte) error {
+    v.Raw = append(json.RawMessage(nil), data...)
+    v.Fields = nil
+    if len(data) > 0 && data[0] == '{' {
+        return json.Unmarshal(data, &v.Fields)
+    }
+    return nil
+}
+
+// MarshalJSON returns the value as it was emitted.
+func (v ViewValue) MarshalJSON() ([]byte, error) {
+    if len(v.Raw) == 0 {
+        return []byte("null"), nil
+    }
+    return v.Raw, nil
+}
+
+// Document returns the _id, _rev and _deleted_conflicts of the value. It is
+// empty when the view did not emit a document.
+func (v ViewValue) Document() Document {
+    var doc Document
+    if v.Fields != nil {
+        json.Unmarshal(v.Raw, &doc)
+    }
+    return doc
+}
+
+// Seq is a database update sequence. CouchDB 1.x reports sequences as numbers
+// and 2.x and later as opaque strings, so both are decoded into a string.
+type Seq string
+
+// UnmarshalJSON decodes either a numeric or a string sequence.
+func (s *Seq) UnmarshalJSON(data []byte) error {
+    var str string
+    if err := json.Unmarshal(data, &str); err == nil {
+        *s = Seq(str)
+        return nil
+    }
+    var num json.Number
+    if err := json.Unmarshal(data, &num); err != nil {
+        return err
+    }
+    *s = Seq(num.String())
+    return nil
+}
+
+// ChangesOptions controls a _changes request.
+type ChangesOptions struct {
+    // Since is the sequence to start after. Empty means from the beginning.
+    Since string
+    // Limit caps the number of results returned. Zero means no limit.
+    Limit int
+    // AllDocs requests style=all_docs so every leaf revision is listed,
+    // not just the winning one.
+    AllDocs bool
+}
+
+// ChangeResult is a single row of a _changes response.
+type ChangeResult struct {
+    Seq     Seq    `json:"seq"`
+    ID      string `json:"id"`
+    Deleted bool   `json:"deleted,omitempty"`
+    Changes []struct {
+        Rev string `json:"rev"`
+    } `json:"changes"`
+}
+
+// RevisionCount returns the number of revisions reported for the change. With
+// style=all_docs this is the number of leaf revisions of the document.
+func (r ChangeResult) RevisionCount() int {
+    return len(r.Changes)
+}
+
+// ChangesResponse represents the structure of a CouchDB _changes response.
+type ChangesResponse struct {
+    Results []ChangeResult `json:"results"`
+    LastSeq Seq            `json:"last_seq"`
+    Pending int            `json:"pending"`
+}
+
+// FilterByRevisionCount returns the changes reporting at least minRevisions revisions.
+func (r *ChangesResponse) FilterByRevisionCount(minRevisions int) []ChangeResult {
+    var filtered []ChangeResult
+    for _, result := range r.Results {
+        if result.RevisionCount() >= minRevisions {
+            filtered = append(filtered, result)
+        }
+    }
+    return filtered
+}
+
+// ScanDialTimeout is the TCP dial timeout used when probing hosts during a
+// network scan. It is deliberately short and unrelated to the timeout applied
+// to HTTP requests made by CouchDBClient.
+const ScanDialTimeout = time.Second
+
 // IsCouchDBRunningFunc defines a function type that checks if CouchDB is running
 // on a given IP address and port.
 type IsCouchDBRunningFunc func(ip, port string) bool
@@ -51,7 +275,7 @@ type IsCouchDBRunningFunc func(ip, port string) bool
 //     }
 //
 func IsCouchDBRunning(ip, port string) bool {
-    timeout := time.Second
+    timeout := ScanDialTimeout
     conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), timeout)
     if err != nil {
         return false
@@ -60,18 +284,366 @@ func IsCouchDBRunning(ip, port string) bool {
     return true
 }
 
-// NewCouchDBClient creates a new CouchDB client.
-func NewCouchDBClient(baseURL, dbName string) *CouchDBClient {
+// NewIsCouchDBRunningWithRetry returns an IsCouchDBRunningFunc that retries the
+// dial up to retries additional times, doubling the wait between attempts
+// starting at backoff. A refused connection means nothing is listening on the
+// port, so it fails immediately instead of retrying.
+//
+// Example usage:
+//
+//     check := couchdb.NewIsCouchDBRunningWithRetry(2, 200*time.Millisecond)
+//     running := check("127.0.0.1", "5984")
+//
+func NewIsCouchDBRunningWithRetry(retries int, backoff time.Duration) IsCouchDBRunningFunc {
+    return func(ip, port string) bool {
+        timeout := ScanDialTimeout
+        delay := backoff
+        for attempt := 0; ; attempt++ {
+            conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), timeout)
+            if err == nil {
+                conn.Close()
+                return true
+            }
+            if errors.Is(err, syscall.ECONNREFUSED) || attempt >= retries {
+                return false
+            }
+            time.Sleep(delay)
+            delay *= 2
+        }
+    }
+}
+
+// NewVerifyingIsCouchDBRunning returns an IsCouchDBRunningFunc that, once
+// check finds the port open, also fetches the server info over HTTP and only
+// reports instances that answer as CouchDB. The HTTP checks share one client
+// and its connection pool; check itself only dials.
+//
+// Example usage:
+//
+//     check := couchdb.NewVerifyingIsCouchDBRunning(couchdb.IsCouchDBRunning, "http", "", couchdb.ClientOptions{})
+//     running := check("127.0.0.1", "5984")
+//
+func NewVerifyingIsCouchDBRunning(check IsCouchDBRunningFunc, scheme, pathPrefix string, opts ClientOptions) IsCouchDBRunningFunc {
+    var output io.Writer = os.Stdout
+    if opts.Output != nil {
+        output = opts.Output
+    }
+    httpClient := newVerifyHTTPClient(opts, output)
+    return func(ip, port string) bool {
+        if !check(ip, port) {
+            return false
+        }
+        client := &CouchDBClient{
+            BaseURL:    BuildBaseURL(scheme, ip, port, pathPrefix),
+            HTTPClient: httpClient,
+            Output:     output,
+        }
+        if _, err := client.ServerVersion(); err != nil {
+            // A node in maintenance is still CouchDB; keep it so the run
+            // reports it as skipped rather than leaving it out unnoticed.
+            return errors.Is(client.Up(), ErrMaintenance)
+        }
+        return true
+    }
+}
+
+// BuildBaseURL builds the base URL of a CouchDB instance from its scheme, host,
+// port and an optional path prefix for instances served behind a reverse proxy.
+// The scheme defaults to http.
+func BuildBaseURL(scheme, host, port, pathPrefix string) string {
+    if scheme == "" {
+        scheme = "http"
+    }
+    return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, port), strings.TrimRight(pathPrefix, "/"))
+}
+
+// NewCouchDBFunc defines a function type that creates a CouchDB for a database
+// on the instance at baseURL. NewCouchDB is the default implementation.
+type NewCouchDBFunc func(baseURL, dbName string, opts ClientOptions) CouchDB
+
+// NewCouchDB creates a *CouchDBClient and returns it as a CouchDB.
+func NewCouchDB(baseURL, dbName string, opts ClientOptions) CouchDB {
+    return NewCouchDBClient(baseURL, dbName, opts)
+}
+
+// NewCouchDBClient creates a new CouchDB client configured by opts.
+func NewCouchDBClient(baseURL, dbName string, opts ClientOptions) *CouchDBClient {
+    var output io.Writer = os.Stdout
+    if opts.Output != nil {
+        output = opts.Output
+    }
     return &CouchDBClient{
-        BaseURL: baseURL,
-        DBName:  dbName,
+        BaseURL:     baseURL,
+        DBName:      dbName,
+        HTTPClient:  newHTTPClient(opts, output),
+        WriteQuorum: opts.WriteQuorum,
+
+        ConditionalDeletes: opts.ConditionalDeletes,
+        VerifyResets:       opts.VerifyResets,
+        ResetStrategy:      opts.ResetStrategy,
+        Output:             output,
+    }
+}
+
+// withWriteQuorum appends the w query parameter to url when WriteQuorum is set.
+func (c *CouchDBClient) withWriteQuorum(url string) string {
+    if c.WriteQuorum <= 0 {
+        return url
+    }
+    separator := "?"
+    if strings.Contains(url, "?") {
+        separator = "&"
+    }
+    return fmt.Sprintf("%s%sw=%d", url, separator, c.WriteQuorum)
+}
+
+// ServerVersion fetches the CouchDB server version from the root endpoint.
+func (c *CouchDBClient) ServerVersion() (string, error) {
+    req, err := http.NewRequest(http.MethodGet, c.BaseURL+"/", nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Accept", "application/json")
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
+    }
+
+    // An error page, such as a proxy's 502, says nothing about what is
+    // behind it, so only a successful response is judged by its content.
+    if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+        return "", fmt.Errorf("failed to fetch server info: %s: %w", resp.Status, ErrUnauthorized)
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return "", fmt.Errorf("failed to fetch server info: %s: %s", resp.Status, string(body))
+    }
+
+    // Other web servers typically answer with HTML, which would otherwise
+    // surface as a confusing JSON syntax error.
+    mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    if mediaType != "application/json" {
+        return "", fmt.Errorf("%s answered with content type %q: %w", c.BaseURL, mediaType, ErrNotCouchDB)
+    }
+
+    var info struct {
+        CouchDB string `json:"couchdb"`
+        Version string `json:"version"`
+    }
+    if err := json.Unmarshal(body, &info); err != nil {
+        return "", err
+    }
+    if info.CouchDB == "" {
+        return "", fmt.Errorf("%s server info has no couchdb welcome field: %w", c.BaseURL, ErrNotCouchDB)
+    }
+    if info.Version == "" {
+        return "", fmt.Errorf("server info has no version: %s", string(body))
+    }
+
+    return info.Version, nil
+}
+
+// CheckVersionCompatibility returns an error if revision purging is known not
+// to work on the given CouchDB version. 1.x implements _purge with different
+// semantics, and 2.0 to 2.2 ship with _purge disabled.
+func CheckVersionCompatibility(version string) error {
+    var major, minor int
+    if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+        return fmt.Errorf("unrecognised CouchDB version %q", version)
+    }
+
+    switch {
+    case major < 2:
+        return fmt.Errorf("CouchDB %s is not supported: 1.x purge semantics differ", version)
+    case major == 2 && minor < 3:
+        return fmt.Errorf("CouchDB %s is not supported: _purge is disabled before 2.3", version)
+    }
+    return nil
+}
+
+// Replication describes a replication job reported by the server.
+type Replication struct {
+    ID     string
+    Source string
+    Target string
+    State  string
+}
+
+// replicationInvolves reports whether a replication endpoint, which may be a
+// bare database name or a URL, refers to the database dbName.
+func replicationInvolves(endpoint, dbName string) bool {
+    endpoint = strings.TrimRight(endpoint, "/")
+    return endpoint == dbName || strings.HasSuffix(endpoint, "/"+dbName)
+}
+
+// ActiveReplications returns the replications that are not finished and
+// involve the client's database as source or target. It reads
+// /_scheduler/docs and falls back to /_active_tasks on servers without the
+// replication scheduler. Both require admin credentials; without them the
+// status cannot be determined and ErrUnauthorized is returned.
+func (c *CouchDBClient) ActiveReplications() ([]Replication, error) {
+    resp, err := c.HTTPClient.Get(c.BaseURL + "/_scheduler/docs")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    var replications []Replication
+    switch resp.StatusCode {
+    case http.StatusOK:
+        var scheduler struct {
+            Docs []struct {
+                DocID  string `json:"doc_id"`
+                Source string `json:"source"`
+                Target string `json:"target"`
+                State  string `json:"state"`
+            } `json:"docs"`
+        }
+        if err := json.Unmarshal(body, &scheduler); err != nil {
+            return nil, err
+        }
+        for _, doc := range scheduler.Docs {
+            if doc.State == "completed" || doc.State == "failed" {
+                continue
+            }
+            replications = append(replications, Replication{ID: doc.DocID, Source: doc.Source, Target: doc.Target, State: doc.State})
+        }
+    case http.StatusNotFound, http.StatusBadRequest:
+        tasks, err := c.activeReplicationTasks()
+        if err != nil {
+            return nil, err
+        }
+        replications = tasks
+    case http.StatusUnauthorized, http.StatusForbidden:
+        return nil, fmt.Errorf("replication status: %w", ErrUnauthorized)
+    default:
+        return nil, fmt.Errorf("failed to fetch replication status: %s", string(body))
+    }
+
+    var involved []Replication
+    for _, replication := range replications {
+        if replicationInvolves(replication.Source, c.DBName) || replicationInvolves(replication.Target, c.DBName) {
+            involved = append(involved, replication)
+        }
+    }
+    return involved, nil
+}
+
+// activeReplicationTasks lists the replication tasks in /_active_tasks.
+func (c *CouchDBClient) activeReplicationTasks() ([]Replication, error) {
+    tasks, err := c.GetActiveTasks()
+    if err != nil {
+        return nil, err
+    }
+
+    var replications []Replication
+    for _, task := range tasks {
+        if task.Type == "replication" {
+            replications = append(replications, Replication{ID: task.ReplicationID, Source: task.Source, Target: task.Target, State: "running"})
+        }
+    }
+    return replications, nil
+}
+
+// ActiveTask is a task reported by /_active_tasks.
+type ActiveTask struct {
+    Type          string `json:"type"`
+    Database      string `json:"database"`
+    Progress      int    `json:"progress"`
+    ReplicationID string `json:"replication_id,omitempty"`
+    Source        string `json:"source,omitempty"`
+    Target        string `json:"target,omitempty"`
+}
+
+// OnDatabase reports whether the task runs on dbName. On a cluster the task
+// database is a shard path such as "shards/00000000-1fffffff/dbname.1712345678".
+func (t ActiveTask) OnDatabase(dbName string) bool {
+    return t.Database == dbName || strings.HasSuffix(t.Database, "/"+dbName) ||
+        (strings.HasPrefix(t.Database, "shards/") && strings.Contains(t.Database, "/"+dbName+"."))
+}
+
+// GetActiveTasks fetches the tasks currently running on the server.
+func (c *CouchDBClient) GetActiveTasks() ([]ActiveTask, error) {
+    resp, err := c.HTTPClient.Get(c.BaseURL + "/_active_tasks")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch active tasks: %s", string(body))
+    }
+
+    var tasks []ActiveTask
+    if err := json.Unmarshal(body, &tasks); err != nil {
+        return nil, err
+    }
+    return tasks, nil
+}
+
+// maxWaitErrors is the number of consecutive failures to read
+// /_active_tasks after which WaitForCompaction gives up.
+const maxWaitErrors = 3
+
+// WaitForCompaction polls /_active_tasks every interval until no compaction
+// task is running on the client's database, logging the progress of each
+// running task as it goes. It gives up with an error once maxWait has passed,
+// unless maxWait is zero, or after maxWaitErrors consecutive failed polls.
+func (c *CouchDBClient) WaitForCompaction(interval, maxWait time.Duration, logger *logger.Logger) error {
+    var deadline time.Time
+    if maxWait > 0 {
+        deadline = time.Now().Add(maxWait)
+    }
+    failures := 0
+    for {
+        tasks, err := c.GetActiveTasks()
+        if err != nil {
+            failures++
+            if failures >= maxWaitErrors {
+                return fmt.Errorf("failed to read active tasks %d times in a row: %w", failures, err)
+            }
+            logger.Printf("Failed to read active tasks, retrying: %v", err)
+        } else {
+            failures = 0
+        }
+
+        running := 0
+        for _, task := range tasks {
+            if task.Type == "database_compaction" && task.OnDatabase(c.DBName) {
+                running++
+                logger.Printf("Compaction of %s is %d%% complete", task.Database, task.Progress)
+            }
+        }
+        if err == nil && running == 0 {
+            return nil
+        }
+
+        if !deadline.IsZero() && time.Now().Add(interval).After(deadline) {
+            return fmt.Errorf("compaction of %s still running after %s", c.DBName, maxWait)
+        }
+        time.Sleep(interval)
     }
 }
 
 // GetDocument fetches a document by its ID.
 func (c *CouchDBClient) GetDocument(docID string) (map[string]interface{}, error) {
-    url := fmt.Sprintf("%s/%s/%s", c.BaseURL, c.DBName, docID)
-    resp, err := http.Get(url)
+    url := c.documentURL(docID)
+    resp, err := c.HTTPClient.Get(url)
     if err != nil {
         return nil, err
     }
@@ -82,6 +654,9 @@ func (c *CouchDBClient) GetDocument(docID string) (map[string]interface{}, error
         return nil, err
     }
 
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("document %s: %w", docID, ErrNotFound)
+    }
     if resp.StatusCode != http.StatusOK {
         return nil, fmt.Errorf("failed to fetch document: %s", string(body))
     }
@@ -95,10 +670,71 @@ func (c *CouchDBClient) GetDocument(docID string) (map[string]interface{}, error
     return doc, nil
 }
 
+// GetDocumentStream fetches a document by its ID and returns its body
+// unread, so large documents can be decoded or copied incrementally instead
+// of being held in memory. The caller must close the returned reader.
+func (c *CouchDBClient) GetDocumentStream(docID string) (io.ReadCloser, error) {
+    resp, err := c.HTTPClient.Get(c.documentURL(docID))
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        defer resp.Body.Close()
+        body, err := ioutil.ReadAll(resp.Body)
+        if err != nil {
+            return nil, err
+        }
+        if resp.StatusCode == http.StatusNotFound {
+            return nil, fmt.Errorf("document %s: %w", docID, ErrNotFound)
+        }
+        return nil, fmt.Errorf("failed to fetch document: %s", string(body))
+    }
+
+    return resp.Body, nil
+}
+
+// GetChanges reads the database _changes feed.
+func (c *CouchDBClient) GetChanges(opts ChangesOptions) (*ChangesResponse, error) {
+    query := neturl.Values{}
+    if opts.Since != "" {
+        query.Set("since", opts.Since)
+    }
+    if opts.Limit > 0 {
+        query.Set("limit", strconv.Itoa(opts.Limit))
+    }
+    if opts.AllDocs {
+        query.Set("style", "all_docs")
+    }
+    url := withQuery(c.dbURL()+"/_changes", query)
+
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch changes: %s", string(body))
+    }
+
+    var changes ChangesResponse
+    if err := json.Unmarshal(body, &changes); err != nil {
+        return nil, err
+    }
+
+    return &changes, nil
+}
+
 // GetAllRevisions fetches all revisions of a document by its ID.
 func (c *CouchDBClient) GetAllRevisions(docID string) ([]string, error) {
-    url := fmt.Sprintf("%s/%s/%s?revs_info=true", c.BaseURL, c.DBName, docID)
-    resp, err := http.Get(url)
+    url := withQuery(c.documentURL(docID), neturl.Values{"revs_info": {"true"}})
+    resp, err := c.HTTPClient.Get(url)
     if err != nil {
         return nil, err
     }
@@ -109,6 +745,9 @@ func (c *CouchDBClient) GetAllRevisions(docID string) ([]string, error) {
         return nil, err
     }
 
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("document %s: %w", docID, ErrNotFound)
+    }
     if resp.StatusCode != http.StatusOK {
         return nil, fmt.Errorf("failed to fetch document revisions: %s", string(body))
     }
@@ -131,16 +770,51 @@ func (c *CouchDBClient) GetAllRevisions(docID string) ([]string, error) {
     return revisions, nil
 }
 
+// CurrentRevision returns the current revision of a document, read from the
+// ETag of a HEAD request so the body is not transferred.
+func (c *CouchDBClient) CurrentRevision(docID string) (string, error) {
+    url := c.documentURL(docID)
+    resp, err := c.HTTPClient.Head(url)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotFound {
+        return "", fmt.Errorf("document %s: %w", docID, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("failed to fetch document revision: %s", resp.Status)
+    }
+
+    return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// checkRevision returns ErrRevisionChanged if ConditionalDeletes is set and the
+// document is no longer at rev.
+func (c *CouchDBClient) checkRevision(docID, rev string) error {
+    if !c.ConditionalDeletes {
+        return nil
+    }
+    current, err := c.CurrentRevision(docID)
+    if err != nil {
+        return err
+    }
+    if current != rev {
+        return fmt.Errorf("document %s is at %s, expected %s: %w", docID, current, rev, ErrRevisionChanged)
+    }
+    return nil
+}
+
 // DeleteDocumentRevision deletes a specific document revision.
 func (c *CouchDBClient) DeleteDocumentRevision(docID, rev string) (string, error) {
-    url := fmt.Sprintf("%s/%s/%s?rev=%s", c.BaseURL, c.DBName, docID, rev)
+    url := c.withWriteQuorum(withQuery(c.documentURL(docID), neturl.Values{"rev": {rev}}))
     req, err := http.NewRequest("DELETE", url, nil)
     if err != nil {
         return "", err
     }
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := c.HTTPClient.Do(req)
     if err != nil {
         return "", err
     }
@@ -158,32 +832,48 @@ func (c *CouchDBClient) DeleteDocumentRevision(docID, rev string) (string, error
     return "Revision deleted successfully", nil
 }
 
-// DeleteAllRevisions deletes all revisions of a document by its ID.
-func (c *CouchDBClient) DeleteAllRevisions(docID string, revisions []string) error {
+// DeleteAllRevisions deletes all revisions of a document by its ID and
+// returns the number of revisions it deleted.
+func (c *CouchDBClient) DeleteAllRevisions(docID string, revisions []string) (int, error) {
+    deleted := 0
     for _, rev := range revisions {
         resp, err := c.DeleteDocumentRevision(docID, rev)
         if err != nil {
             if strings.Contains(err.Error(), "not_found") {
-                fmt.Printf("Revision %s is already deleted, skipping.\n", rev)
+                fmt.Fprintf(c.Output, "Revision %s is already deleted, skipping.\n", rev)
                 continue
             }
-            return fmt.Errorf("failed to delete revision %s: %v", rev, err)
+            return deleted, fmt.Errorf("failed to delete revision %s: %v", rev, err)
         }
-        fmt.Printf("Deleted revision %s: %s\n", rev, resp)
+        fmt.Fprintf(c.Output, "Deleted revision %s: %s\n", rev, resp)
+        deleted++
     }
-    return nil
+    return deleted, nil
 }
 
 // DeleteDocument deletes a document by its ID.
 func (c *CouchDBClient) DeleteDocument(docID string) error {
-    url := fmt.Sprintf("%s/%s/%s", c.BaseURL, c.DBName, docID)
+    url := c.documentURL(docID)
+    if IsLocalDocument(docID) {
+        // Local documents are not found through _revs_info, so their
+        // revision is read from the document itself.
+        doc, err := c.GetDocument(docID)
+        if errors.Is(err, ErrNotFound) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        rev, _ := doc["_rev"].(string)
+        url = withQuery(url, neturl.Values{"rev": {rev}})
+    }
+    url = c.withWriteQuorum(url)
     req, err := http.NewRequest("DELETE", url, nil)
     if err != nil {
         return err
     }
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := c.HTTPClient.Do(req)
     if err != nil {
         return err
     }
@@ -203,7 +893,7 @@ func (c *CouchDBClient) DeleteDocument(docID string) error {
 
 // CreateDocument creates a new document.
 func (c *CouchDBClient) CreateDocument(doc map[string]interface{}) error {
-    url := fmt.Sprintf("%s/%s/%s", c.BaseURL, c.DBName, doc["_id"].(string))
+    url := c.withWriteQuorum(c.documentURL(doc["_id"].(string)))
 
     delete(doc, "_rev")
 
@@ -219,8 +909,7 @@ func (c *CouchDBClient) CreateDocument(doc map[string]interface{}) error {
 
     req.Header.Set("Content-Type", "application/json")
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := c.HTTPClient.Do(req)
     if err != nil {
         return err
     }
@@ -238,43 +927,207 @@ func (c *CouchDBClient) CreateDocument(doc map[string]interface{}) error {
     return nil
 }
 
-// ResetDocument resets a document by deleting all its revisions and recreating it.
-func (c *CouchDBClient) ResetDocument(docID string, logger *logger.Logger) error {
+// SaveDocument creates doc, or updates it if doc carries the _rev of its
+// current revision, and returns the new revision. A _rev that is no longer
+// current is reported as ErrRevisionChanged.
+func (c *CouchDBClient) SaveDocument(doc map[string]interface{}) (string, error) {
+    docID, _ := doc["_id"].(string)
+    url := c.withWriteQuorum(c.documentURL(docID))
+
+    jsonDoc, err := json.Marshal(doc)
+    if err != nil {
+        return "", err
+    }
+
+    req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonDoc))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
+    }
+
+    switch resp.StatusCode {
+    case http.StatusCreated, http.StatusAccepted:
+    case http.StatusConflict:
+        return "", fmt.Errorf("document %s: %w", docID, ErrRevisionChanged)
+    default:
+        return "", fmt.Errorf("failed to save document: %s", string(body))
+    }
+
+    var saved struct {
+        Rev string `json:"rev"`
+    }
+    if err := json.Unmarshal(body, &saved); err != nil {
+        return "", err
+    }
+    return saved.Rev, nil
+}
+
+// DocumentValidator checks a fetched document before ResetDocument writes it back.
+type DocumentValidator func(doc map[string]interface{}) error
+
+// RequireFields returns a DocumentValidator that fails if any of the given
+// top-level fields is missing from the document.
+func RequireFields(fields ...string) DocumentValidator {
+    return func(doc map[string]interface{}) error {
+        for _, field := range fields {
+            if _, ok := doc[field]; !ok {
+                return fmt.Errorf("missing required field %q", field)
+            }
+        }
+        return nil
+    }
+}
+
+// ResetResult is the machine-readable outcome of ResetDocument.
+type ResetResult struct {
+    Instance         string `json:"instance,omitempty"`
+    DocID            string `json:"docID"`
+    RevisionsDeleted int    `json:"revisionsDeleted"`
+    Recreated        bool   `json:"recreated"`
+    Removed          bool   `json:"removed,omitempty"`
+    Verified         bool   `json:"verified,omitempty"`
+    Error            string `json:"error,omitempty"`
+}
+
+// ResetDocument resets a document by deleting all its revisions and recreating it,
+// or, with the ResetBulkDocs strategy, by rewriting it at its current revision.
+// With the ResetRemove strategy the document is deleted and purged instead and
+// does not exist afterwards.
+// If validate is not nil, the fetched document must pass it before anything is
+// deleted; on failure the document is left untouched. The returned result is
+// never nil and records how far the reset got, including any error.
+func (c *CouchDBClient) ResetDocument(docID string, logger *logger.Logger, validate DocumentValidator) (*ResetResult, error) {
+    result := &ResetResult{DocID: docID}
+    fail := func(err error) (*ResetResult, error) {
+        result.Error = err.Error()
+        return result, err
+    }
+
     doc, err := c.GetDocument(docID)
     if err != nil {
         logger.Printf("Failed to fetch document: %v", err)
-        return fmt.Errorf("failed to fetch document: %v", err)
+        return fail(fmt.Errorf("failed to fetch document: %w", err))
+    }
+
+    if validate != nil {
+        if err := validate(doc); err != nil {
+            logger.Printf("Document %s failed validation: %v", docID, err)
+            return fail(fmt.Errorf("document failed validation: %w", err))
+        }
     }
 
     revisions, err := c.GetAllRevisions(docID)
     if err != nil {
         logger.Printf("Failed to get revisions: %v", err)
-        return fmt.Errorf("failed to get revisions: %v", err)
+        return fail(fmt.Errorf("failed to get revisions: %w", err))
     }
 
-    err = c.DeleteAllRevisions(docID, revisions)
-    if err != nil {
-        logger.Printf("Failed to delete all revisions: %v", err)
-        return fmt.Errorf("failed to delete all revisions: %v", err)
+    rev, _ := doc["_rev"].(string)
+    if err := c.checkRevision(docID, rev); err != nil {
+        logger.Printf("Not resetting document %s: %v", docID, err)
+        return fail(fmt.Errorf("failed to confirm document revision: %w", err))
     }
 
-    err = c.DeleteDocument(docID)
-    if err != nil {
-        logger.Printf("Failed to delete document: %v", err)
-        return fmt.Errorf("failed to delete document: %v", err)
+    if c.ResetStrategy == ResetBulkDocs {
+        result.RevisionsDeleted, err = c.RewriteDocument(docID, rev)
+        if err != nil {
+            logger.Printf("Failed to rewrite document: %v", err)
+            return fail(fmt.Errorf("failed to rewrite document: %w", err))
+        }
+        delete(doc, "_rev")
+        result.Recreated = true
+    } else {
+        result.RevisionsDeleted, err = c.DeleteAllRevisions(docID, revisions)
+        if err != nil {
+            logger.Printf("Failed to delete all revisions: %v", err)
+            return fail(fmt.Errorf("failed to delete all revisions: %w", err))
+        }
+
+        err = c.DeleteDocument(docID)
+        if err != nil {
+            logger.Printf("Failed to delete document: %v", err)
+            return fail(fmt.Errorf("failed to delete document: %w", err))
+        }
+
+        if c.ResetStrategy == ResetRemove {
+            // Local documents keep no history, so there is nothing to purge
+            if !IsLocalDocument(docID) {
+                if _, err := c.PurgeDocument(docID); err != nil {
+                    logger.Printf("Failed to purge deleted document: %v", err)
+                    return fail(fmt.Errorf("failed to purge deleted document: %w", err))
+                }
+            }
+            logger.Printf("Removed document %s without recreating it", docID)
+            result.Removed = true
+        } else {
+            err = c.CreateDocument(doc)
+            if err != nil {
+                logger.Printf("Failed to recreate document: %v", err)
+                return fail(fmt.Errorf("failed to recreate document: %w", err))
+            }
+            result.Recreated = true
+        }
     }
 
-    err = c.CreateDocument(doc)
+    if c.VerifyResets && result.Removed {
+        if _, err := c.GetDocument(docID); !errors.Is(err, ErrNotFound) {
+            if err == nil {
+                err = fmt.Errorf("document %s still exists", docID)
+            }
+            logger.Printf("Error: removed document %s failed verification: %v", docID, err)
+            return fail(fmt.Errorf("failed to verify document removal: %w", err))
+        }
+        result.Verified = true
+    } else if c.VerifyResets {
+        if err := c.VerifyDocument(doc); err != nil {
+            logger.Printf("Error: reset document %s failed verification: %v", docID, err)
+            return fail(fmt.Errorf("failed to verify document: %w", err))
+        }
+        result.Verified = true
+    }
+
+    return result, nil
+}
+
+// VerifyDocument re-reads the document with the ID of doc and checks that its
+// body, ignoring _rev, is the same as doc. It returns an error wrapping
+// ErrDocumentMismatch if it is not.
+func (c *CouchDBClient) VerifyDocument(doc map[string]interface{}) error {
+    docID, _ := doc["_id"].(string)
+    stored, err := c.GetDocument(docID)
     if err != nil {
-        logger.Printf("Failed to recreate document: %v", err)
-        return fmt.Errorf("failed to recreate document: %v", err)
+        return err
     }
 
+    expected := make(map[string]interface{}, len(doc))
+    for key, value := range doc {
+        if key != "_rev" {
+            expected[key] = value
+        }
+    }
+    delete(stored, "_rev")
+
+    if !reflect.DeepEqual(expected, stored) {
+        return fmt.Errorf("document %s: %w", docID, ErrDocumentMismatch)
+    }
     return nil
 }
 
+// CompactDatabase triggers compaction of the database. Any 2xx response counts
+// as success; the returned string holds the response status and body.
 func (c *CouchDBClient) CompactDatabase() (string, error) {
-    url := fmt.Sprintf("%s/%s/_compact", c.BaseURL, c.DBName)
+    url := c.dbURL() + "/_compact"
 
     // Include an empty JSON body
     jsonBody := []byte(`{}`)
@@ -285,8 +1138,7 @@ func (c *CouchDBClient) CompactDatabase() (string, error) {
 
     req.Header.Set("Content-Type", "application/json") // Set Content-Type header
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := c.HTTPClient.Do(req)
     if err != nil {
         return "", err
     }
@@ -297,48 +1149,67 @@ func (c *CouchDBClient) CompactDatabase() (string, error) {
         return "", err
     }
 
-    if resp.StatusCode != http.StatusAccepted {
-        return "", fmt.Errorf("failed to trigger compaction: %s", string(body))
+    // CouchDB answers 202 Accepted, but proxies and load balancers in front
+    // of it may rewrite that to another success status.
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return "", fmt.Errorf("failed to trigger compaction (%s): %s", resp.Status, string(body))
     }
 
-    return string(body), nil
+    return fmt.Sprintf("%s %s", resp.Status, strings.TrimSpace(string(body))), nil
 }
 
-func (c *CouchDBClient) CheckAndDeleteDesignDocument(designDocName string) (string, error) {
-    url := fmt.Sprintf("%s/%s/_design/%s", c.BaseURL, c.DBName, designDocName)
+// CleanupViews removes index files that are no longer used by any design document.
+func (c *CouchDBClient) CleanupViews() (string, error) {
+    url := c.dbURL() + "/_view_cleanup"
 
-    // Fetch the design document to see if it exists
-    resp, err := http.Get(url)
+    req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(`{}`)))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.HTTPClient.Do(req)
     if err != nil {
         return "", err
     }
     defer resp.Body.Close()
 
-    if resp.StatusCode == http.StatusNotFound {
-        return "Design document does not exist, no deletion needed", nil
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
     }
 
-    if resp.StatusCode != http.StatusOK {
-        body, _ := ioutil.ReadAll(resp.Body)
-        return "", fmt.Errorf("failed to fetch design document: %s", string(body))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return "", fmt.Errorf("failed to trigger view cleanup (%s): %s", resp.Status, string(body))
     }
 
-    // Parse the response to get the document's revision
-    var doc struct {
-        Rev string `json:"_rev"`
+    return fmt.Sprintf("%s %s", resp.Status, strings.TrimSpace(string(body))), nil
+}
+
+// CheckAndDeleteDesignDocument deletes the design document designDocName if it
+// exists. It is read with GetDesignDocument, so a design document the client
+// has already read is not transferred again to learn its revision.
+func (c *CouchDBClient) CheckAndDeleteDesignDocument(designDocName string) (string, error) {
+    url := c.designDocURL(designDocName)
+
+    // Fetch the design document to see if it exists
+    doc, err := c.GetDesignDocument(designDocName)
+    if errors.Is(err, ErrNotFound) {
+        return "Design document does not exist, no deletion needed", nil
     }
-    if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+    if err != nil {
         return "", err
     }
+    rev, _ := doc["_rev"].(string)
 
     // Delete the existing design document
-    deleteURL := fmt.Sprintf("%s?rev=%s", url, doc.Rev)
+    deleteURL := withQuery(url, neturl.Values{"rev": {rev}})
     req, err := http.NewRequest("DELETE", deleteURL, nil)
     if err != nil {
         return "", err
     }
 
-    deleteResp, err := http.DefaultClient.Do(req)
+    deleteResp, err := c.HTTPClient.Do(req)
     if err != nil {
         return "", err
     }
@@ -348,36 +1219,268 @@ func (c *CouchDBClient) CheckAndDeleteDesignDocument(designDocName string) (stri
         body, _ := ioutil.ReadAll(deleteResp.Body)
         return "", fmt.Errorf("failed to delete design document: %s", string(body))
     }
+    c.designs.forget(url)
 
     return "Existing design document deleted", nil
 }
 
-func (c *CouchDBClient) HandleQueryResponse(queryResponse []byte) error {
+// HandleOptions controls how HandleQueryResponse processes the view rows.
+type HandleOptions struct {
+    // MaxDocs stops processing after this many documents have been handled.
+    // Zero means no limit.
+    MaxDocs int
+    // MinGenerationAge only deletes conflict revisions whose generation is at
+    // least this many generations behind the document's current revision, so
+    // recent conflicts still needed for replication to converge are kept.
+    // Zero deletes every conflict revision.
+    MinGenerationAge int
+    // SortBySavings estimates the bytes freed by removing the conflict
+    // revisions of each document on the page and handles the largest first,
+    // so a MaxDocs limit is spent on the documents that free the most space.
+    // Only the documents of a single page are ordered; a larger document on
+    // a later page is still handled after every document on this one.
+    SortBySavings bool
+    // Seen, if not nil, collects the IDs of the documents looked at. Documents
+    // already in it are skipped, so rows returned by several views are only
+    // handled once.
+    Seen map[string]bool
+    // DeleteConcurrency is the number of conflict revisions of a document
+    // deleted in parallel. Values below 1 delete them one at a time.
+    DeleteConcurrency int
+}
+
+// HandleResult reports what HandleQueryResponse did.
+type HandleResult struct {
+    DocsHandled      int
+    ConflictsDeleted int
+    ConflictsFailed  int
+    ConflictsKept    int
+    DocsChanged      int
+    LimitReached     bool
+
+    // TimedOut counts the requests that timed out without stopping the
+    // page, such as individual conflict deletes.
+    TimedOut int
+
+    // DeletedRevisions lists the conflict revisions deleted, keyed by
+    // document ID.
+    DeletedRevisions map[string][]string
+}
+
+// RevGeneration returns the generation number of a revision ID such as "3-abc".
+func RevGeneration(rev string) (int, error) {
+    prefix, _, found := strings.Cut(rev, "-")
+    if !found {
+        return 0, fmt.Errorf("invalid revision %q", rev)
+    }
+    var gen int
+    if _, err := fmt.Sscanf(prefix, "%d", &gen); err != nil {
+        return 0, fmt.Errorf("invalid revision %q", rev)
+    }
+    return gen, nil
+}
+
+func (c *CouchDBClient) HandleQueryResponse(queryResponse []byte, opts HandleOptions) (HandleResult, error) {
+    var result HandleResult
     var response QueryResponse
     err := json.Unmarshal(queryResponse, &response)
     if err != nil {
-        return err
+        return result, err
     }
 
+    var candidates []Document
     for _, row := range response.Rows {
-        doc := row.Value
-        if len(doc.DeletedConflicts) > 0 {
-            fmt.Printf("Document %s has conflicts: %v\n", doc.ID, doc.DeletedConflicts)
-            for _, conflictRev := range doc.DeletedConflicts {
-                deleteResp, err := c.DeleteDocumentRevision(doc.ID, conflictRev)
-                if err != nil {
-                    return fmt.Errorf("failed to delete conflict for document %s: %v", doc.ID, err)
+        doc := row.Document()
+        if doc.ID == "" {
+            fmt.Fprintf(c.Output, "Skipping view row without a document ID: key %s, value %s\n", row.Key, row.Value.Raw)
+            continue
+        }
+        if opts.Seen[doc.ID] {
+            continue
+        }
+        if opts.Seen != nil {
+            opts.Seen[doc.ID] = true
+        }
+        if len(doc.DeletedConflicts) == 0 {
+            continue
+        }
+        candidates = append(candidates, doc)
+    }
+    return c.handleDocuments(candidates, func(doc Document) []string { return doc.DeletedConflicts }, opts)
+}
+
+// handleDocuments deletes the conflict revisions conflicts returns for each
+// of candidates, as HandleQueryResponse describes.
+func (c *CouchDBClient) handleDocuments(candidates []Document, conflicts func(Document) []string, opts HandleOptions) (HandleResult, error) {
+    var result HandleResult
+    if opts.SortBySavings {
+        var timedOut int
+        candidates, timedOut = c.sortBySavings(candidates, conflicts, opts.MinGenerationAge)
+        result.TimedOut += timedOut
+    }
+
+    for _, doc := range candidates {
+        if opts.MaxDocs > 0 && result.DocsHandled >= opts.MaxDocs {
+            result.LimitReached = true
+            break
+        }
+        fmt.Fprintf(c.Output, "Document %s has conflicts: %v\n", doc.ID, conflicts(doc))
+        if err := c.checkRevision(doc.ID, doc.Rev); err != nil {
+            if !errors.Is(err, ErrRevisionChanged) {
+                return result, err
+            }
+            fmt.Fprintf(c.Output, "Skipping document %s: %v\n", doc.ID, err)
+            result.DocsChanged++
+            continue
+        }
+        toDelete, kept, err := removableConflicts(doc, conflicts(doc), opts.MinGenerationAge)
+        if err != nil {
+            return result, err
+        }
+        for _, conflictRev := range kept {
+            fmt.Fprintf(c.Output, "Keeping recent conflict revision %s for document %s\n", conflictRev, doc.ID)
+            result.ConflictsKept++
+        }
+        deleted, failed, timedOut := c.deleteRevisions(doc.ID, toDelete, opts.DeleteConcurrency)
+        result.ConflictsDeleted += len(deleted)
+        result.ConflictsFailed += failed
+        result.TimedOut += timedOut
+        if len(deleted) > 0 {
+            if result.DeletedRevisions == nil {
+                result.DeletedRevisions = make(map[string][]string)
+            }
+            result.DeletedRevisions[doc.ID] = deleted
+        }
+        result.DocsHandled++
+    }
+
+    return result, nil
+}
+
+// removableConflicts splits the conflict revisions revs of doc into those to
+// delete and those kept because they are fewer than minGenerationAge
+// generations behind the winning revision. Zero deletes every one.
+func removableConflicts(doc Document, revs []string, minGenerationAge int) ([]string, []string, error) {
+    if minGenerationAge <= 0 {
+        return revs, nil, nil
+    }
+    currentGen, err := RevGeneration(doc.Rev)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to read generation of document %s: %w", doc.ID, err)
+    }
+    var toDelete, kept []string
+    for _, conflictRev := range revs {
+        conflictGen, err := RevGeneration(conflictRev)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to read generation of conflict for document %s: %w", doc.ID, err)
+        }
+        if currentGen-conflictGen < minGenerationAge {
+            kept = append(kept, conflictRev)
+            continue
+        }
+        toDelete = append(toDelete, conflictRev)
+    }
+    return toDelete, kept, nil
+}
+
+// deleteRevisions deletes revs of docID, up to concurrency at a time. A
+// failed delete is reported on c.Output and does not stop the others; the
+// revisions deleted, the number that failed and how many of those timed out
+// are returned.
+func (c *CouchDBClient) deleteRevisions(docID string, revs []string, concurrency int) ([]string, int, int) {
+    if concurrency < 1 {
+        concurrency = 1
+    }
+
+    var mu sync.Mutex
+    var deleted []string
+    failed, timedOut := 0, 0
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, concurrency)
+
+    for _, rev := range revs {
+        sem <- struct{}{}
+        wg.Add(1)
+        go func(rev string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            deleteResp, err := c.DeleteDocumentRevision(docID, rev)
+            mu.Lock()
+            defer mu.Unlock()
+            if err != nil {
+                fmt.Fprintf(c.Output, "Failed to delete conflict revision %s for document %s: %v\n", rev, docID, err)
+                failed++
+                if IsTimeout(err) {
+                    timedOut++
                 }
-                fmt.Printf("Deleted conflict revision %s for document %s: %s\n", conflictRev, doc.ID, deleteResp)
+                return
+            }
+            fmt.Fprintf(c.Output, "Deleted conflict revision %s for document %s: %s\n", rev, docID, deleteResp)
+            deleted = append(deleted, rev)
+        }(rev)
+    }
+
+    wg.Wait()
+    return deleted, failed, timedOut
+}
+
+// sortBySavings orders docs by the estimated bytes freed by removing the
+// conflict revisions handleDocuments would delete, largest first. Documents
+// whose size cannot be estimated are kept, after the others; the number of
+// estimates that timed out is returned with the sorted docs.
+func (c *CouchDBClient) sortBySavings(docs []Document, conflicts func(Document) []string, minGenerationAge int) ([]Document, int) {
+    savings := make(map[string]int64, len(docs))
+    timedOut := 0
+    for _, doc := range docs {
+        toDelete, _, err := removableConflicts(doc, conflicts(doc), minGenerationAge)
+        if err != nil {
+            fmt.Fprintf(c.Output, "Failed to estimate size of document %s: %v\n", doc.ID, err)
+            continue
+        }
+        estimate, err := c.EstimateReclaimableBytes(doc.ID, toDelete)
+        if err != nil {
+            if IsTimeout(err) {
+                timedOut++
             }
+            fmt.Fprintf(c.Output, "Failed to estimate size of document %s: %v\n", doc.ID, err)
+            continue
         }
+        fmt.Fprintf(c.Output, "Document %s has %d conflict revisions to remove, about %d reclaimable bytes\n", doc.ID, estimate.Leaves, estimate.ReclaimableBytes)
+        savings[doc.ID] = estimate.ReclaimableBytes
     }
 
-    return nil
+    sort.SliceStable(docs, func(i, j int) bool {
+        return savings[docs[i].ID] > savings[docs[j].ID]
+    })
+    return docs, timedOut
+}
+
+// LoadViewFunction reads a JavaScript map or reduce function from a file. It
+// rejects files that are empty or do not look like a JavaScript function.
+// Built-in reduce functions such as _count are accepted as well.
+func LoadViewFunction(path string) (string, error) {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+
+    source := strings.TrimSpace(string(content))
+    if source == "" {
+        return "", fmt.Errorf("view function file %s is empty", path)
+    }
+    if strings.HasPrefix(source, "_") {
+        return source, nil
+    }
+    if !strings.HasPrefix(source, "function") && !strings.Contains(source, "=>") {
+        return "", fmt.Errorf("view function file %s does not contain a JavaScript function", path)
+    }
+
+    return source, nil
 }
 
 func (c *CouchDBClient) CreateDesignDocument(designDocName string, designDoc map[string]interface{}) (string, error) {
-    url := fmt.Sprintf("%s/%s/_design/%s", c.BaseURL, c.DBName, designDocName)
+    url := c.designDocURL(designDocName)
 
     jsonDoc, err := json.Marshal(designDoc)
     if err != nil {
@@ -390,25 +1493,34 @@ func (c *CouchDBClient) CreateDesignDocument(designDocName string, designDoc map
     }
     req.Header.Set("Content-Type", "application/json")
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    resp, err := c.HTTPClient.Do(req)
     if err != nil {
         return "", err
     }
     defer resp.Body.Close()
+    c.designs.forget(url)
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
         return "", err
     }
 
+    // The ETag of a document is its quoted revision, so remember the design
+    // document just written under it
+    var created struct {
+        Rev string `json:"rev"`
+    }
+    if json.Unmarshal(body, &created) == nil && created.Rev != "" {
+        c.RememberDesignDocument(designDocName, strconv.Quote(created.Rev), designDoc)
+    }
+
     return string(body), nil
 }
 
 func (c *CouchDBClient) QueryDesignDocument(designDocName string) (string, error) {
-    url := fmt.Sprintf("%s/%s/_design/%s/_view/high_rev_gen", c.BaseURL, c.DBName, designDocName)
+    url := c.designDocURL(designDocName) + "/_view/high_rev_gen?reduce=false"
 
-    resp, err := http.Get(url)
+    resp, err := c.HTTPClient.Get(url)
     if err != nil {
         return "", err
     }
@@ -420,4 +1532,108 @@ func (c *CouchDBClient) QueryDesignDocument(designDocName string) (string, error
     }
 
     return string(body), nil
-}
\ No newline at end of file
+}
+
+// viewBookmark records where the next page of a view query starts.
+type viewBookmark struct {
+    Key json.RawMessage `json:"key"`
+    ID  string          `json:"id"`
+}
+
+// QueryDesignDocumentPage queries the view viewName of the design document one
+// page of at most limit rows at a time. Pass an empty bookmark for the first page and the
+// returned bookmark for each following page; the returned bookmark is empty
+// once the last page has been read. Rows are always read unreduced, so views
+// with a reduce function page through their documents too.
+func (c *CouchDBClient) QueryDesignDocumentPage(designDocName, viewName string, limit int, bookmark string) (string, string, error) {
+    url := fmt.Sprintf("%s/_view/%s?reduce=false&limit=%d", c.designDocURL(designDocName), neturl.PathEscape(viewName), limit)
+    if bookmark != "" {
+        raw, err := base64.RawURLEncoding.DecodeString(bookmark)
+        if err != nil {
+            return "", "", fmt.Errorf("invalid bookmark: %v", err)
+        }
+        var start viewBookmark
+        if err := json.Unmarshal(raw, &start); err != nil {
+            return "", "", fmt.Errorf("invalid bookmark: %v", err)
+        }
+        startDocID, err := json.Marshal(start.ID)
+        if err != nil {
+            return "", "", err
+        }
+        url += "&skip=1&startkey=" + neturl.QueryEscape(string(start.Key)) + "&startkey_docid=" + neturl.QueryEscape(string(startDocID))
+    }
+
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return "", "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", "", err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return "", "", fmt.Errorf("failed to query design document: %s", string(body))
+    }
+
+    var page struct {
+        Rows []viewBookmark `json:"rows"`
+    }
+    if err := json.Unmarshal(body, &page); err != nil {
+        return "", "", err
+    }
+    if len(page.Rows) == 0 || len(page.Rows) < limit {
+        return string(body), "", nil
+    }
+
+    next, err := page.Rows[len(page.Rows)-1].encode()
+    if err != nil {
+        return "", "", err
+    }
+    return string(body), next, nil
+}
+
+// encode returns the bookmark as QueryDesignDocumentPage takes it.
+func (b viewBookmark) encode() (string, error) {
+    content, err := json.Marshal(b)
+    if err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(content), nil
+}
+
+// RowBookmark returns the bookmark with which QueryDesignDocumentPage
+// continues a view after row, so a page can be resumed part way through.
+func RowBookmark(row ViewRow) (string, error) {
+    return viewBookmark{Key: row.Key, ID: row.ID}.encode()
+}
+
+// QueryDesignDocumentKeys queries the view viewName of the design document for
+// the rows whose key is one of keys, unreduced.
+func (c *CouchDBClient) QueryDesignDocumentKeys(designDocName, viewName string, keys []string) (string, error) {
+    url := c.designDocURL(designDocName) + "/_view/" + neturl.PathEscape(viewName) + "?reduce=false"
+
+    payload, err := json.Marshal(map[string]interface{}{"keys": keys})
+    if err != nil {
+        return "", err
+    }
+
+    resp, err := c.HTTPClient.Post(url, "application/json", bytes.NewBuffer(payload))
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("failed to query design document: %s", string(body))
+    }
+
+    return string(body), nil
+}
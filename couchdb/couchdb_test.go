@@ -0,0 +1,2377 @@
+package couchdb
+
+import (
+    "compress/gzip"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+)
+
+// TestQueryDesignDocumentPage pages through a view of five rows two rows at a
+// time and checks every row is returned exactly once.
+func TestQueryDesignDocumentPage(t *testing.T) {
+    ids := []string{"a", "b", "c", "d", "e"}
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        limit, _ := strconv.Atoi(query.Get("limit"))
+        start := 0
+        if startKey := query.Get("startkey"); startKey != "" {
+            for i, id := range ids {
+                if fmt.Sprintf("%q", id) == startKey {
+                    start = i
+                }
+            }
+            if query.Get("skip") == "1" {
+                start++
+            }
+        }
+
+        end := start + limit
+        if end > len(ids) {
+            end = len(ids)
+        }
+        rows := ""
+        for i, id := range ids[start:end] {
+            if i > 0 {
+                rows += ","
+            }
+            rows += fmt.Sprintf(`{"id": %q, "key": %q, "value": {"_id": %q, "_rev": "1-x"}}`, id, id, id)
+        }
+        w.WriteHeader(http.StatusOK)
+        fmt.Fprintf(w, `{"total_rows": %d, "offset": %d, "rows": [%s]}`, len(ids), start, rows)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+
+    var seen []string
+    pages := 0
+    bookmark := ""
+    for {
+        body, next, err := client.QueryDesignDocumentPage("rev_filter", "high_rev_gen", 2, bookmark)
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        pages++
+
+        var response QueryResponse
+        if err := json.Unmarshal([]byte(body), &response); err != nil {
+            t.Fatalf("Failed to parse page: %v", err)
+        }
+        for _, row := range response.Rows {
+            seen = append(seen, row.ID)
+        }
+
+        if next == "" {
+            break
+        }
+        bookmark = next
+    }
+
+    if pages != 3 {
+        t.Errorf("Expected 3 pages, got %d", pages)
+    }
+    if fmt.Sprint(seen) != fmt.Sprint(ids) {
+        t.Errorf("Expected rows %v, got %v", ids, seen)
+    }
+
+    _, next, err := client.QueryDesignDocumentPage("rev_filter", "high_rev_gen", 0, "")
+    if err != nil {
+        t.Fatalf("Expected no error for an empty page, got %v", err)
+    }
+    if next != "" {
+        t.Errorf("Expected no bookmark after an empty page, got %q", next)
+    }
+}
+
+// TestEstimateReclaimableBytes checks that only the bodies of the conflict
+// leaves being removed are counted, and that a compacted leaf counts as zero.
+func TestEstimateReclaimableBytes(t *testing.T) {
+    leaf := `{"_id":"doc1","_rev":"2-b","value":"a much larger conflicting body"}`
+    var requested []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rev := r.URL.Query().Get("rev")
+        requested = append(requested, rev)
+        if rev != "2-b" {
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error":"not_found","reason":"missing"}`)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        fmt.Fprint(w, leaf)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    estimate, err := client.EstimateReclaimableBytes("doc1", []string{"2-b", "2-a"})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if estimate.Leaves != 2 {
+        t.Errorf("Expected 2 leaves, got %d", estimate.Leaves)
+    }
+    var doc map[string]interface{}
+    json.Unmarshal([]byte(leaf), &doc)
+    content, _ := json.Marshal(doc)
+    if estimate.ReclaimableBytes != int64(len(content)) {
+        t.Errorf("Expected %d reclaimable bytes, got %d", len(content), estimate.ReclaimableBytes)
+    }
+    if fmt.Sprint(requested) != "[2-b 2-a]" {
+        t.Errorf("Expected only the conflict leaves to be fetched, got %v", requested)
+    }
+}
+
+// TestVerifyDocument checks that a document read back with a different body
+// is reported as a mismatch, while a different _rev is ignored.
+func TestVerifyDocument(t *testing.T) {
+    stored := `{"_id":"doc1","_rev":"1-new","value":"x"}`
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+        fmt.Fprint(w, stored)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+
+    doc := map[string]interface{}{"_id": "doc1", "_rev": "5-old", "value": "x"}
+    if err := client.VerifyDocument(doc); err != nil {
+        t.Errorf("Expected no error, got %v", err)
+    }
+
+    doc["value"] = "y"
+    if err := client.VerifyDocument(doc); !errors.Is(err, ErrDocumentMismatch) {
+        t.Errorf("Expected ErrDocumentMismatch, got %v", err)
+    }
+}
+
+// TestLocalDocuments lists the local documents of a database and deletes one,
+// checking the _local/ path is kept and its revision is sent.
+func TestLocalDocuments(t *testing.T) {
+    var deleted string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case r.URL.Path == "/testdb/_local_docs":
+            fmt.Fprint(w, `{"rows": [{"id": "_local/checkpoint-1", "key": "_local/checkpoint-1", "value": {"rev": "0-3"}}]}`)
+        case r.Method == http.MethodGet && r.URL.Path == "/testdb/_local/checkpoint-1":
+            fmt.Fprint(w, `{"_id": "_local/checkpoint-1", "_rev": "0-3"}`)
+        case r.Method == http.MethodDelete && r.URL.Path == "/testdb/_local/checkpoint-1":
+            deleted = r.URL.Query().Get("rev")
+            fmt.Fprint(w, `{"ok": true}`)
+        default:
+            w.WriteHeader(http.StatusNotFound)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+
+    ids, err := client.ListLocalDocuments()
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if len(ids) != 1 || ids[0] != "_local/checkpoint-1" {
+        t.Fatalf("Expected [_local/checkpoint-1], got %v", ids)
+    }
+
+    if err := client.DeleteDocument(ids[0]); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if deleted != "0-3" {
+        t.Errorf("Expected revision 0-3 to be deleted, got %q", deleted)
+    }
+}
+
+// TestGetDocumentStream checks the document body is returned unread and that
+// a missing document is reported as ErrNotFound.
+func TestGetDocumentStream(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/testdb/doc1" {
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error": "not_found"}`)
+            return
+        }
+        fmt.Fprint(w, `{"_id": "doc1", "_rev": "1-a"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+
+    body, err := client.GetDocumentStream("doc1")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    defer body.Close()
+    var doc Document
+    if err := json.NewDecoder(body).Decode(&doc); err != nil {
+        t.Fatalf("Failed to decode document: %v", err)
+    }
+    if doc.Rev != "1-a" {
+        t.Errorf("Expected revision 1-a, got %s", doc.Rev)
+    }
+
+    if _, err := client.GetDocumentStream("missing"); !errors.Is(err, ErrNotFound) {
+        t.Errorf("Expected ErrNotFound, got %v", err)
+    }
+}
+
+// TestGetDocumentRevision checks that a given revision's body is fetched and
+// that a compacted revision is reported as ErrRevisionUnavailable.
+func TestGetDocumentRevision(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Query().Get("rev") {
+        case "2-b":
+            fmt.Fprint(w, `{"_id": "doc1", "_rev": "2-b", "color": "blue"}`)
+        default:
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error": "not_found", "reason": "missing"}`)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    doc, err := client.GetDocumentRevision("doc1", "2-b")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if doc["color"] != "blue" {
+        t.Errorf("Expected the body of 2-b, got %v", doc)
+    }
+
+    _, err = client.GetDocumentRevision("doc1", "1-a")
+    if !errors.Is(err, ErrRevisionUnavailable) || !errors.Is(err, ErrNotFound) {
+        t.Errorf("Expected ErrRevisionUnavailable, got %v", err)
+    }
+}
+
+// TestGetLeafRevisions checks that every leaf of a multipart open_revs
+// response is read, including one with attachments.
+func TestGetLeafRevisions(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("open_revs") != "all" || r.Header.Get("Accept") != "multipart/mixed" {
+            t.Errorf("Unexpected request %s with Accept %q", r.URL, r.Header.Get("Accept"))
+        }
+        w.Header().Set("Content-Type", `multipart/mixed; boundary="outer"`)
+        fmt.Fprint(w, "--outer\r\n"+
+            "Content-Type: application/json\r\n\r\n"+
+            `{"_id": "doc1", "_rev": "3-a", "color": "red"}`+"\r\n"+
+            "--outer\r\n"+
+            "Content-Type: multipart/related; boundary=\"inner\"\r\n\r\n"+
+            "--inner\r\n"+
+            "Content-Type: application/json\r\n\r\n"+
+            `{"_id": "doc1", "_rev": "3-b", "_attachments": {"a.txt": {"follows": true}}}`+"\r\n"+
+            "--inner\r\n"+
+            "Content-Disposition: attachment; filename=\"a.txt\"\r\n\r\n"+
+            "hello\r\n"+
+            "--inner--\r\n"+
+            "--outer\r\n"+
+            "Content-Type: application/json\r\n\r\n"+
+            `{"_id": "doc1", "_rev": "2-c", "_deleted": true}`+"\r\n"+
+            "--outer--")
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    leaves, err := client.GetLeafRevisions("doc1")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    var revs []string
+    for _, leaf := range leaves {
+        revs = append(revs, leaf["_rev"].(string))
+    }
+    if fmt.Sprint(revs) != "[3-a 3-b 2-c]" {
+        t.Errorf("Expected leaves 3-a, 3-b and 2-c, got %v", revs)
+    }
+    if leaves[0]["color"] != "red" || leaves[2]["_deleted"] != true {
+        t.Errorf("Expected the leaf bodies, got %v", leaves)
+    }
+}
+
+// TestSecurity checks reading and replacing the _security document, and that
+// CouchDB's error body is reported on failure.
+func TestSecurity(t *testing.T) {
+    var stored string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/testdb/_security" {
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error": "not_found", "reason": "Database does not exist."}`)
+            return
+        }
+        switch r.Method {
+        case http.MethodGet:
+            fmt.Fprint(w, `{"admins": {"names": ["alice"]}, "members": {"roles": []}}`)
+        case http.MethodPut:
+            body, _ := io.ReadAll(r.Body)
+            stored = string(body)
+            fmt.Fprint(w, `{"ok": true}`)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    security, err := client.GetSecurity()
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fmt.Sprint(security["admins"]) != "map[names:[alice]]" {
+        t.Errorf("Expected alice as admin, got %v", security)
+    }
+    if err := client.SetSecurity(map[string]interface{}{"members": map[string]interface{}{"names": []string{"bob"}}}); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if stored != `{"members":{"names":["bob"]}}` {
+        t.Errorf("Expected the new document to be written, got %s", stored)
+    }
+
+    missing := NewCouchDBClient(mockServer.URL, "missing", ClientOptions{})
+    if _, err := missing.GetSecurity(); err == nil || !strings.Contains(err.Error(), "Database does not exist") {
+        t.Errorf("Expected the error body, got %v", err)
+    }
+    if err := missing.SetSecurity(map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "Database does not exist") {
+        t.Errorf("Expected the error body, got %v", err)
+    }
+}
+
+// TestRequestTimeout checks that a request exceeding the request timeout
+// fails with a *TimeoutError naming the operation and URL.
+func TestRequestTimeout(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(200 * time.Millisecond)
+        fmt.Fprint(w, `{"_id": "doc1", "_rev": "1-a"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{RequestTimeout: 20 * time.Millisecond})
+    _, err := client.GetDocument("doc1")
+
+    var timeoutErr *TimeoutError
+    if !errors.As(err, &timeoutErr) {
+        t.Fatalf("Expected a TimeoutError, got %v", err)
+    }
+    if timeoutErr.Op != http.MethodGet || timeoutErr.URL != mockServer.URL+"/testdb/doc1" {
+        t.Errorf("Expected GET %s/testdb/doc1, got %s %s", mockServer.URL, timeoutErr.Op, timeoutErr.URL)
+    }
+}
+
+// TestGetDocsByKeys checks the keys are posted in one request and that rows
+// for missing keys are reported.
+func TestGetDocsByKeys(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var request struct {
+            Keys []string `json:"keys"`
+        }
+        if r.Method != http.MethodPost || r.URL.Query().Get("include_docs") != "true" {
+            t.Errorf("Expected POST with include_docs=true, got %s %s", r.Method, r.URL)
+        }
+        if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Keys) != 2 {
+            t.Errorf("Expected 2 keys, got %v (%v)", request.Keys, err)
+        }
+        fmt.Fprint(w, `{"total_rows": 1, "offset": 0, "rows": [
+            {"id": "doc1", "key": "doc1", "value": {"rev": "1-a"}, "doc": {"_id": "doc1", "_rev": "1-a"}},
+            {"key": "missing", "error": "not_found"}
+        ]}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    response, err := client.GetDocsByKeys([]string{"doc1", "missing"}, true)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if len(response.Rows) != 2 || response.Rows[0].Value.Rev != "1-a" || response.Rows[0].Doc["_id"] != "doc1" {
+        t.Errorf("Expected doc1 at 1-a with its body, got %+v", response.Rows)
+    }
+    if missing := response.Missing(); len(missing) != 1 || missing[0] != "missing" {
+        t.Errorf("Expected [missing], got %v", missing)
+    }
+}
+
+// TestDocumentURLEscaping checks that document IDs with slashes, spaces and
+// query or fragment characters reach the server as a single path segment.
+func TestDocumentURLEscaping(t *testing.T) {
+    ids := []string{"a/b", "with space", "what?now", "hash#tag", "percent%41", "_local/x/y"}
+    var got []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = append(got, r.URL.EscapedPath())
+        fmt.Fprint(w, `{"_id": "x", "_rev": "1-a"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "my/db", ClientOptions{})
+    for _, id := range ids {
+        if _, err := client.GetDocument(id); err != nil {
+            t.Fatalf("Expected no error for %q, got %v", id, err)
+        }
+    }
+
+    expected := []string{
+        "/my%2Fdb/a%2Fb",
+        "/my%2Fdb/with%20space",
+        "/my%2Fdb/what%3Fnow",
+        "/my%2Fdb/hash%23tag",
+        "/my%2Fdb/percent%2541",
+        "/my%2Fdb/_local/x%2Fy",
+    }
+    if fmt.Sprint(got) != fmt.Sprint(expected) {
+        t.Errorf("Expected paths %v, got %v", expected, got)
+    }
+}
+
+// TestDesignDocumentEscaping checks that design document names with special
+// characters are escaped after an unescaped _design/ prefix, with or without
+// the prefix given.
+func TestDesignDocumentEscaping(t *testing.T) {
+    var got []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = append(got, r.Method+" "+r.URL.EscapedPath()+" "+r.URL.RawQuery)
+        fmt.Fprint(w, `{"_id": "_design/x", "_rev": "1-a"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    if _, err := client.CheckAndDeleteDesignDocument("team/rev filter"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if _, err := client.GetDocument("_design/team/rev filter"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    expected := []string{
+        "GET /testdb/_design/team%2Frev%20filter ",
+        "DELETE /testdb/_design/team%2Frev%20filter rev=1-a",
+        "GET /testdb/_design/team%2Frev%20filter ",
+    }
+    if fmt.Sprint(got) != fmt.Sprint(expected) {
+        t.Errorf("Expected requests %q, got %q", expected, got)
+    }
+}
+
+// TestHandleQueryResponseSeen checks that a document returned by a second
+// view is not handled again when the same Seen set is passed.
+func TestHandleQueryResponseSeen(t *testing.T) {
+    deletes := 0
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodDelete {
+            deletes++
+        }
+        fmt.Fprint(w, `{"ok": true}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Output: io.Discard})
+    page := []byte(`{"rows": [{"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "9-a", "_deleted_conflicts": ["3-b"]}}]}`)
+    opts := HandleOptions{Seen: make(map[string]bool)}
+
+    first, err := client.HandleQueryResponse(page, opts)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    second, err := client.HandleQueryResponse(page, opts)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if first.DocsHandled != 1 || second.DocsHandled != 0 {
+        t.Errorf("Expected 1 then 0 documents handled, got %d then %d", first.DocsHandled, second.DocsHandled)
+    }
+    if deletes != 1 {
+        t.Errorf("Expected 1 delete, got %d", deletes)
+    }
+}
+
+// TestRewriteDocument checks that the document's leaves are purged, the
+// chosen revision is written back with a history of only itself, other
+// leaves are tombstoned with new_edits=false, and a second run writes the
+// same revisions.
+func TestRewriteDocument(t *testing.T) {
+    var payloads []string
+    var purges int
+    history := `{"start": 5, "ids": ["e", "d", "c", "b", "a"]}`
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case r.URL.Path == "/testdb/_purge":
+            purges++
+            history = `{"start": 0, "ids": []}`
+            w.WriteHeader(http.StatusCreated)
+            fmt.Fprint(w, `{"purged": {"doc1": ["5-e", "3-c"]}}`)
+        case r.URL.Path == "/testdb/_bulk_docs":
+            body, _ := io.ReadAll(r.Body)
+            payloads = append(payloads, string(body))
+            var request struct {
+                Docs []map[string]json.RawMessage `json:"docs"`
+            }
+            json.Unmarshal(body, &request)
+            history = string(request.Docs[0]["_revisions"])
+            w.WriteHeader(http.StatusCreated)
+            fmt.Fprint(w, `[]`)
+        case r.URL.Query().Get("conflicts") == "true":
+            fmt.Fprint(w, `{"_id": "doc1", "_rev": "5-e", "_conflicts": ["3-c"]}`)
+        default:
+            fmt.Fprintf(w, `{"_id": "doc1", "_rev": "5-e", "value": 1, "_revisions": %s}`, history)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    for i := 0; i < 2; i++ {
+        deleted, err := client.RewriteDocument("doc1", "5-e")
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        if deleted != 1 {
+            t.Errorf("Expected 1 revision deleted, got %d", deleted)
+        }
+    }
+
+    var request struct {
+        NewEdits *bool                    `json:"new_edits"`
+        Docs     []map[string]interface{} `json:"docs"`
+    }
+    if err := json.Unmarshal([]byte(payloads[0]), &request); err != nil {
+        t.Fatalf("Failed to parse request: %v", err)
+    }
+    if request.NewEdits == nil || *request.NewEdits {
+        t.Errorf("Expected new_edits to be false")
+    }
+    if len(request.Docs) != 2 || request.Docs[0]["_rev"] != "5-e" || request.Docs[1]["_deleted"] != true {
+        t.Fatalf("Expected the kept revision and one tombstone, got %v", request.Docs)
+    }
+    if rev, _ := request.Docs[1]["_rev"].(string); !strings.HasPrefix(rev, "4-") {
+        t.Errorf("Expected the tombstone to be generation 4, got %s", rev)
+    }
+    if payloads[0] != payloads[1] {
+        t.Errorf("Expected both runs to write the same revisions")
+    }
+    if purges != 2 {
+        t.Errorf("Expected the document to be purged before each rewrite, got %d purges", purges)
+    }
+
+    resp, err := http.Get(mockServer.URL + "/testdb/doc1?revs=true")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    defer resp.Body.Close()
+    var doc struct {
+        Revisions struct {
+            Start int      `json:"start"`
+            IDs   []string `json:"ids"`
+        } `json:"_revisions"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+        t.Fatalf("Failed to parse document: %v", err)
+    }
+    if doc.Revisions.Start != 5 || fmt.Sprint(doc.Revisions.IDs) != "[e]" {
+        t.Errorf("Expected a history of only 5-e after the rewrite, got %+v", doc.Revisions)
+    }
+}
+
+// TestServerVersionNotCouchDB checks that a web server answering with HTML is
+// reported as ErrNotCouchDB rather than as a JSON parse error.
+func TestServerVersionNotCouchDB(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        fmt.Fprint(w, "<html><body>It works!</body></html>")
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    if _, err := client.ServerVersion(); !errors.Is(err, ErrNotCouchDB) {
+        t.Errorf("Expected ErrNotCouchDB, got %v", err)
+    }
+
+    couchServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        fmt.Fprint(w, `{"couchdb": "Welcome", "version": "3.3.3"}`)
+    }))
+    defer couchServer.Close()
+
+    client = NewCouchDBClient(couchServer.URL, "testdb", ClientOptions{})
+    version, err := client.ServerVersion()
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if version != "3.3.3" {
+        t.Errorf("Expected version 3.3.3, got %s", version)
+    }
+}
+
+// TestServerVersionStatus checks that error responses are reported by status
+// rather than as not being CouchDB, and that JSON is asked for.
+func TestServerVersionStatus(t *testing.T) {
+    tests := []struct {
+        status       int
+        contentType  string
+        notCouchDB   bool
+        unauthorized bool
+    }{
+        {http.StatusBadGateway, "text/html", false, false},
+        {http.StatusServiceUnavailable, "application/json", false, false},
+        {http.StatusUnauthorized, "application/json", false, true},
+        {http.StatusOK, "text/html", true, false},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Header.Get("Accept") != "application/json" {
+                t.Errorf("Expected Accept: application/json, got %q", r.Header.Get("Accept"))
+            }
+            w.Header().Set("Content-Type", tt.contentType)
+            w.WriteHeader(tt.status)
+            fmt.Fprint(w, "error page")
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        _, err := client.ServerVersion()
+        mockServer.Close()
+        if err == nil {
+            t.Errorf("%d %s: expected an error", tt.status, tt.contentType)
+            continue
+        }
+        if errors.Is(err, ErrNotCouchDB) != tt.notCouchDB {
+            t.Errorf("%d %s: expected ErrNotCouchDB to be %v, got %v", tt.status, tt.contentType, tt.notCouchDB, err)
+        }
+        if errors.Is(err, ErrUnauthorized) != tt.unauthorized {
+            t.Errorf("%d %s: expected ErrUnauthorized to be %v, got %v", tt.status, tt.contentType, tt.unauthorized, err)
+        }
+    }
+}
+
+// TestHandleQueryResponseDeleteConcurrency deletes many conflict revisions in
+// parallel with one of them failing, and checks the failure is counted without
+// stopping the other deletes.
+func TestHandleQueryResponseDeleteConcurrency(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("rev") == "2-bad" {
+            w.WriteHeader(http.StatusConflict)
+            fmt.Fprint(w, `{"error": "conflict"}`)
+            return
+        }
+        fmt.Fprint(w, `{"ok": true}`)
+    }))
+    defer mockServer.Close()
+
+    var conflicts []string
+    for i := 0; i < 9; i++ {
+        conflicts = append(conflicts, fmt.Sprintf("%q", fmt.Sprintf("2-c%d", i)))
+    }
+    conflicts = append(conflicts, `"2-bad"`)
+    page := fmt.Sprintf(`{"rows": [{"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "9-a", "_deleted_conflicts": [%s]}}]}`, strings.Join(conflicts, ","))
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Output: io.Discard})
+    result, err := client.HandleQueryResponse([]byte(page), HandleOptions{DeleteConcurrency: 4})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if result.ConflictsDeleted != 9 || result.ConflictsFailed != 1 {
+        t.Errorf("Expected 9 deleted and 1 failed, got %d and %d", result.ConflictsDeleted, result.ConflictsFailed)
+    }
+    if result.DocsHandled != 1 {
+        t.Errorf("Expected 1 document handled, got %d", result.DocsHandled)
+    }
+}
+
+// TestEnsureFullCommit checks the flush is only needed before 3.0 and that it
+// posts to _ensure_full_commit.
+func TestEnsureFullCommit(t *testing.T) {
+    for version, expected := range map[string]bool{"2.3.1": true, "3.3.3": false, "unknown": false} {
+        if NeedsFullCommit(version) != expected {
+            t.Errorf("Expected NeedsFullCommit(%q) to be %v", version, expected)
+        }
+    }
+
+    var path string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        path = r.Method + " " + r.URL.Path
+        w.WriteHeader(http.StatusCreated)
+        fmt.Fprint(w, `{"ok": true, "instance_start_time": "0"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    if err := client.EnsureFullCommit(); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if path != "POST /testdb/_ensure_full_commit" {
+        t.Errorf("Expected POST /testdb/_ensure_full_commit, got %s", path)
+    }
+}
+
+// TestFindDocsOverRevCount pages through the _changes feed and checks that
+// every live document at or above the threshold is reported, conflicted or
+// not, most revisions first.
+func TestFindDocsOverRevCount(t *testing.T) {
+    pages := map[string]string{
+        "": `{"results": [
+            {"seq": "1-a", "id": "doc1", "changes": [{"rev": "500-a"}, {"rev": "3-b"}]},
+            {"seq": "2-a", "id": "doc2", "changes": [{"rev": "800-c"}]}
+        ], "last_seq": "2-a", "pending": 2}`,
+        "2-a": `{"results": [
+            {"seq": "3-a", "id": "doc3", "changes": [{"rev": "20-d"}]},
+            {"seq": "4-a", "id": "doc4", "deleted": true, "changes": [{"rev": "900-e"}]}
+        ], "last_seq": "4-a", "pending": 0}`,
+    }
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, pages[r.URL.Query().Get("since")])
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    docs, err := client.FindDocsOverRevCount(500, 2)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fmt.Sprint(docs) != "[{doc2 800} {doc1 500}]" {
+        t.Errorf("Expected doc2 and doc1, got %v", docs)
+    }
+}
+
+// TestClusterSetupState checks the state is read from /_cluster_setup and
+// that only the finished states count as set up.
+func TestClusterSetupState(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/_cluster_setup" {
+            http.NotFound(w, r)
+            return
+        }
+        fmt.Fprint(w, `{"state": "cluster_disabled"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    state, err := client.ClusterSetupState()
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if state != "cluster_disabled" || SetupFinished(state) {
+        t.Errorf("Expected an unfinished cluster_disabled state, got %s", state)
+    }
+    if !SetupFinished("single_node_finished") || !SetupFinished("cluster_finished") {
+        t.Errorf("Expected the finished states to count as set up")
+    }
+}
+
+// TestDiffDesignDocuments checks that added, removed and changed views are
+// reported and identical views are not.
+func TestDiffDesignDocuments(t *testing.T) {
+    existing := map[string]interface{}{"views": map[string]interface{}{
+        "same":    map[string]interface{}{"map": "function(doc) { emit(doc._id); }"},
+        "changed": map[string]interface{}{"map": "function(doc) { emit(1); }"},
+        "removed": map[string]interface{}{"map": "function(doc) {}"},
+    }}
+    proposed := map[string]interface{}{"views": map[string]interface{}{
+        "same":    map[string]interface{}{"map": "function(doc) { emit(doc._id); }"},
+        "changed": map[string]interface{}{"map": "function(doc) { emit(2); }", "reduce": "_count"},
+        "added":   map[string]interface{}{"map": "function(doc) {}"},
+    }}
+
+    expected := []string{
+        "view added added",
+        `view changed: map changed from "function(doc) { emit(1); }" to "function(doc) { emit(2); }"`,
+        `view changed: reduce changed from "" to "_count"`,
+        "view removed removed",
+    }
+    diff := DiffDesignDocuments(existing, proposed)
+    if strings.Join(diff, "\n") != strings.Join(expected, "\n") {
+        t.Errorf("Expected %q, got %q", expected, diff)
+    }
+    if diff := DiffDesignDocuments(proposed, proposed); len(diff) != 0 {
+        t.Errorf("Expected no differences, got %q", diff)
+    }
+}
+
+// TestClientCertificate checks that the client certificate is presented to a
+// server requiring mutual TLS.
+func TestClientCertificate(t *testing.T) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "purge-client"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+    mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+    }))
+    mockServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+    mockServer.StartTLS()
+    defer mockServer.Close()
+    roots := mockServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+    for _, opts := range []ClientOptions{{}, {ClientCertificate: &cert}} {
+        transport := newTransport(opts)
+        if transport.TLSClientConfig == nil {
+            transport.TLSClientConfig = &tls.Config{}
+        }
+        transport.TLSClientConfig.RootCAs = roots
+
+        resp, err := (&http.Client{Transport: transport}).Get(mockServer.URL)
+        if opts.ClientCertificate == nil {
+            if err == nil {
+                resp.Body.Close()
+                t.Errorf("Expected the server to refuse a client without a certificate")
+            }
+            continue
+        }
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if string(body) != "purge-client" {
+            t.Errorf("Expected the client certificate to be presented, got %q", body)
+        }
+    }
+}
+
+// TestHTTPProtocol checks that ProtocolHTTP1 stays on HTTP/1.1 with a server
+// offering HTTP/2, and that ProtocolHTTP2 negotiates it.
+func TestHTTPProtocol(t *testing.T) {
+    mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, r.Proto)
+    }))
+    mockServer.EnableHTTP2 = true
+    mockServer.StartTLS()
+    defer mockServer.Close()
+
+    for protocol, expected := range map[HTTPProtocol]string{ProtocolHTTP1: "HTTP/1.1", ProtocolHTTP2: "HTTP/2.0"} {
+        transport := baseTransport(ClientOptions{Protocol: protocol, Gzip: true}).(*http.Transport)
+        transport.TLSClientConfig = mockServer.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+        resp, err := (&http.Client{Transport: transport}).Get(mockServer.URL)
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if string(body) != expected {
+            t.Errorf("Expected %s, got %s", expected, body)
+        }
+    }
+}
+
+// TestBuildPurgeMap checks that each document is looked up once, documents
+// without revisions are left out and lookup errors are returned.
+func TestBuildPurgeMap(t *testing.T) {
+    var resp QueryResponse
+    page := `{"rows": [
+        {"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "3-a"}},
+        {"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "3-a"}},
+        {"id": "doc2", "key": "doc2", "value": {"_id": "doc2", "_rev": "1-b"}}
+    ]}`
+    if err := json.Unmarshal([]byte(page), &resp); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    lookups := 0
+    purgeMap, err := BuildPurgeMap(&resp, func(docID string) ([]string, error) {
+        lookups++
+        if docID == "doc1" {
+            return []string{"1-x", "2-y"}, nil
+        }
+        return nil, nil
+    })
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if lookups != 2 {
+        t.Errorf("Expected 2 lookups, got %d", lookups)
+    }
+    if fmt.Sprint(purgeMap) != "map[doc1:[1-x 2-y]]" {
+        t.Errorf("Expected only doc1 with 2 revisions, got %v", purgeMap)
+    }
+
+    _, err = BuildPurgeMap(&resp, func(docID string) ([]string, error) {
+        return nil, ErrNotFound
+    })
+    if !errors.Is(err, ErrNotFound) {
+        t.Errorf("Expected ErrNotFound, got %v", err)
+    }
+}
+
+// TestGzipResponses checks that with Gzip the client asks for a compressed
+// response and reads it decompressed, and that without it no compression is
+// asked for.
+func TestGzipResponses(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Accept-Encoding") != "gzip" {
+            fmt.Fprint(w, `{"_id": "doc1", "compressed": false}`)
+            return
+        }
+        w.Header().Set("Content-Encoding", "gzip")
+        writer := gzip.NewWriter(w)
+        fmt.Fprint(writer, `{"_id": "doc1", "compressed": true}`)
+        writer.Close()
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Gzip: true})
+    doc, err := client.GetDocument("doc1")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if doc["compressed"] != true {
+        t.Errorf("Expected a compressed response, got %v", doc)
+    }
+
+    client = NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    doc, err = client.GetDocument("doc1")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if doc["compressed"] != false {
+        t.Errorf("Expected an uncompressed response, got %v", doc)
+    }
+}
+
+// TestMaxResponseBytes checks that a response larger than the limit fails
+// with ErrResponseTooLarge and a smaller one is read normally.
+func TestMaxResponseBytes(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, `{"_id": %q}`, strings.TrimPrefix(r.URL.Path, "/testdb/"))
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{MaxResponseBytes: 20})
+    if _, err := client.GetDocument("short"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if _, err := client.GetDocument(strings.Repeat("x", 50)); !errors.Is(err, ErrResponseTooLarge) {
+        t.Errorf("Expected ErrResponseTooLarge, got %v", err)
+    }
+}
+
+// TestThrottleTransport checks that the throttle starts delaying requests
+// once the p95 latency exceeds the threshold and lifts the delay once
+// latency recovers.
+func TestThrottleTransport(t *testing.T) {
+    var output strings.Builder
+    throttle := &throttleTransport{threshold: time.Millisecond, output: &output}
+    req := httptest.NewRequest("GET", "http://couchdb:5984/", nil)
+
+    for i := 0; i < throttleMinSamples; i++ {
+        throttle.observe(req, 3*time.Millisecond)
+    }
+    if delay := throttle.currentDelay(); delay != throttleInitialDelay || !strings.Contains(output.String(), "Backing off couchdb:5984") {
+        t.Fatalf("Expected to back off by %s, got %s and output %q", throttleInitialDelay, delay, output.String())
+    }
+
+    for i := 0; i < 4*throttleMinSamples; i++ {
+        throttle.observe(req, 0)
+    }
+    if delay := throttle.currentDelay(); delay != 0 || !strings.Contains(output.String(), "no longer waiting") {
+        t.Errorf("Expected the delay to be lifted, got %s and output %q", delay, output.String())
+    }
+}
+
+// TestCheckVersionCompatibility checks the supported version boundaries.
+func TestCheckVersionCompatibility(t *testing.T) {
+    tests := []struct {
+        version   string
+        supported bool
+    }{
+        {"1.7.2", false},
+        {"2.2.0", false},
+        {"2.3.0", true},
+        {"2.3.1", true},
+        {"3.3.3", true},
+        {"garbage", false},
+        {"", false},
+    }
+
+    for _, tt := range tests {
+        err := CheckVersionCompatibility(tt.version)
+        if tt.supported && err != nil {
+            t.Errorf("CheckVersionCompatibility(%q): expected no error, got %v", tt.version, err)
+        }
+        if !tt.supported && err == nil {
+            t.Errorf("CheckVersionCompatibility(%q): expected an error", tt.version)
+        }
+    }
+}
+
+// TestQueryViewWithReduce pages through, and looks up keys in, a view with a
+// reduce function and checks the document rows are returned rather than the
+// reduced value.
+func TestQueryViewWithReduce(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("reduce") != "false" {
+            fmt.Fprint(w, `{"rows": [{"key": null, "value": 2}]}`)
+            return
+        }
+        fmt.Fprint(w, `{"total_rows": 2, "offset": 0, "rows": [
+            {"id": "a", "key": "a", "value": {"_id": "a", "_rev": "1-x"}},
+            {"id": "b", "key": "b", "value": {"_id": "b", "_rev": "1-y"}}
+        ]}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    page, _, err := client.QueryDesignDocumentPage("rev_filter", "high_rev_gen", 10, "")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    keys, err := client.QueryDesignDocumentKeys("rev_filter", "high_rev_gen", []string{"a", "b"})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    for _, body := range []string{page, keys} {
+        var response QueryResponse
+        if err := json.Unmarshal([]byte(body), &response); err != nil {
+            t.Fatalf("Expected document rows, got %v", err)
+        }
+        if len(response.Rows) != 2 || response.Rows[0].Value.Document().ID != "a" {
+            t.Errorf("Expected rows for a and b, got %s", body)
+        }
+    }
+}
+
+// TestRevGeneration checks generation parsing of valid and invalid revisions.
+func TestRevGeneration(t *testing.T) {
+    tests := []struct {
+        rev     string
+        gen     int
+        invalid bool
+    }{
+        {"1-abc", 1, false},
+        {"250000-def", 250000, false},
+        {"abc", 0, true},
+        {"x-abc", 0, true},
+        {"", 0, true},
+    }
+
+    for _, tt := range tests {
+        gen, err := RevGeneration(tt.rev)
+        if tt.invalid {
+            if err == nil {
+                t.Errorf("RevGeneration(%q): expected an error", tt.rev)
+            }
+            continue
+        }
+        if err != nil || gen != tt.gen {
+            t.Errorf("RevGeneration(%q): expected %d, got %d, %v", tt.rev, tt.gen, gen, err)
+        }
+    }
+}
+
+// TestHandleQueryResponseMinGenerationAge checks which conflict revisions are
+// kept and which deleted for a range of generation ages.
+func TestHandleQueryResponseMinGenerationAge(t *testing.T) {
+    tests := []struct {
+        minAge  int
+        deleted []string
+        kept    int
+    }{
+        {0, []string{"2-a", "8-b", "10-c"}, 0},
+        {1, []string{"2-a", "8-b"}, 1},
+        {3, []string{"2-a"}, 2},
+        {9, nil, 3},
+    }
+
+    for _, tt := range tests {
+        var deleted []string
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == http.MethodDelete {
+                deleted = append(deleted, r.URL.Query().Get("rev"))
+            }
+            fmt.Fprint(w, `{"ok": true}`)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Output: io.Discard})
+        page := []byte(`{"rows": [{"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "10-z", "_deleted_conflicts": ["2-a", "8-b", "10-c"]}}]}`)
+        result, err := client.HandleQueryResponse(page, HandleOptions{MinGenerationAge: tt.minAge})
+        mockServer.Close()
+        if err != nil {
+            t.Fatalf("MinGenerationAge %d: expected no error, got %v", tt.minAge, err)
+        }
+        if fmt.Sprint(deleted) != fmt.Sprint(tt.deleted) || result.ConflictsKept != tt.kept {
+            t.Errorf("MinGenerationAge %d: expected %v deleted and %d kept, got %v and %d", tt.minAge, tt.deleted, tt.kept, deleted, result.ConflictsKept)
+        }
+    }
+}
+
+// TestActiveReplications checks the scheduler path, the fallback to
+// /_active_tasks on servers without the scheduler, and that a 401 is reported
+// as ErrUnauthorized.
+func TestActiveReplications(t *testing.T) {
+    tests := []struct {
+        name      string
+        scheduler int
+        expected  []string
+        err       error
+    }{
+        {"scheduler", http.StatusOK, []string{"rep1"}, nil},
+        {"fallback", http.StatusNotFound, []string{"task1"}, nil},
+        {"unauthorized", http.StatusUnauthorized, nil, ErrUnauthorized},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            switch r.URL.Path {
+            case "/_scheduler/docs":
+                w.WriteHeader(tt.scheduler)
+                fmt.Fprint(w, `{"docs": [
+                    {"doc_id": "rep1", "source": "http://a/testdb", "target": "http://b/testdb", "state": "running"},
+                    {"doc_id": "rep2", "source": "http://a/testdb", "target": "http://b/testdb", "state": "completed"},
+                    {"doc_id": "rep3", "source": "http://a/otherdb", "target": "http://b/otherdb", "state": "running"}
+                ]}`)
+            case "/_active_tasks":
+                fmt.Fprint(w, `[{"type": "replication", "replication_id": "task1", "source": "testdb", "target": "http://b/testdb"}]`)
+            }
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        replications, err := client.ActiveReplications()
+        mockServer.Close()
+        if !errors.Is(err, tt.err) {
+            t.Fatalf("%s: expected error %v, got %v", tt.name, tt.err, err)
+        }
+        var ids []string
+        for _, replication := range replications {
+            ids = append(ids, replication.ID)
+        }
+        if fmt.Sprint(ids) != fmt.Sprint(tt.expected) {
+            t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, ids)
+        }
+    }
+}
+
+// TestWaitForCompaction checks that waiting ends once compaction finishes,
+// gives up at the deadline while compaction is stuck, and gives up after
+// repeated failures to read the active tasks.
+func TestWaitForCompaction(t *testing.T) {
+    tests := []struct {
+        name     string
+        handler  func(polls int, w http.ResponseWriter)
+        expected string
+    }{
+        {"finishes", func(polls int, w http.ResponseWriter) {
+            if polls < 3 {
+                fmt.Fprint(w, `[{"type": "database_compaction", "database": "testdb", "progress": 50}]`)
+                return
+            }
+            fmt.Fprint(w, `[]`)
+        }, ""},
+        {"stuck", func(polls int, w http.ResponseWriter) {
+            fmt.Fprint(w, `[{"type": "database_compaction", "database": "testdb", "progress": 50}]`)
+        }, "still running"},
+        {"unreachable", func(polls int, w http.ResponseWriter) {
+            w.WriteHeader(http.StatusInternalServerError)
+        }, "3 times in a row"},
+    }
+
+    for _, tt := range tests {
+        polls := 0
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            polls++
+            tt.handler(polls, w)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        err := client.WaitForCompaction(time.Millisecond, 50*time.Millisecond, logger.NewWriterLogger(io.Discard))
+        mockServer.Close()
+        if tt.expected == "" && err != nil {
+            t.Errorf("%s: expected no error, got %v", tt.name, err)
+        }
+        if tt.expected != "" && (err == nil || !strings.Contains(err.Error(), tt.expected)) {
+            t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.expected, err)
+        }
+    }
+}
+
+// TestFindDeletedDocuments pages through a _changes feed until nothing is
+// pending and checks that only documents still deleted at the end are kept.
+func TestFindDeletedDocuments(t *testing.T) {
+    pages := map[string]string{
+        "": `{"results": [
+            {"seq": "1-a", "id": "doc1", "deleted": true, "changes": [{"rev": "2-a"}]},
+            {"seq": "2-a", "id": "doc2", "deleted": true, "changes": [{"rev": "3-a"}, {"rev": "2-b"}]}
+        ], "last_seq": "2-a", "pending": 3}`,
+        "2-a": `{"results": [
+            {"seq": "3-a", "id": "doc3", "changes": [{"rev": "1-a"}]},
+            {"seq": "4-a", "id": "doc1", "changes": [{"rev": "3-a"}]}
+        ], "last_seq": "4-a", "pending": 1}`,
+        "4-a": `{"results": [
+            {"seq": "5-a", "id": "doc4", "deleted": true, "changes": [{"rev": "2-a"}]}
+        ], "last_seq": "5-a", "pending": 0}`,
+    }
+
+    var requested []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        since := r.URL.Query().Get("since")
+        requested = append(requested, since)
+        if r.URL.Query().Get("limit") != "2" {
+            t.Errorf("Expected limit=2, got %q", r.URL.Query().Get("limit"))
+        }
+        fmt.Fprint(w, pages[since])
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    deleted, err := client.FindDeletedDocuments(2)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if len(requested) != 3 {
+        t.Errorf("Expected 3 pages to be read, got %v", requested)
+    }
+    if len(deleted) != 2 || len(deleted["doc2"]) != 2 || len(deleted["doc4"]) != 1 {
+        t.Errorf("Expected doc2 and doc4 to be deleted, got %v", deleted)
+    }
+}
+
+// TestInspectDocument builds the revision tree of a conflicted document and
+// checks that a missing document reports ErrNotFound.
+func TestInspectDocument(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/testdb/doc1" {
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error": "not_found", "reason": "missing"}`)
+            return
+        }
+        query := r.URL.Query()
+        if query.Get("revs_info") == "true" {
+            fmt.Fprint(w, `{"_id": "doc1", "_rev": "5-e", "_revs_info": [
+                {"rev": "5-e", "status": "available"},
+                {"rev": "4-d", "status": "available"},
+                {"rev": "3-c", "status": "missing"}
+            ]}`)
+            return
+        }
+        if query.Get("conflicts") != "true" || query.Get("deleted_conflicts") != "true" {
+            t.Errorf("Expected conflicts and deleted_conflicts to be requested, got %s", r.URL.RawQuery)
+        }
+        fmt.Fprint(w, `{"_id": "doc1", "_rev": "5-e", "_conflicts": ["5-x"], "_deleted_conflicts": ["4-y", "3-z"]}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    tree, err := client.InspectDocument("doc1")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if tree.CurrentRev != "5-e" || tree.RevisionCount != 3 || tree.MinGeneration != 3 || tree.MaxGeneration != 5 {
+        t.Errorf("Unexpected revision tree %+v", tree)
+    }
+    if len(tree.Conflicts) != 1 || len(tree.DeletedConflicts) != 2 {
+        t.Errorf("Expected 1 conflict and 2 deleted conflicts, got %v and %v", tree.Conflicts, tree.DeletedConflicts)
+    }
+    if tree.SizeBytes == 0 {
+        t.Errorf("Expected the body size to be recorded")
+    }
+
+    if _, err := client.InspectDocument("missing"); !errors.Is(err, ErrNotFound) {
+        t.Errorf("Expected ErrNotFound, got %v", err)
+    }
+}
+
+// TestConditionalDeletes checks that with ConditionalDeletes set, conflicts
+// are only deleted while the document's ETag still matches the revision read
+// from the view, and that a reset is refused once the document has moved on.
+func TestConditionalDeletes(t *testing.T) {
+    current := map[string]string{"doc1": "9-a", "doc2": "10-b"}
+    var deletes []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        docID := strings.TrimPrefix(r.URL.Path, "/testdb/")
+        switch r.Method {
+        case http.MethodHead:
+            w.Header().Set("ETag", fmt.Sprintf("%q", current[docID]))
+        case http.MethodDelete:
+            deletes = append(deletes, docID+"@"+r.URL.Query().Get("rev"))
+            fmt.Fprint(w, `{"ok": true}`)
+        case http.MethodGet:
+            if r.URL.Query().Get("revs_info") == "true" {
+                fmt.Fprintf(w, `{"_id": %q, "_rev": "9-b", "_revs_info": [{"rev": "9-b", "status": "available"}]}`, docID)
+                return
+            }
+            fmt.Fprintf(w, `{"_id": %q, "_rev": "9-b"}`, docID)
+        default:
+            t.Errorf("Unexpected %s %s", r.Method, r.URL.Path)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Output: io.Discard, ConditionalDeletes: true})
+    page := []byte(`{"rows": [
+        {"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "9-a", "_deleted_conflicts": ["3-c"]}},
+        {"id": "doc2", "key": "doc2", "value": {"_id": "doc2", "_rev": "9-b", "_deleted_conflicts": ["4-d"]}}
+    ]}`)
+
+    result, err := client.HandleQueryResponse(page, HandleOptions{})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if result.DocsHandled != 1 || result.DocsChanged != 1 {
+        t.Errorf("Expected 1 document handled and 1 changed, got %d and %d", result.DocsHandled, result.DocsChanged)
+    }
+    if fmt.Sprint(deletes) != "[doc1@3-c]" {
+        t.Errorf("Expected only doc1's conflict to be deleted, got %v", deletes)
+    }
+
+    deletes = nil
+    _, err = client.ResetDocument("doc2", logger.NewWriterLogger(io.Discard), nil)
+    if !errors.Is(err, ErrRevisionChanged) {
+        t.Errorf("Expected ErrRevisionChanged, got %v", err)
+    }
+    if len(deletes) != 0 {
+        t.Errorf("Expected nothing to be deleted, got %v", deletes)
+    }
+}
+
+// TestHandleQueryResponseCountsTimeouts checks that a conflict delete that
+// times out is counted as a timeout as well as a failure, without stopping
+// the other deletes.
+func TestHandleQueryResponseCountsTimeouts(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("rev") == "2-slow" {
+            time.Sleep(200 * time.Millisecond)
+        }
+        fmt.Fprint(w, `{"ok": true}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Output: io.Discard, RequestTimeout: 50 * time.Millisecond})
+    page := []byte(`{"rows": [{"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "9-a", "_deleted_conflicts": ["2-slow", "2-fast"]}}]}`)
+
+    result, err := client.HandleQueryResponse(page, HandleOptions{})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if result.ConflictsDeleted != 1 || result.ConflictsFailed != 1 || result.TimedOut != 1 {
+        t.Errorf("Expected 1 deleted, 1 failed and 1 timed out, got %d, %d and %d", result.ConflictsDeleted, result.ConflictsFailed, result.TimedOut)
+    }
+}
+
+// TestViewValue checks that every emitted field is kept, and that views
+// emitting keys and values other than documents can still be handled.
+func TestViewValue(t *testing.T) {
+    page := []byte(`{"rows": [
+        {"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "9-a", "_deleted_conflicts": ["3-c"], "type": "order"}},
+        {"id": "doc2", "key": ["order", 2], "value": 42}
+    ]}`)
+    var response QueryResponse
+    if err := json.Unmarshal(page, &response); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    first, second := response.Rows[0].Value, response.Rows[1].Value
+    if first.Fields["type"] != "order" || first.Document().Rev != "9-a" || len(first.Document().DeletedConflicts) != 1 {
+        t.Errorf("Expected the whole document, got %s", first.Raw)
+    }
+    if second.Fields != nil || string(second.Raw) != "42" || second.Document().ID != "" {
+        t.Errorf("Expected a plain value, got %s", second.Raw)
+    }
+
+    client := NewCouchDBClient("http://127.0.0.1:1", "testdb", ClientOptions{Output: io.Discard})
+    result, err := client.HandleQueryResponse([]byte(`{"rows": [{"id": "doc2", "key": ["order", 2], "value": 42}]}`), HandleOptions{})
+    if err != nil || result.DocsHandled != 0 {
+        t.Errorf("Expected the row to be ignored, got %+v and %v", result, err)
+    }
+}
+
+// TestViewRowDocument checks the document ID found for each shape of row a
+// view can emit.
+func TestViewRowDocument(t *testing.T) {
+    tests := []struct {
+        name string
+        row  string
+        id   string
+        rev  string
+    }{
+        {"whole document", `{"id": "doc1", "key": "doc1", "value": {"_id": "doc1", "_rev": "9-a"}}`, "doc1", "9-a"},
+        {"object without _id", `{"id": "doc1", "key": 3, "value": {"_rev": "9-a"}}`, "doc1", "9-a"},
+        {"number", `{"id": "doc2", "key": ["order", 2], "value": 42}`, "doc2", ""},
+        {"string", `{"id": "doc3", "key": "doc3", "value": "9-a"}`, "doc3", ""},
+        {"null", `{"id": "doc4", "key": null, "value": null}`, "doc4", ""},
+        {"reduced, string key", `{"key": "doc5", "value": 7}`, "doc5", ""},
+        {"reduced, array key", `{"key": ["order", 2], "value": 7}`, "", ""},
+        {"reduced, no key", `{"key": null, "value": 7}`, "", ""},
+    }
+
+    for _, tt := range tests {
+        var row ViewRow
+        if err := json.Unmarshal([]byte(tt.row), &row); err != nil {
+            t.Fatalf("%s: expected no error, got %v", tt.name, err)
+        }
+        doc := row.Document()
+        if doc.ID != tt.id || doc.Rev != tt.rev {
+            t.Errorf("%s: expected ID %q and rev %q, got %q and %q", tt.name, tt.id, tt.rev, doc.ID, doc.Rev)
+        }
+    }
+}
+
+// TestHandleQueryResponseRowWithoutID checks that a row without a usable
+// document ID is reported and does not mark an empty ID as seen.
+func TestHandleQueryResponseRowWithoutID(t *testing.T) {
+    var output strings.Builder
+    client := NewCouchDBClient("http://127.0.0.1:1", "testdb", ClientOptions{Output: &output})
+    seen := make(map[string]bool)
+    result, err := client.HandleQueryResponse([]byte(`{"rows": [{"key": ["order", 2], "value": 7}]}`), HandleOptions{Seen: seen})
+    if err != nil || result.DocsHandled != 0 {
+        t.Errorf("Expected the row to be skipped, got %+v and %v", result, err)
+    }
+    if len(seen) != 0 {
+        t.Errorf("Expected nothing to be marked seen, got %v", seen)
+    }
+    if !strings.Contains(output.String(), "without a document ID") {
+        t.Errorf("Expected the row to be reported, got %q", output.String())
+    }
+}
+
+// TestBuildIndex checks that building the index queries the view for no rows.
+func TestBuildIndex(t *testing.T) {
+    var query string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        query = r.URL.Path + "?" + r.URL.RawQuery
+        fmt.Fprint(w, `{"total_rows": 12, "offset": 0, "rows": []}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    if err := client.BuildIndex("rev_filter", "high_rev_gen"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if query != "/testdb/_design/rev_filter/_view/high_rev_gen?reduce=false&limit=0" {
+        t.Errorf("Expected a query for no rows, got %s", query)
+    }
+}
+
+// TestListDatabases checks that the database list is assembled from several
+// pages of /_all_dbs, each starting after the last name of the one before.
+func TestListDatabases(t *testing.T) {
+    all := []string{"_replicator", "_users", "db1", "db2", "db3", "db4", "db5"}
+    requests := 0
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        query := r.URL.Query()
+        limit, _ := strconv.Atoi(query.Get("limit"))
+        start := 0
+        if startKey := query.Get("startkey"); startKey != "" {
+            for i, name := range all {
+                if fmt.Sprintf("%q", name) == startKey {
+                    start = i
+                }
+            }
+            if query.Get("skip") == "1" {
+                start++
+            }
+        }
+        end := start + limit
+        if end > len(all) {
+            end = len(all)
+        }
+        json.NewEncoder(w).Encode(all[start:end])
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "", ClientOptions{})
+    names, err := client.listDatabases(3)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fmt.Sprint(names) != fmt.Sprint(all) {
+        t.Errorf("Expected %v, got %v", all, names)
+    }
+    if requests != 3 {
+        t.Errorf("Expected 3 pages, got %d", requests)
+    }
+}
+
+// TestDesignDocumentETag checks that a design document read before is asked
+// for with If-None-Match, and that its cached revision is used to delete it
+// when CouchDB answers 304 Not Modified.
+func TestDesignDocumentETag(t *testing.T) {
+    var fullReads, notModified int
+    var deletedRev string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+            if r.Header.Get("If-None-Match") == `"3-abc"` {
+                notModified++
+                w.WriteHeader(http.StatusNotModified)
+                return
+            }
+            fullReads++
+            w.Header().Set("ETag", `"3-abc"`)
+            fmt.Fprint(w, `{"_id": "_design/rev_filter", "_rev": "3-abc", "views": {}}`)
+        case http.MethodDelete:
+            deletedRev = r.URL.Query().Get("rev")
+            fmt.Fprint(w, `{"ok": true}`)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    if _, err := client.GetDesignDocument("rev_filter"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    doc, err := client.GetDesignDocument("rev_filter")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if doc["_rev"] != "3-abc" {
+        t.Errorf("Expected the cached design document, got %v", doc)
+    }
+    if _, err := client.CheckAndDeleteDesignDocument("rev_filter"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if fullReads != 1 || notModified != 2 {
+        t.Errorf("Expected 1 full read and 2 not modified, got %d and %d", fullReads, notModified)
+    }
+    if deletedRev != "3-abc" {
+        t.Errorf("Expected revision 3-abc to be deleted, got %q", deletedRev)
+    }
+
+    // The deleted design document is no longer cached.
+    if _, err := client.GetDesignDocument("rev_filter"); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fullReads != 2 {
+        t.Errorf("Expected a full read after deleting, got %d", fullReads)
+    }
+}
+
+// TestRememberDesignDocument checks that a design document remembered with
+// an ETag from an earlier run is revalidated rather than fetched, and that a
+// created design document is remembered under its new revision.
+func TestRememberDesignDocument(t *testing.T) {
+    var fullReads int
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+            if r.Header.Get("If-None-Match") == `"3-abc"` {
+                w.WriteHeader(http.StatusNotModified)
+                return
+            }
+            fullReads++
+            fmt.Fprint(w, `{"_id": "_design/rev_filter", "_rev": "3-abc", "views": {}}`)
+        case http.MethodPut:
+            w.WriteHeader(http.StatusCreated)
+            fmt.Fprint(w, `{"ok": true, "id": "_design/rev_filter", "rev": "1-def"}`)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    views := map[string]interface{}{"views": map[string]interface{}{"high_rev_gen": map[string]interface{}{"map": "function(doc) {}"}}}
+    client.RememberDesignDocument("rev_filter", `"3-abc"`, views)
+    doc, err := client.GetDesignDocument("rev_filter")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fullReads != 0 || doc["_rev"] != "3-abc" || len(DiffDesignDocuments(doc, views)) != 0 {
+        t.Errorf("Expected the remembered design document without a full read, got %v after %d reads", doc, fullReads)
+    }
+
+    if _, err := client.CreateDesignDocument("other", views); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if etag := client.DesignDocumentETag("other"); etag != `"1-def"` {
+        t.Errorf("Expected ETag \"1-def\" for the created design document, got %q", etag)
+    }
+}
+
+// serveSocks5 accepts connections on ln as a SOCKS5 proxy without
+// authentication, supporting only CONNECT to an IPv4 address, and records the
+// addresses connected to on targets.
+func serveSocks5(ln net.Listener, targets chan<- string) {
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        go func(conn net.Conn) {
+            defer conn.Close()
+            // Greeting: version, number of methods, methods
+            greeting := make([]byte, 2)
+            if _, err := io.ReadFull(conn, greeting); err != nil {
+                return
+            }
+            if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+                return
+            }
+            conn.Write([]byte{5, 0})
+
+            // Request: version, CONNECT, reserved, IPv4, address, port
+            request := make([]byte, 10)
+            if _, err := io.ReadFull(conn, request); err != nil || request[3] != 1 {
+                return
+            }
+            target := net.JoinHostPort(net.IP(request[4:8]).String(), strconv.Itoa(int(request[8])<<8|int(request[9])))
+            upstream, err := net.Dial("tcp", target)
+            if err != nil {
+                conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+                return
+            }
+            defer upstream.Close()
+            targets <- target
+            conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+            go io.Copy(upstream, conn)
+            io.Copy(conn, upstream)
+        }(conn)
+    }
+}
+
+// TestSocks5Proxy checks that requests are sent through the configured SOCKS5
+// proxy.
+func TestSocks5Proxy(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        fmt.Fprint(w, `{"couchdb": "Welcome", "version": "3.3.3"}`)
+    }))
+    defer mockServer.Close()
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    defer ln.Close()
+    targets := make(chan string, 1)
+    go serveSocks5(ln, targets)
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Socks5Proxy: ln.Addr().String()})
+    version, err := client.ServerVersion()
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if version != "3.3.3" {
+        t.Errorf("Expected version 3.3.3, got %s", version)
+    }
+    select {
+    case target := <-targets:
+        if target != mockServer.Listener.Addr().String() {
+            t.Errorf("Expected the proxy to connect to %s, got %s", mockServer.Listener.Addr(), target)
+        }
+    default:
+        t.Errorf("Expected the request to go through the proxy")
+    }
+}
+
+// TestWaitForQuiescence checks that waiting ends once update_seq stops
+// changing, and gives up while it keeps changing.
+func TestWaitForQuiescence(t *testing.T) {
+    var seq int32
+    var writing int32 = 1
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        n := atomic.LoadInt32(&seq)
+        if n < 3 || atomic.LoadInt32(&writing) == 1 {
+            n = atomic.AddInt32(&seq, 1)
+        }
+        fmt.Fprintf(w, `{"db_name": "testdb", "update_seq": "%d-abc"}`, n)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    if err := client.WaitForQuiescence(time.Millisecond); !errors.Is(err, ErrNotQuiescent) {
+        t.Errorf("Expected ErrNotQuiescent, got %v", err)
+    }
+
+    atomic.StoreInt32(&writing, 0)
+    atomic.StoreInt32(&seq, 0)
+    if err := client.WaitForQuiescence(time.Millisecond); err != nil {
+        t.Errorf("Expected no error, got %v", err)
+    }
+    if n := atomic.LoadInt32(&seq); n != 3 {
+        t.Errorf("Expected waiting to stop once the sequence settled at 3, got %d", n)
+    }
+}
+
+// TestUp checks that /_up answering 404 or 503 is reported as maintenance
+// mode and any other failure is not.
+func TestUp(t *testing.T) {
+    tests := []struct {
+        status      int
+        wantErr     bool
+        maintenance bool
+    }{
+        {http.StatusOK, false, false},
+        {http.StatusNotFound, true, true},
+        {http.StatusServiceUnavailable, true, true},
+        {http.StatusInternalServerError, true, false},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.URL.Path != "/_up" {
+                t.Errorf("Expected a request for /_up, got %s", r.URL.Path)
+            }
+            w.WriteHeader(tt.status)
+            fmt.Fprint(w, `{"status": "maintenance_mode"}`)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        err := client.Up()
+        if (err != nil) != tt.wantErr {
+            t.Errorf("status %d: expected error %v, got %v", tt.status, tt.wantErr, err)
+        }
+        if errors.Is(err, ErrMaintenance) != tt.maintenance {
+            t.Errorf("status %d: expected maintenance %v, got %v", tt.status, tt.maintenance, err)
+        }
+        mockServer.Close()
+    }
+}
+
+// TestSaveDocument checks that a saved document's new revision is returned,
+// its _rev is sent, and a stale one is reported as ErrRevisionChanged.
+func TestSaveDocument(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var doc map[string]interface{}
+        json.NewDecoder(r.Body).Decode(&doc)
+        if r.URL.Path != "/testdb/_local/audit-tip" {
+            t.Errorf("Expected a request for the local document, got %s", r.URL.Path)
+        }
+        if doc["_rev"] != nil && doc["_rev"] != "0-1" {
+            w.WriteHeader(http.StatusConflict)
+            fmt.Fprint(w, `{"error": "conflict"}`)
+            return
+        }
+        w.WriteHeader(http.StatusCreated)
+        fmt.Fprint(w, `{"ok": true, "id": "_local/audit-tip", "rev": "0-2"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    rev, err := client.SaveDocument(map[string]interface{}{"_id": "_local/audit-tip", "_rev": "0-1"})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if rev != "0-2" {
+        t.Errorf("Expected revision 0-2, got %s", rev)
+    }
+    if _, err := client.SaveDocument(map[string]interface{}{"_id": "_local/audit-tip", "_rev": "0-0"}); !errors.Is(err, ErrRevisionChanged) {
+        t.Errorf("Expected ErrRevisionChanged, got %v", err)
+    }
+}
+
+// TestCreateDatabase checks that an existing database is not an error and
+// that other failures carry CouchDB's error body.
+func TestCreateDatabase(t *testing.T) {
+    tests := []struct {
+        status  int
+        body    string
+        wantErr string
+    }{
+        {http.StatusCreated, `{"ok": true}`, ""},
+        {http.StatusAccepted, `{"ok": true}`, ""},
+        {http.StatusPreconditionFailed, `{"error": "file_exists"}`, ""},
+        {http.StatusUnauthorized, `{"error": "unauthorized"}`, "unauthorized"},
+        {http.StatusBadRequest, `{"error": "illegal_database_name"}`, "illegal_database_name"},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodPut || r.URL.Path != "/testdb" {
+                t.Errorf("Expected PUT /testdb, got %s %s", r.Method, r.URL.Path)
+            }
+            w.WriteHeader(tt.status)
+            fmt.Fprint(w, tt.body)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        err := client.CreateDatabase()
+        if tt.wantErr == "" && err != nil {
+            t.Errorf("status %d: expected no error, got %v", tt.status, err)
+        }
+        if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+            t.Errorf("status %d: expected an error containing %q, got %v", tt.status, tt.wantErr, err)
+        }
+        mockServer.Close()
+    }
+}
+
+// TestDeleteDatabase checks that a missing database is reported as
+// ErrNotFound and that other failures carry CouchDB's error body.
+func TestDeleteDatabase(t *testing.T) {
+    tests := []struct {
+        status   int
+        body     string
+        wantErr  string
+        notFound bool
+    }{
+        {http.StatusOK, `{"ok": true}`, "", false},
+        {http.StatusAccepted, `{"ok": true}`, "", false},
+        {http.StatusNotFound, `{"error": "not_found"}`, "not found", true},
+        {http.StatusBadRequest, `{"error": "bad_request", "reason": "You tried to DELETE a database with a ?rev= parameter."}`, "bad_request", false},
+        {http.StatusUnauthorized, `{"error": "unauthorized"}`, "unauthorized", false},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.Method != http.MethodDelete || r.URL.Path != "/testdb" {
+                t.Errorf("Expected DELETE /testdb, got %s %s", r.Method, r.URL.Path)
+            }
+            w.WriteHeader(tt.status)
+            fmt.Fprint(w, tt.body)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        err := client.DeleteDatabase()
+        if tt.wantErr == "" && err != nil {
+            t.Errorf("status %d: expected no error, got %v", tt.status, err)
+        }
+        if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+            t.Errorf("status %d: expected an error containing %q, got %v", tt.status, tt.wantErr, err)
+        }
+        if errors.Is(err, ErrNotFound) != tt.notFound {
+            t.Errorf("status %d: expected ErrNotFound %v, got %v", tt.status, tt.notFound, err)
+        }
+        mockServer.Close()
+    }
+}
+
+// TestGetAllConflicts pages through _all_docs two documents at a time and
+// checks only the conflicted documents are returned.
+func TestGetAllConflicts(t *testing.T) {
+    rows := []string{
+        `{"id": "doc1", "doc": {"_id": "doc1", "_rev": "2-a", "_conflicts": ["2-b"]}}`,
+        `{"id": "doc2", "doc": {"_id": "doc2", "_rev": "1-a"}}`,
+        `{"id": "doc3", "doc": {"_id": "doc3", "_rev": "4-a"}}`,
+        `{"id": "doc4", "doc": {"_id": "doc4", "_rev": "3-c", "_conflicts": ["3-a", "2-b"]}}`,
+        `{"id": "doc5", "doc": {"_id": "doc5", "_rev": "1-a"}}`,
+    }
+    requests := 0
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        requests++
+        query := r.URL.Query()
+        if query.Get("conflicts") != "true" || query.Get("include_docs") != "true" {
+            t.Errorf("Expected conflicts and include_docs, got %s", r.URL.RawQuery)
+        }
+        limit, _ := strconv.Atoi(query.Get("limit"))
+        start := 0
+        if startKey := query.Get("startkey"); startKey != "" {
+            for i := range rows {
+                if fmt.Sprintf(`"doc%d"`, i+1) == startKey {
+                    start = i + 1
+                }
+            }
+        }
+        end := start + limit
+        if end > len(rows) {
+            end = len(rows)
+        }
+        fmt.Fprintf(w, `{"rows": [%s]}`, strings.Join(rows[start:end], ","))
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    conflicts, err := client.GetAllConflicts(2)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if len(conflicts) != 2 || conflicts[0].ID != "doc1" || conflicts[1].ID != "doc4" || len(conflicts[1].Conflicts) != 2 {
+        t.Errorf("Expected the conflicts of doc1 and doc4, got %+v", conflicts)
+    }
+    if requests != 3 {
+        t.Errorf("Expected 3 pages, got %d", requests)
+    }
+    if _, err := client.GetAllConflicts(0); err == nil {
+        t.Errorf("Expected a page size of 0 to be rejected")
+    }
+}
+
+// TestResolveConflicts checks that the losing revisions of documents with
+// live conflicts are deleted and the winning ones kept.
+func TestResolveConflicts(t *testing.T) {
+    var mu sync.Mutex
+    var deleted []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodDelete {
+            mu.Lock()
+            deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/testdb/")+"@"+r.URL.Query().Get("rev"))
+            mu.Unlock()
+            fmt.Fprint(w, `{"ok": true}`)
+            return
+        }
+        fmt.Fprint(w, `{"rows": [
+            {"id": "doc1", "doc": {"_id": "doc1", "_rev": "2-a", "_conflicts": ["2-b"]}},
+            {"id": "doc2", "doc": {"_id": "doc2", "_rev": "1-a", "_deleted_conflicts": ["1-b"]}},
+            {"id": "doc3", "doc": {"_id": "doc3", "_rev": "3-c", "_conflicts": ["3-a", "2-b"]}}
+        ]}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Output: io.Discard})
+    result, err := client.ResolveConflicts(10, HandleOptions{})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    sort.Strings(deleted)
+    if result.DocsHandled != 2 || result.ConflictsDeleted != 3 || fmt.Sprint(deleted) != "[doc1@2-b doc3@2-b doc3@3-a]" {
+        t.Errorf("Expected the losing revisions of doc1 and doc3 to be deleted, got %+v and %v", result, deleted)
+    }
+}
+
+// TestVerifyingIsCouchDBRunningReusesConnections checks that the HTTP checks
+// of a verifying IsCouchDBRunningFunc share connections rather than opening a
+// new one per request.
+func TestVerifyingIsCouchDBRunningReusesConnections(t *testing.T) {
+    mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/_up" {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        // Answer the version check as a node in maintenance would, so the
+        // check goes on to ask /_up.
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    var connections int32
+    mockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+        if state == http.StateNew {
+            atomic.AddInt32(&connections, 1)
+        }
+    }
+    mockServer.Start()
+    defer mockServer.Close()
+
+    host, port, _ := net.SplitHostPort(mockServer.Listener.Addr().String())
+    open := func(ip, port string) bool { return true }
+    check := NewVerifyingIsCouchDBRunning(open, "http", "", ClientOptions{})
+    for i := 0; i < 3; i++ {
+        if !check(host, port) {
+            t.Fatalf("Expected a node in maintenance to be kept")
+        }
+    }
+    if n := atomic.LoadInt32(&connections); n != 1 {
+        t.Errorf("Expected 1 connection for 6 requests, got %d", n)
+    }
+}
+
+// TestPurgeDisabled checks that a node refusing _purge is reported with
+// TestPurgeDisabled checks that only a node without _purge support is
+// reported as ErrPurgeDisabled, and that a refusal for lack of permissions is
+// reported as ErrUnauthorized alone.
+func TestPurgeDisabled(t *testing.T) {
+    tests := []struct {
+        status       int
+        body         string
+        disabled     bool
+        unauthorized bool
+    }{
+        {http.StatusNotImplemented, `{"error": "not_implemented", "reason": "this feature is not yet implemented"}`, true, false},
+        {http.StatusInternalServerError, `{"error": "not_implemented", "reason": "this feature is not yet implemented"}`, true, false},
+        {http.StatusForbidden, `{"error": "forbidden", "reason": "You are not a db or server admin."}`, false, true},
+        {http.StatusUnauthorized, `{"error": "unauthorized", "reason": "You are not authorized to access this db."}`, false, true},
+        {http.StatusInternalServerError, `{"error": "unknown_error"}`, false, false},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(tt.status)
+            fmt.Fprint(w, tt.body)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        _, err := client.PurgeDocuments(map[string][]string{"doc1": {"2-a"}})
+        if err == nil {
+            t.Errorf("status %d: expected an error", tt.status)
+        }
+        if errors.Is(err, ErrPurgeDisabled) != tt.disabled {
+            t.Errorf("status %d: expected ErrPurgeDisabled %v, got %v", tt.status, tt.disabled, err)
+        }
+        if errors.Is(err, ErrUnauthorized) != tt.unauthorized {
+            t.Errorf("status %d: expected ErrUnauthorized %v, got %v", tt.status, tt.unauthorized, err)
+        }
+        mockServer.Close()
+    }
+}
+
+// TestResetDocumentRemove checks that the ResetRemove strategy deletes and
+// purges the document without recreating it.
+func TestResetDocumentRemove(t *testing.T) {
+    var purged map[string][]string
+    created := false
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        switch {
+        case r.URL.Path == "/testdb/_purge":
+            json.NewDecoder(r.Body).Decode(&purged)
+            json.NewEncoder(w).Encode(map[string]interface{}{"purged": purged})
+        case r.Method == http.MethodPut:
+            created = true
+            w.WriteHeader(http.StatusCreated)
+            fmt.Fprint(w, `{"ok": true}`)
+        case r.Method == http.MethodDelete:
+            fmt.Fprint(w, `{"ok": true}`)
+        case query.Get("open_revs") == "all":
+            fmt.Fprint(w, `[{"ok": {"_id": "doc1", "_rev": "3-x", "_deleted": true}}]`)
+        case query.Get("revs_info") == "true":
+            fmt.Fprint(w, `{"_id": "doc1", "_rev": "2-b", "_revs_info": [{"rev": "2-b", "status": "available"}, {"rev": "1-a", "status": "available"}]}`)
+        case purged != nil:
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error": "not_found", "reason": "missing"}`)
+        default:
+            fmt.Fprint(w, `{"_id": "doc1", "_rev": "2-b", "value": 1}`)
+        }
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{ResetStrategy: ResetRemove, VerifyResets: true})
+    result, err := client.ResetDocument("doc1", logger.NewWriterLogger(io.Discard), nil)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if created || result.Recreated {
+        t.Errorf("Expected the document not to be recreated")
+    }
+    if !result.Removed || !result.Verified || result.RevisionsDeleted != 2 {
+        t.Errorf("Expected 2 revisions deleted and a verified removal, got %+v", result)
+    }
+    if fmt.Sprint(purged) != "map[doc1:[3-x]]" {
+        t.Errorf("Expected the tombstone of doc1 to be purged, got %v", purged)
+    }
+}
+
+// TestDetectAuthMode checks that /_session is asked without credentials, even
+// when the client has some, and how its answer is read.
+func TestDetectAuthMode(t *testing.T) {
+    tests := []struct {
+        status   int
+        session  string
+        expected AuthMode
+    }{
+        {http.StatusOK, `{"ok": true, "userCtx": {"name": null, "roles": ["_admin"]}}`, AuthAdminParty},
+        {http.StatusOK, `{"ok": true, "userCtx": {"name": null, "roles": []}}`, AuthRequired},
+        {http.StatusUnauthorized, `{"error": "unauthorized"}`, AuthRequired},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if _, _, ok := r.BasicAuth(); ok {
+                t.Errorf("Expected the probe to be sent without credentials")
+            }
+            w.WriteHeader(tt.status)
+            fmt.Fprint(w, tt.session)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{Username: "admin", Password: "secret"})
+        mode, err := client.DetectAuthMode()
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        if mode != tt.expected {
+            t.Errorf("session %s: expected %s, got %s", tt.session, tt.expected, mode)
+        }
+        mockServer.Close()
+    }
+}
+
+// TestListDesignDocs checks that the design documents are listed by name
+// without their _design/ prefix.
+func TestListDesignDocs(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/testdb/_design_docs" {
+            w.WriteHeader(http.StatusNotFound)
+            fmt.Fprint(w, `{"error": "not_found", "reason": "Database does not exist."}`)
+            return
+        }
+        fmt.Fprint(w, `{"total_rows": 2, "offset": 0, "rows": [
+            {"id": "_design/reports", "key": "_design/reports", "value": {"rev": "1-a"}},
+            {"id": "_design/rev_filter", "key": "_design/rev_filter", "value": {"rev": "3-b"}}
+        ]}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+    names, err := client.ListDesignDocs()
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fmt.Sprint(names) != "[reports rev_filter]" {
+        t.Errorf("Expected [reports rev_filter], got %v", names)
+    }
+
+    client = NewCouchDBClient(mockServer.URL, "missing", ClientOptions{})
+    if _, err := client.ListDesignDocs(); !errors.Is(err, ErrNotFound) {
+        t.Errorf("Expected ErrNotFound, got %v", err)
+    }
+}
+
+// TestCompactAll checks that compaction is triggered on every user database,
+// and on system databases only when asked, carrying on past failures.
+func TestCompactAll(t *testing.T) {
+    var mu sync.Mutex
+    var compacted []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/_all_dbs" {
+            fmt.Fprint(w, `["_replicator", "_users", "db1", "db2", "db3", "broken"]`)
+            return
+        }
+        if r.Method == "GET" {
+            // Only db3 is fragmented enough to need compaction
+            sizes := `{"file": 100, "active": 90}`
+            if r.URL.Path == "/db3" {
+                sizes = `{"file": 100, "active": 10}`
+            }
+            fmt.Fprintf(w, `{"db_name": "%s", "update_seq": "1-abc", "sizes": %s}`, strings.TrimPrefix(r.URL.Path, "/"), sizes)
+            return
+        }
+        name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/_compact")
+        if name == "broken" {
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Fprint(w, `{"error": "unknown_error"}`)
+            return
+        }
+        mu.Lock()
+        compacted = append(compacted, name)
+        mu.Unlock()
+        w.WriteHeader(http.StatusAccepted)
+        fmt.Fprint(w, `{"ok": true}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "db1", ClientOptions{})
+    log := logger.NewWriterLogger(io.Discard)
+
+    // db1 is the client's own database and is left out
+    count, err := client.CompactAll(CompactAllOptions{Concurrency: 2}, log)
+    if err == nil || !strings.Contains(err.Error(), "broken") {
+        t.Errorf("Expected the failure on broken to be returned, got %v", err)
+    }
+    sort.Strings(compacted)
+    if count != 2 || fmt.Sprint(compacted) != "[db2 db3]" {
+        t.Errorf("Expected db2 and db3 to be compacted, got %d: %v", count, compacted)
+    }
+
+    compacted = nil
+    count, _ = client.CompactAll(CompactAllOptions{IncludeSystem: true}, log)
+    if count != 4 {
+        t.Errorf("Expected 4 databases including system ones, got %d: %v", count, compacted)
+    }
+
+    compacted = nil
+    allow := func(name string) bool { return name != "db2" }
+    count, err = client.CompactAll(CompactAllOptions{Allow: allow}, log)
+    if err == nil || count != 1 || fmt.Sprint(compacted) != "[db3]" {
+        t.Errorf("Expected only db3 to be allowed and compacted, got %d: %v (%v)", count, compacted, err)
+    }
+
+    compacted = nil
+    count, err = client.CompactAll(CompactAllOptions{Threshold: 0.5, QuiesceWindow: time.Millisecond}, log)
+    if err != nil || count != 1 || fmt.Sprint(compacted) != "[db3]" {
+        t.Errorf("Expected only db3 to reach the threshold, got %d: %v (%v)", count, compacted, err)
+    }
+
+    var delays []time.Duration
+    sleep := func(d time.Duration) {
+        mu.Lock()
+        defer mu.Unlock()
+        delays = append(delays, d)
+    }
+    client.CompactAll(CompactAllOptions{Concurrency: 2, Jitter: 20 * time.Millisecond, sleep: sleep}, log)
+    for _, delay := range delays {
+        if delay < 0 || delay >= 20*time.Millisecond {
+            t.Errorf("Expected a delay within [0, 20ms), got %s", delay)
+        }
+    }
+    delays = nil
+    client.CompactAll(CompactAllOptions{Jitter: -time.Second, sleep: sleep}, log)
+    if len(delays) != 0 {
+        t.Errorf("Expected no wait for a negative jitter, got %v", delays)
+    }
+}
+
+// TestCorrelationIDHeader checks that the correlation ID is sent with every
+// request.
+func TestCorrelationIDHeader(t *testing.T) {
+    var got string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r.Header.Get("X-Correlation-Id")
+        fmt.Fprint(w, `{"state": "cluster_finished"}`)
+    }))
+    defer mockServer.Close()
+
+    client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{CorrelationID: "3f9a2c1e"})
+    if _, err := client.ClusterSetupState(); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if got != "3f9a2c1e" {
+        t.Errorf("Expected X-Correlation-Id 3f9a2c1e, got %q", got)
+    }
+}
+
+// TestNewIsCouchDBRunningWithRetry verifies that a listening port is reported
+// as running and that a refused connection fails without waiting on a retry.
+func TestNewIsCouchDBRunningWithRetry(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Failed to listen: %v", err)
+    }
+    defer listener.Close()
+    _, openPort, _ := net.SplitHostPort(listener.Addr().String())
+
+    closed, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Failed to listen: %v", err)
+    }
+    _, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+    closed.Close()
+
+    tests := []struct {
+        name     string
+        port     string
+        retries  int
+        expected bool
+    }{
+        {"listening", openPort, 0, true},
+        {"listening with retries", openPort, 2, true},
+        {"refused", closedPort, 0, false},
+        {"refused with retries", closedPort, 3, false},
+    }
+
+    for _, tt := range tests {
+        check := NewIsCouchDBRunningWithRetry(tt.retries, time.Second)
+        start := time.Now()
+        if running := check("127.0.0.1", tt.port); running != tt.expected {
+            t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, running)
+        }
+        if elapsed := time.Since(start); elapsed >= time.Second {
+            t.Errorf("%s: expected no backoff wait, took %v", tt.name, elapsed)
+        }
+    }
+}
+
+// TestBuildBaseURL verifies the default scheme, IPv6 hosts and trailing
+// slashes on the path prefix.
+func TestBuildBaseURL(t *testing.T) {
+    tests := []struct {
+        scheme     string
+        host       string
+        port       string
+        pathPrefix string
+        expected   string
+    }{
+        {"", "10.0.0.1", "5984", "", "http://10.0.0.1:5984"},
+        {"https", "couch.example.com", "6984", "", "https://couch.example.com:6984"},
+        {"https", "10.0.0.1", "443", "/couchdb", "https://10.0.0.1:443/couchdb"},
+        {"http", "10.0.0.1", "80", "/couchdb/", "http://10.0.0.1:80/couchdb"},
+        {"", "::1", "5984", "", "http://[::1]:5984"},
+    }
+
+    for _, tt := range tests {
+        if url := BuildBaseURL(tt.scheme, tt.host, tt.port, tt.pathPrefix); url != tt.expected {
+            t.Errorf("Expected %s, got %s", tt.expected, url)
+        }
+    }
+}
+
+// TestRequireFields verifies that every listed field must be present, while a
+// null value still counts as present.
+func TestRequireFields(t *testing.T) {
+    tests := []struct {
+        name    string
+        fields  []string
+        doc     map[string]interface{}
+        wantErr bool
+    }{
+        {"no fields", nil, map[string]interface{}{}, false},
+        {"all present", []string{"type", "owner"}, map[string]interface{}{"type": "order", "owner": "alice"}, false},
+        {"null value", []string{"owner"}, map[string]interface{}{"owner": nil}, false},
+        {"one missing", []string{"type", "owner"}, map[string]interface{}{"type": "order"}, true},
+        {"empty document", []string{"type"}, map[string]interface{}{}, true},
+    }
+
+    for _, tt := range tests {
+        err := RequireFields(tt.fields...)(tt.doc)
+        if tt.wantErr && err == nil {
+            t.Errorf("%s: expected an error", tt.name)
+        }
+        if !tt.wantErr && err != nil {
+            t.Errorf("%s: expected no error, got %v", tt.name, err)
+        }
+    }
+}
+
+// TestWithWriteQuorum verifies that the w parameter is only added when a write
+// quorum is set and is joined to any existing query string.
+func TestWithWriteQuorum(t *testing.T) {
+    tests := []struct {
+        quorum   int
+        url      string
+        expected string
+    }{
+        {0, "http://couch/db/doc1", "http://couch/db/doc1"},
+        {-1, "http://couch/db/doc1", "http://couch/db/doc1"},
+        {2, "http://couch/db/doc1", "http://couch/db/doc1?w=2"},
+        {3, "http://couch/db/doc1?rev=1-a", "http://couch/db/doc1?rev=1-a&w=3"},
+    }
+
+    for _, tt := range tests {
+        client := &CouchDBClient{WriteQuorum: tt.quorum}
+        if url := client.withWriteQuorum(tt.url); url != tt.expected {
+            t.Errorf("Expected %s, got %s", tt.expected, url)
+        }
+    }
+}
+
+// TestNeedsCompaction verifies the fragmentation ratio from both the 2.x sizes
+// object and the 1.x disk_size and data_size fields, and the threshold check.
+func TestNeedsCompaction(t *testing.T) {
+    tests := []struct {
+        name      string
+        info      string
+        threshold float64
+        ratio     float64
+        needed    bool
+    }{
+        {"fragmented", `{"sizes":{"file":1000,"active":250}}`, 0.5, 0.75, true},
+        {"at threshold", `{"sizes":{"file":1000,"active":500}}`, 0.5, 0.5, true},
+        {"compact", `{"sizes":{"file":1000,"active":900}}`, 0.5, 0.1, false},
+        {"couchdb 1.x", `{"disk_size":400,"data_size":100}`, 0.5, 0.75, true},
+        {"empty file", `{"sizes":{"file":0,"active":0}}`, 0.5, 0, false},
+        {"active larger than file", `{"sizes":{"file":100,"active":150}}`, 0.5, 0, false},
+    }
+
+    for _, tt := range tests {
+        mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(http.StatusOK)
+            fmt.Fprint(w, tt.info)
+        }))
+
+        client := NewCouchDBClient(mockServer.URL, "testdb", ClientOptions{})
+        needed, ratio, err := client.NeedsCompaction(tt.threshold)
+        mockServer.Close()
+        if err != nil {
+            t.Fatalf("%s: expected no error, got %v", tt.name, err)
+        }
+        if needed != tt.needed {
+            t.Errorf("%s: expected needed %v, got %v", tt.name, tt.needed, needed)
+        }
+        if ratio < tt.ratio-1e-9 || ratio > tt.ratio+1e-9 {
+            t.Errorf("%s: expected ratio %g, got %g", tt.name, tt.ratio, ratio)
+        }
+    }
+}
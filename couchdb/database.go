@@ -0,0 +1,271 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+// DatabaseInfo represents the structure of a CouchDB database information response.
+type DatabaseInfo struct {
+    DBName      string `json:"db_name"`
+    DocCount    int    `json:"doc_count"`
+    DocDelCount int    `json:"doc_del_count"`
+    UpdateSeq   Seq    `json:"update_seq"`
+    Sizes       struct {
+        File     int64 `json:"file"`
+        Active   int64 `json:"active"`
+        External int64 `json:"external"`
+    } `json:"sizes"`
+
+    // DiskSize and DataSize are reported by CouchDB 1.x instead of Sizes.
+    DiskSize int64 `json:"disk_size"`
+    DataSize int64 `json:"data_size"`
+}
+
+// FileSize returns the size of the database file on disk.
+func (i *DatabaseInfo) FileSize() int64 {
+    if i.Sizes.File > 0 {
+        return i.Sizes.File
+    }
+    return i.DiskSize
+}
+
+// LiveDataSize returns the size of the live data in the database file.
+func (i *DatabaseInfo) LiveDataSize() int64 {
+    if i.Sizes.Active > 0 {
+        return i.Sizes.Active
+    }
+    return i.DataSize
+}
+
+// Fragmentation returns the fraction of the database file that is not live
+// data and would be reclaimed by compaction, between 0 and 1.
+func (i *DatabaseInfo) Fragmentation() float64 {
+    file := i.FileSize()
+    if file <= 0 {
+        return 0
+    }
+    ratio := float64(file-i.LiveDataSize()) / float64(file)
+    if ratio < 0 {
+        return 0
+    }
+    return ratio
+}
+
+// GetDatabaseInfo fetches information about the database.
+func (c *CouchDBClient) GetDatabaseInfo() (*DatabaseInfo, error) {
+    url := c.dbURL()
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch database info: %s", string(body))
+    }
+
+    var info DatabaseInfo
+    if err := json.Unmarshal(body, &info); err != nil {
+        return nil, err
+    }
+
+    return &info, nil
+}
+
+// NeedsCompaction reports whether the database's fragmentation ratio is at
+// least threshold, along with the ratio itself.
+func (c *CouchDBClient) NeedsCompaction(threshold float64) (bool, float64, error) {
+    info, err := c.GetDatabaseInfo()
+    if err != nil {
+        return false, 0, err
+    }
+    ratio := info.Fragmentation()
+    return ratio >= threshold, ratio, nil
+}
+
+// SetRevsLimit sets the database's _revs_limit, the number of revisions
+// CouchDB keeps for each document.
+func (c *CouchDBClient) SetRevsLimit(limit int) error {
+    url := c.dbURL() + "/_revs_limit"
+    req, err := http.NewRequest("PUT", url, strings.NewReader(strconv.Itoa(limit)))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("failed to set revs limit: %s", string(body))
+    }
+    return nil
+}
+
+// NeedsFullCommit reports whether a server of the given version buffers
+// writes that _ensure_full_commit would flush. From 3.0 every write is
+// committed to disk before it is acknowledged and the endpoint is a no-op.
+func NeedsFullCommit(version string) bool {
+    var major int
+    if _, err := fmt.Sscanf(version, "%d.", &major); err != nil {
+        return false
+    }
+    return major < 3
+}
+
+// EnsureFullCommit asks the server to flush the database's recent writes to
+// disk with _ensure_full_commit.
+func (c *CouchDBClient) EnsureFullCommit() error {
+    url := c.dbURL() + "/_ensure_full_commit"
+    resp, err := c.HTTPClient.Post(url, "application/json", nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusCreated {
+        return fmt.Errorf("failed to ensure full commit: %s", string(body))
+    }
+    return nil
+}
+
+// CreateDatabase creates the database. A database that already exists is not
+// an error.
+func (c *CouchDBClient) CreateDatabase() error {
+    url := c.dbURL()
+    req, err := http.NewRequest("PUT", url, nil)
+    if err != nil {
+        return err
+    }
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    switch resp.StatusCode {
+    case http.StatusCreated, http.StatusAccepted, http.StatusPreconditionFailed:
+        return nil
+    }
+    return fmt.Errorf("failed to create database: %s", string(body))
+}
+
+// DeleteDatabase deletes the database and every document in it. It is not
+// part of the purge pipeline and is only meant for tearing down test
+// environments.
+func (c *CouchDBClient) DeleteDatabase() error {
+    url := c.dbURL()
+    req, err := http.NewRequest("DELETE", url, nil)
+    if err != nil {
+        return err
+    }
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    switch resp.StatusCode {
+    case http.StatusOK, http.StatusAccepted:
+        return nil
+    case http.StatusNotFound:
+        return fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    return fmt.Errorf("failed to delete database: %s", string(body))
+}
+
+// listDatabasesPageSize is the number of database names ListDatabases asks
+// for in each request.
+const listDatabasesPageSize = 1000
+
+// ListDatabases returns the names of every database on the server. It reads
+// /_all_dbs a page at a time, so a server with thousands of databases never
+// sends the whole list in one response.
+func (c *CouchDBClient) ListDatabases() ([]string, error) {
+    return c.listDatabases(listDatabasesPageSize)
+}
+
+// listDatabases implements ListDatabases with pages of pageSize names.
+func (c *CouchDBClient) listDatabases(pageSize int) ([]string, error) {
+    var names []string
+    startKey := ""
+    for {
+        query := neturl.Values{"limit": {strconv.Itoa(pageSize)}}
+        if startKey != "" {
+            key, err := json.Marshal(startKey)
+            if err != nil {
+                return nil, err
+            }
+            query.Set("startkey", string(key))
+            query.Set("skip", "1")
+        }
+        resp, err := c.HTTPClient.Get(withQuery(c.BaseURL+"/_all_dbs", query))
+        if err != nil {
+            return nil, err
+        }
+        body, err := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+
+        if resp.StatusCode != http.StatusOK {
+            return nil, fmt.Errorf("failed to list databases: %s", string(body))
+        }
+
+        var page []string
+        if err := json.Unmarshal(body, &page); err != nil {
+            return nil, err
+        }
+        names = append(names, page...)
+        if len(page) < pageSize {
+            return names, nil
+        }
+        startKey = page[len(page)-1]
+    }
+}
@@ -0,0 +1,217 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// designCache remembers the design documents a client has read, with their
+// ETags, so reading one again only transfers it if it has changed.
+type designCache struct {
+    mu   sync.Mutex
+    docs map[string]cachedDesign
+}
+
+// cachedDesign is a design document as last read, and its ETag.
+type cachedDesign struct {
+    etag string
+    doc  map[string]interface{}
+}
+
+func (d *designCache) get(url string) (cachedDesign, bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    cached, ok := d.docs[url]
+    return cached, ok
+}
+
+func (d *designCache) put(url string, cached cachedDesign) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.docs == nil {
+        d.docs = make(map[string]cachedDesign)
+    }
+    d.docs[url] = cached
+}
+
+func (d *designCache) forget(url string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    delete(d.docs, url)
+}
+
+// GetDesignDocument fetches the design document designDocName, given with or
+// without the _design/ prefix. A missing design document is reported as
+// ErrNotFound. If the client has read it before, the request carries its
+// ETag in If-None-Match and a 304 Not Modified answer returns the copy read
+// then, so an unchanged design document is not transferred again.
+func (c *CouchDBClient) GetDesignDocument(designDocName string) (map[string]interface{}, error) {
+    url := c.designDocURL(designDocName)
+    req, err := http.NewRequest(http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+    cached, isCached := c.designs.get(url)
+    if isCached {
+        req.Header.Set("If-None-Match", cached.etag)
+    }
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotModified && isCached {
+        return cached.doc, nil
+    }
+    if resp.StatusCode == http.StatusNotFound {
+        c.designs.forget(url)
+        return nil, fmt.Errorf("design document %s: %w", designDocName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch design document: %s", string(body))
+    }
+
+    var doc map[string]interface{}
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return nil, err
+    }
+    if etag := resp.Header.Get("ETag"); etag != "" {
+        c.designs.put(url, cachedDesign{etag: etag, doc: doc})
+    }
+    return doc, nil
+}
+
+// DesignDocumentETag returns the ETag of the design document designDocName
+// as the client last read or created it, or "" if it has none, so that it can
+// be kept across runs and handed back with RememberDesignDocument.
+func (c *CouchDBClient) DesignDocumentETag(designDocName string) string {
+    cached, _ := c.designs.get(c.designDocURL(designDocName))
+    return cached.etag
+}
+
+// RememberDesignDocument tells the client that designDoc is the design
+// document designDocName as it was when it had ETag etag, typically one
+// recorded by an earlier run. GetDesignDocument then sends that ETag and, if
+// CouchDB answers 304 Not Modified, returns designDoc without transferring it.
+func (c *CouchDBClient) RememberDesignDocument(designDocName, etag string, designDoc map[string]interface{}) {
+    doc := make(map[string]interface{}, len(designDoc)+1)
+    for key, value := range designDoc {
+        doc[key] = value
+    }
+    if rev, err := strconv.Unquote(etag); err == nil {
+        doc["_rev"] = rev
+    }
+    c.designs.put(c.designDocURL(designDocName), cachedDesign{etag: etag, doc: doc})
+}
+
+// DiffDesignDocuments compares the views of an existing design document with
+// proposed ones and describes each view added or removed and each map or
+// reduce function changed, in view name order. A nil existing document is
+// treated as having no views. No differences yields an empty result.
+func DiffDesignDocuments(existing, proposed map[string]interface{}) []string {
+    oldViews := designViews(existing)
+    newViews := designViews(proposed)
+
+    names := make(map[string]bool)
+    for name := range oldViews {
+        names[name] = true
+    }
+    for name := range newViews {
+        names[name] = true
+    }
+    sorted := make([]string, 0, len(names))
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+
+    var diff []string
+    for _, name := range sorted {
+        oldView, inOld := oldViews[name]
+        newView, inNew := newViews[name]
+        switch {
+        case !inOld:
+            diff = append(diff, fmt.Sprintf("view %s added", name))
+        case !inNew:
+            diff = append(diff, fmt.Sprintf("view %s removed", name))
+        default:
+            for _, field := range []string{"map", "reduce"} {
+                before, after := viewFunction(oldView, field), viewFunction(newView, field)
+                if before != after {
+                    diff = append(diff, fmt.Sprintf("view %s: %s changed from %q to %q", name, field, before, after))
+                }
+            }
+        }
+    }
+    return diff
+}
+
+// designViews returns the views of a design document, keyed by name.
+func designViews(designDoc map[string]interface{}) map[string]interface{} {
+    views, _ := designDoc["views"].(map[string]interface{})
+    return views
+}
+
+// viewFunction returns the source of the map or reduce function of a view,
+// or "" if the view has none.
+func viewFunction(view interface{}, field string) string {
+    definition, _ := view.(map[string]interface{})
+    source, _ := definition[field].(string)
+    return source
+}
+
+// BuildIndex brings the index of designDocName up to date without reading
+// any rows. CouchDB updates a design document's index, for all of its views,
+// before answering a query of one of them, so this returns once the index
+// has caught up or the request times out; in the latter case the build
+// carries on in the background on the server.
+func (c *CouchDBClient) BuildIndex(designDocName, viewName string) error {
+    _, _, err := c.QueryDesignDocumentPage(designDocName, viewName, 0, "")
+    return err
+}
+
+// ListDesignDocs returns the names of the design documents in the database,
+// without their _design/ prefix, read from _design_docs.
+func (c *CouchDBClient) ListDesignDocs() ([]string, error) {
+    resp, err := c.HTTPClient.Get(c.dbURL() + "/_design_docs")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to list design documents: %s", string(body))
+    }
+
+    var response AllDocsResponse
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, err
+    }
+
+    names := make([]string, 0, len(response.Rows))
+    for _, row := range response.Rows {
+        names = append(names, strings.TrimPrefix(row.ID, "_design/"))
+    }
+    return names, nil
+}
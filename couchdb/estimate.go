@@ -0,0 +1,39 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// SizeEstimate is a rough estimate of the space removing a document's conflict
+// leaves would free. It is the size of the leaf bodies as CouchDB returns them,
+// which is good enough to rank documents against each other but not an exact
+// byte count on disk.
+type SizeEstimate struct {
+    DocID            string `json:"docID"`
+    Leaves           int    `json:"leaves"`
+    ReclaimableBytes int64  `json:"reclaimableBytes"`
+}
+
+// EstimateReclaimableBytes estimates how many bytes removing the conflict
+// leaves revs of a document would free, from the size of each leaf's body. A
+// leaf whose body is no longer available counts as zero bytes.
+func (c *CouchDBClient) EstimateReclaimableBytes(docID string, revs []string) (*SizeEstimate, error) {
+    estimate := &SizeEstimate{DocID: docID, Leaves: len(revs)}
+    for _, rev := range revs {
+        leaf, err := c.GetDocumentRevision(docID, rev)
+        if errors.Is(err, ErrRevisionUnavailable) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        content, err := json.Marshal(leaf)
+        if err != nil {
+            return nil, err
+        }
+        estimate.ReclaimableBytes += int64(len(content))
+    }
+
+    return estimate, nil
+}
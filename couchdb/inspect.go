@@ -0,0 +1,82 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+)
+
+// RevisionTree summarises the revision history of a single document.
+type RevisionTree struct {
+    DocID            string   `json:"docID"`
+    CurrentRev       string   `json:"currentRev"`
+    RevisionCount    int      `json:"revisionCount"`
+    MinGeneration    int      `json:"minGeneration"`
+    MaxGeneration    int      `json:"maxGeneration"`
+    Conflicts        []string `json:"conflicts"`
+    DeletedConflicts []string `json:"deletedConflicts"`
+    SizeBytes        int      `json:"sizeBytes"`
+}
+
+// InspectDocument gathers the revision tree of a document: its available
+// revisions from _revs_info, its live and deleted conflicts, and the size of
+// its current body. It only reads from the database.
+func (c *CouchDBClient) InspectDocument(docID string) (*RevisionTree, error) {
+    revisions, err := c.GetAllRevisions(docID)
+    if err != nil {
+        return nil, err
+    }
+
+    url := withQuery(c.documentURL(docID), neturl.Values{"conflicts": {"true"}, "deleted_conflicts": {"true"}})
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("document %s: %w", docID, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch document: %s", string(body))
+    }
+
+    var doc struct {
+        Rev              string   `json:"_rev"`
+        Conflicts        []string `json:"_conflicts"`
+        DeletedConflicts []string `json:"_deleted_conflicts"`
+    }
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return nil, err
+    }
+
+    tree := &RevisionTree{
+        DocID:            docID,
+        CurrentRev:       doc.Rev,
+        RevisionCount:    len(revisions),
+        Conflicts:        doc.Conflicts,
+        DeletedConflicts: doc.DeletedConflicts,
+        SizeBytes:        len(body),
+    }
+    for i, rev := range revisions {
+        gen, err := RevGeneration(rev)
+        if err != nil {
+            return nil, err
+        }
+        if i == 0 || gen < tree.MinGeneration {
+            tree.MinGeneration = gen
+        }
+        if gen > tree.MaxGeneration {
+            tree.MaxGeneration = gen
+        }
+    }
+
+    return tree, nil
+}
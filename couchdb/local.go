@@ -0,0 +1,56 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// localPrefix is the ID prefix of local documents, which are never
+// replicated and are used, among other things, for replication checkpoints.
+const localPrefix = "_local/"
+
+// IsLocalDocument reports whether docID names a local document.
+func IsLocalDocument(docID string) bool {
+    return strings.HasPrefix(docID, localPrefix)
+}
+
+// ListLocalDocuments returns the IDs of the database's local documents, each
+// including the _local/ prefix. It requires CouchDB 2.2 or later.
+func (c *CouchDBClient) ListLocalDocuments() ([]string, error) {
+    url := c.dbURL() + "/_local_docs"
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("database %s: %w", c.DBName, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to list local documents: %s", string(body))
+    }
+
+    var response struct {
+        Rows []struct {
+            ID string `json:"id"`
+        } `json:"rows"`
+    }
+    if err := json.Unmarshal(body, &response); err != nil {
+        return nil, err
+    }
+
+    ids := make([]string, 0, len(response.Rows))
+    for _, row := range response.Rows {
+        ids = append(ids, row.ID)
+    }
+    return ids, nil
+}
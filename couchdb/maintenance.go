@@ -0,0 +1,36 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ErrMaintenance is returned when a node reports it is in maintenance mode,
+// in which it refuses to serve data until an operator takes it out again.
+var ErrMaintenance = errors.New("node is in maintenance mode")
+
+// Up checks the node's /_up endpoint. A node in maintenance mode answers 404
+// Not Found, or 503 Service Unavailable while it is being brought up or
+// down; both are returned as ErrMaintenance.
+func (c *CouchDBClient) Up() error {
+    resp, err := c.HTTPClient.Get(c.BaseURL + "/_up")
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return nil
+    case http.StatusNotFound, http.StatusServiceUnavailable:
+        return fmt.Errorf("/_up answered %s: %w", resp.Status, ErrMaintenance)
+    }
+    return fmt.Errorf("failed to check node status: %s", string(body))
+}
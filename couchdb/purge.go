@@ -0,0 +1,127 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// PurgeResponse represents the structure of a CouchDB _purge response.
+type PurgeResponse struct {
+    Purged map[string][]string `json:"purged"`
+}
+
+// ErrPurgeDisabled is returned when a node does not support _purge,
+// answering 501 Not Implemented or a "not_implemented" error, as CouchDB 2.0
+// to 2.2 do. A 401 or 403 answer is a permissions problem and is returned as
+// ErrUnauthorized instead.
+var ErrPurgeDisabled = errors.New("_purge is disabled")
+
+// PurgeDocuments permanently removes the given revisions, keyed by document
+// ID, from the database using the _purge endpoint.
+func (c *CouchDBClient) PurgeDocuments(revs map[string][]string) (*PurgeResponse, error) {
+    url := c.dbURL() + "/_purge"
+
+    jsonBody, err := json.Marshal(revs)
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        var couchErr struct {
+            Error string `json:"error"`
+        }
+        json.Unmarshal(body, &couchErr)
+        switch {
+        case resp.StatusCode == http.StatusNotImplemented || couchErr.Error == "not_implemented":
+            return nil, fmt.Errorf("failed to purge documents: %s: %w", resp.Status, ErrPurgeDisabled)
+        case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+            return nil, fmt.Errorf("failed to purge documents: %s: %w", resp.Status, ErrUnauthorized)
+        }
+        return nil, fmt.Errorf("failed to purge documents: %s", string(body))
+    }
+
+    var purgeResp PurgeResponse
+    if err := json.Unmarshal(body, &purgeResp); err != nil {
+        return nil, err
+    }
+
+    return &purgeResp, nil
+}
+
+// BuildPurgeMap turns the rows of a view query into the {docID: [revs]} map
+// PurgeDocuments takes. The revisions to purge for each document are those
+// returned by revsFn, typically a client's GetAllRevisions or a function
+// selecting only some of them; documents for which it returns none are left
+// out. A document appearing in several rows is only looked up once.
+func BuildPurgeMap(resp *QueryResponse, revsFn func(docID string) ([]string, error)) (map[string][]string, error) {
+    purgeMap := make(map[string][]string)
+    seen := make(map[string]bool)
+    for _, row := range resp.Rows {
+        docID := row.Document().ID
+        if docID == "" || seen[docID] {
+            continue
+        }
+        seen[docID] = true
+
+        revs, err := revsFn(docID)
+        if err != nil {
+            return nil, fmt.Errorf("failed to get revisions to purge for document %s: %w", docID, err)
+        }
+        if len(revs) > 0 {
+            purgeMap[docID] = revs
+        }
+    }
+    return purgeMap, nil
+}
+
+// FindDeletedDocuments reads the whole _changes feed, pageSize changes at a
+// time, and returns the leaf revisions of every deleted document keyed by
+// document ID.
+func (c *CouchDBClient) FindDeletedDocuments(pageSize int) (map[string][]string, error) {
+    deleted := make(map[string][]string)
+    since := ""
+    for {
+        changes, err := c.GetChanges(ChangesOptions{Since: since, Limit: pageSize, AllDocs: true})
+        if err != nil {
+            return nil, err
+        }
+
+        for _, change := range changes.Results {
+            if !change.Deleted {
+                delete(deleted, change.ID)
+                continue
+            }
+            var revs []string
+            for _, rev := range change.Changes {
+                revs = append(revs, rev.Rev)
+            }
+            deleted[change.ID] = revs
+        }
+
+        if len(changes.Results) == 0 || changes.Pending == 0 {
+            return deleted, nil
+        }
+        since = string(changes.LastSeq)
+    }
+}
@@ -0,0 +1,38 @@
+package couchdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotQuiescent is returned by WaitForQuiescence when the database kept
+// being written to.
+var ErrNotQuiescent = errors.New("database is still being written to")
+
+// maxQuiescenceWindows is the number of windows WaitForQuiescence watches
+// before giving up.
+const maxQuiescenceWindows = 10
+
+// WaitForQuiescence waits until the database's update_seq stays unchanged
+// for a whole window, a sign that no large write is in progress. It returns
+// ErrNotQuiescent if the sequence still moved in each of
+// maxQuiescenceWindows windows.
+func (c *CouchDBClient) WaitForQuiescence(window time.Duration) error {
+    info, err := c.GetDatabaseInfo()
+    if err != nil {
+        return err
+    }
+    for i := 0; i < maxQuiescenceWindows; i++ {
+        time.Sleep(window)
+        next, err := c.GetDatabaseInfo()
+        if err != nil {
+            return err
+        }
+        if next.UpdateSeq == info.UpdateSeq {
+            return nil
+        }
+        info = next
+    }
+    return fmt.Errorf("%w: update_seq of %s changed in each of %d windows of %s", ErrNotQuiescent, c.DBName, maxQuiescenceWindows, window)
+}
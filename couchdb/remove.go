@@ -0,0 +1,36 @@
+package couchdb
+
+// openRevisions returns the revision IDs of every leaf of the document,
+// deleted ones included, read with open_revs=all.
+func (c *CouchDBClient) openRevisions(docID string) ([]string, error) {
+    leaves, err := c.GetLeafRevisions(docID)
+    if err != nil {
+        return nil, err
+    }
+    var revs []string
+    for _, leaf := range leaves {
+        if rev, ok := leaf["_rev"].(string); ok {
+            revs = append(revs, rev)
+        }
+    }
+    return revs, nil
+}
+
+// PurgeDocument purges every leaf of the document, deleted ones included, so
+// that nothing of it is left in the database, and returns the number of
+// revisions purged. It is used after deleting a document that is not to be
+// recreated.
+func (c *CouchDBClient) PurgeDocument(docID string) (int, error) {
+    leaves, err := c.openRevisions(docID)
+    if err != nil {
+        return 0, err
+    }
+    if len(leaves) == 0 {
+        return 0, nil
+    }
+    purgeResp, err := c.PurgeDocuments(map[string][]string{docID: leaves})
+    if err != nil {
+        return 0, err
+    }
+    return len(purgeResp.Purged[docID]), nil
+}
@@ -0,0 +1,59 @@
+package couchdb
+
+import (
+	"sort"
+)
+
+// DocRevCount is a document found by FindDocsOverRevCount.
+type DocRevCount struct {
+    ID         string
+    Generation int
+}
+
+// FindDocsOverRevCount reads the whole _changes feed, pageSize changes at a
+// time, and returns the live documents whose highest leaf revision generation
+// is at least threshold, most revisions first. Unlike the candidate views it
+// covers every document, whether or not it has conflicts.
+func (c *CouchDBClient) FindDocsOverRevCount(threshold, pageSize int) ([]DocRevCount, error) {
+    generations := make(map[string]int)
+    since := ""
+    for {
+        changes, err := c.GetChanges(ChangesOptions{Since: since, Limit: pageSize, AllDocs: true})
+        if err != nil {
+            return nil, err
+        }
+
+        for _, change := range changes.Results {
+            delete(generations, change.ID)
+            if change.Deleted {
+                continue
+            }
+            highest := 0
+            for _, rev := range change.Changes {
+                if gen, err := RevGeneration(rev.Rev); err == nil && gen > highest {
+                    highest = gen
+                }
+            }
+            if highest >= threshold {
+                generations[change.ID] = highest
+            }
+        }
+
+        if len(changes.Results) == 0 || changes.Pending == 0 {
+            break
+        }
+        since = string(changes.LastSeq)
+    }
+
+    docs := make([]DocRevCount, 0, len(generations))
+    for id, gen := range generations {
+        docs = append(docs, DocRevCount{ID: id, Generation: gen})
+    }
+    sort.Slice(docs, func(i, j int) bool {
+        if docs[i].Generation != docs[j].Generation {
+            return docs[i].Generation > docs[j].Generation
+        }
+        return docs[i].ID < docs[j].ID
+    })
+    return docs, nil
+}
@@ -0,0 +1,138 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// ErrRevisionUnavailable is returned when the body of a revision cannot be
+// read, most often because compaction has discarded it: CouchDB only keeps
+// the bodies of leaf revisions once a database is compacted.
+var ErrRevisionUnavailable = errors.New("revision body is not available")
+
+// GetDocumentRevision fetches the body of revision rev of a document, which
+// need not be the winning one, so that conflicting revisions can be compared.
+// CouchDB answers 404 Not Found alike for a revision compacted away and one
+// that never existed, so both are returned as ErrRevisionUnavailable, also
+// matching ErrNotFound.
+func (c *CouchDBClient) GetDocumentRevision(docID, rev string) (map[string]interface{}, error) {
+    url := withQuery(c.documentURL(docID), neturl.Values{"rev": {rev}})
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, fmt.Errorf("revision %s of document %s: %w (%w)", rev, docID, ErrRevisionUnavailable, ErrNotFound)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch document revision: %s", string(body))
+    }
+
+    var doc map[string]interface{}
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return nil, err
+    }
+    return doc, nil
+}
+
+// GetLeafRevisions fetches every leaf revision of a document with
+// open_revs=all: the winning revision, its conflicts and deleted leaves. This
+// is the authoritative list of a document's conflicting branches. CouchDB
+// answers with a multipart/mixed body holding one part per leaf, a leaf with
+// attachments being a multipart/related part whose first part is the
+// document; a JSON array of {"ok": doc} objects is accepted as well.
+func (c *CouchDBClient) GetLeafRevisions(docID string) ([]map[string]interface{}, error) {
+    req, err := http.NewRequest(http.MethodGet, withQuery(c.documentURL(docID), neturl.Values{"open_revs": {"all"}}), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Accept", "multipart/mixed")
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        body, err := ioutil.ReadAll(resp.Body)
+        if err != nil {
+            return nil, err
+        }
+        if resp.StatusCode == http.StatusNotFound {
+            return nil, fmt.Errorf("document %s: %w", docID, ErrNotFound)
+        }
+        return nil, fmt.Errorf("failed to fetch open revisions: %s", string(body))
+    }
+
+    mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+        var leaves []struct {
+            OK map[string]interface{} `json:"ok"`
+        }
+        if err := json.NewDecoder(resp.Body).Decode(&leaves); err != nil {
+            return nil, err
+        }
+        var docs []map[string]interface{}
+        for _, leaf := range leaves {
+            if leaf.OK != nil {
+                docs = append(docs, leaf.OK)
+            }
+        }
+        return docs, nil
+    }
+
+    var docs []map[string]interface{}
+    reader := multipart.NewReader(resp.Body, params["boundary"])
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            return docs, nil
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read open revisions of document %s: %w", docID, err)
+        }
+        doc, err := readLeafPart(part)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read open revisions of document %s: %w", docID, err)
+        }
+        docs = append(docs, doc)
+    }
+}
+
+// readLeafPart decodes the document in one part of an open_revs multipart
+// response. A multipart/related part holds the document followed by its
+// attachments, which are skipped.
+func readLeafPart(part *multipart.Part) (map[string]interface{}, error) {
+    mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+    if err != nil {
+        return nil, err
+    }
+    body := io.Reader(part)
+    if mediaType == "multipart/related" {
+        first, err := multipart.NewReader(part, params["boundary"]).NextPart()
+        if err != nil {
+            return nil, err
+        }
+        body = first
+    }
+    var doc map[string]interface{}
+    if err := json.NewDecoder(body).Decode(&doc); err != nil {
+        return nil, err
+    }
+    return doc, nil
+}
@@ -0,0 +1,68 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// GetSecurity fetches the database's _security document.
+func (c *CouchDBClient) GetSecurity() (map[string]interface{}, error) {
+    url := c.dbURL() + "/_security"
+    resp, err := c.HTTPClient.Get(url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("failed to fetch security document: %s", string(body))
+    }
+
+    var security map[string]interface{}
+    if err := json.Unmarshal(body, &security); err != nil {
+        return nil, err
+    }
+
+    return security, nil
+}
+
+// SetSecurity replaces the database's _security document.
+func (c *CouchDBClient) SetSecurity(security map[string]interface{}) error {
+    url := c.dbURL() + "/_security"
+
+    jsonDoc, err := json.Marshal(security)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonDoc))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("failed to set security document: %s", string(body))
+    }
+
+    return nil
+}
@@ -0,0 +1,43 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ClusterSetupState returns the state reported by /_cluster_setup, such as
+// "cluster_finished", "single_node_finished" or "cluster_disabled". Until the
+// setup wizard has finished, system databases such as _users may be missing.
+func (c *CouchDBClient) ClusterSetupState() (string, error) {
+    resp, err := c.HTTPClient.Get(c.BaseURL + "/_cluster_setup")
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("failed to fetch cluster setup state: %s", string(body))
+    }
+
+    var setup struct {
+        State string `json:"state"`
+    }
+    if err := json.Unmarshal(body, &setup); err != nil {
+        return "", err
+    }
+    return setup.State, nil
+}
+
+// SetupFinished reports whether a /_cluster_setup state means the node has
+// been set up, either as a cluster or as a single node.
+func SetupFinished(state string) bool {
+    return strings.HasSuffix(state, "_finished")
+}
@@ -0,0 +1,116 @@
+package couchdb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+    // throttleWindow is the number of recent request latencies the p95 is
+    // computed over, and throttleMinSamples the number needed before the
+    // throttle acts on it.
+    throttleWindow     = 50
+    throttleMinSamples = 20
+    // throttleInitialDelay is the first delay added between requests once
+    // the p95 latency exceeds the threshold; it doubles up to
+    // throttleMaxDelay while latency stays high and halves once it recovers.
+    throttleInitialDelay = 50 * time.Millisecond
+    throttleMaxDelay     = 5 * time.Second
+)
+
+// throttleTransport sheds load from a slow node: it tracks the latency of
+// recent requests and, while their 95th percentile is above threshold, waits
+// between requests for a delay that grows as long as the node stays slow.
+// The window is cleared whenever the delay changes, so each decision is made
+// on latencies measured at the current delay.
+type throttleTransport struct {
+    threshold time.Duration
+    next      http.RoundTripper
+    output    io.Writer
+
+    mu        sync.Mutex
+    latencies []time.Duration
+    delay     time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if delay := t.currentDelay(); delay > 0 {
+        timer := time.NewTimer(delay)
+        select {
+        case <-timer.C:
+        case <-req.Context().Done():
+            timer.Stop()
+            return nil, req.Context().Err()
+        }
+    }
+
+    start := time.Now()
+    resp, err := t.next.RoundTrip(req)
+    t.observe(req, time.Since(start))
+    return resp, err
+}
+
+// currentDelay returns the delay currently added before each request.
+func (t *throttleTransport) currentDelay() time.Duration {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.delay
+}
+
+// observe records the latency of a request and adjusts the delay.
+func (t *throttleTransport) observe(req *http.Request, latency time.Duration) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    t.latencies = append(t.latencies, latency)
+    if len(t.latencies) > throttleWindow {
+        t.latencies = t.latencies[len(t.latencies)-throttleWindow:]
+    }
+    if len(t.latencies) < throttleMinSamples {
+        return
+    }
+
+    p95 := percentile(t.latencies, 0.95)
+    previous := t.delay
+    switch {
+    case p95 > t.threshold:
+        t.delay *= 2
+        if t.delay < throttleInitialDelay {
+            t.delay = throttleInitialDelay
+        }
+        if t.delay > throttleMaxDelay {
+            t.delay = throttleMaxDelay
+        }
+        if t.delay != previous {
+            fmt.Fprintf(t.output, "Backing off %s: p95 latency %s is above %s, waiting %s between requests\n", req.URL.Host, p95, t.threshold, t.delay)
+        }
+    case t.delay > 0:
+        t.delay /= 2
+        if t.delay < throttleInitialDelay/8 {
+            t.delay = 0
+            fmt.Fprintf(t.output, "Latency of %s is back below %s, no longer waiting between requests\n", req.URL.Host, t.threshold)
+        }
+    }
+    if t.delay != previous {
+        t.latencies = t.latencies[:0]
+    }
+}
+
+// percentile returns the p-th percentile, between 0 and 1, of latencies.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+    sorted := append([]time.Duration{}, latencies...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    index := int(p*float64(len(sorted)+1)) - 1
+    if index < 0 {
+        index = 0
+    }
+    if index >= len(sorted) {
+        index = len(sorted) - 1
+    }
+    return sorted[index]
+}
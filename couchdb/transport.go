@@ -0,0 +1,369 @@
+package couchdb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"time"
+)
+
+// ClientOptions configures the HTTP client used by CouchDBClient.
+type ClientOptions struct {
+    // RequestTimeout bounds each HTTP request. Zero means no timeout.
+    RequestTimeout time.Duration
+
+    // Username and Password are sent as HTTP basic auth when Username is set.
+    Username string
+    Password string
+
+    // WriteQuorum is the w parameter sent on document writes and deletes.
+    // Zero uses the server default.
+    WriteQuorum int
+
+    // ConditionalDeletes confirms a document is still at the revision it was
+    // read at before deleting any of its revisions.
+    ConditionalDeletes bool
+
+    // VerifyResets re-reads each reset document after it is recreated and
+    // checks its body matches what was written.
+    VerifyResets bool
+
+    // ResetStrategy selects how documents are reset. The zero value deletes
+    // and recreates them.
+    ResetStrategy ResetStrategy
+
+    // Protocol selects the HTTP version used over TLS. The zero value lets
+    // Go negotiate HTTP/2 when the server offers it.
+    Protocol HTTPProtocol
+
+    // Gzip asks CouchDB for gzip-compressed responses, which saves bandwidth
+    // on large view and _all_docs results over slow links. net/http's
+    // transport sends the Accept-Encoding header and decompresses the
+    // response itself; without Gzip that is turned off, so responses are
+    // never compressed.
+    Gzip bool
+
+    // MaxResponseBytes bounds the size of a response body; reading past it
+    // fails with ErrResponseTooLarge instead of exhausting memory. Zero uses
+    // DefaultMaxResponseBytes and a negative value removes the limit.
+    MaxResponseBytes int64
+
+    // LatencyThreshold enables adaptive throttling: while the 95th
+    // percentile latency of recent requests to the node is above it, the
+    // client waits, for a growing delay, between requests. Zero disables it.
+    LatencyThreshold time.Duration
+
+    // Socks5Proxy is the host:port of a SOCKS5 proxy to send requests
+    // through, such as one opened with ssh -D on a jump host. Empty means
+    // connecting directly.
+    Socks5Proxy string
+
+    // ClientCertificate, when set, is presented to CouchDB servers that
+    // require mutual TLS.
+    ClientCertificate *tls.Certificate
+
+    // CorrelationID, when set, is sent as the X-Correlation-Id header of
+    // every request, so CouchDB's logs can be matched with the tool's.
+    CorrelationID string
+
+    // Output receives progress messages. Nil means os.Stdout.
+    Output io.Writer
+}
+
+// DefaultMaxResponseBytes is the response size limit used when
+// ClientOptions.MaxResponseBytes is zero.
+const DefaultMaxResponseBytes = 256 << 20
+
+// HTTPProtocol selects the HTTP version a CouchDBClient speaks over TLS.
+type HTTPProtocol int
+
+const (
+    // ProtocolAuto uses HTTP/2 when the server offers it through ALPN and
+    // HTTP/1.1 otherwise.
+    ProtocolAuto HTTPProtocol = iota
+    // ProtocolHTTP1 never negotiates HTTP/2, for proxies that mishandle
+    // chunked CouchDB responses over h2.
+    ProtocolHTTP1
+    // ProtocolHTTP2 attempts HTTP/2 even when the transport has a custom TLS
+    // configuration, which otherwise disables it.
+    ProtocolHTTP2
+)
+
+// ParseHTTPProtocol converts a protocol name, "auto", "http1" or "http2", to
+// an HTTPProtocol.
+func ParseHTTPProtocol(name string) (HTTPProtocol, error) {
+    switch name {
+    case "", "auto":
+        return ProtocolAuto, nil
+    case "http1":
+        return ProtocolHTTP1, nil
+    case "http2":
+        return ProtocolHTTP2, nil
+    }
+    return ProtocolAuto, fmt.Errorf("unknown HTTP protocol %q, expected auto, http1 or http2", name)
+}
+
+// baseTransport returns the transport that sends requests for opts.Protocol,
+// asking for compressed responses only if opts.Gzip is set. A non-empty
+// opts.Socks5Proxy routes every connection through that SOCKS5 proxy, using
+// net/http's own SOCKS5 support, and opts.ClientCertificate is presented to
+// servers asking for one.
+func baseTransport(opts ClientOptions) http.RoundTripper {
+    if opts.Protocol == ProtocolAuto && opts.Gzip && opts.Socks5Proxy == "" && opts.ClientCertificate == nil {
+        return http.DefaultTransport
+    }
+    return newTransport(opts)
+}
+
+// newTransport returns a new transport configured as baseTransport describes,
+// never sharing http.DefaultTransport.
+func newTransport(opts ClientOptions) *http.Transport {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.DisableCompression = !opts.Gzip
+    if opts.Socks5Proxy != "" {
+        transport.Proxy = http.ProxyURL(&neturl.URL{Scheme: "socks5", Host: opts.Socks5Proxy})
+    }
+    if opts.ClientCertificate != nil {
+        transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{*opts.ClientCertificate}}
+    }
+    switch opts.Protocol {
+    case ProtocolHTTP1:
+        transport.ForceAttemptHTTP2 = false
+        // A non-nil, empty TLSNextProto disables HTTP/2.
+        transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+    case ProtocolHTTP2:
+        transport.ForceAttemptHTTP2 = true
+    }
+    return transport
+}
+
+// newHTTPClient builds the HTTP client for a CouchDBClient from opts. Messages
+// from the transport, such as throttling notices, go to output.
+func newHTTPClient(opts ClientOptions, output io.Writer) *http.Client {
+    return wrapTransport(baseTransport(opts), opts, output)
+}
+
+// newVerifyHTTPClient builds the HTTP client shared by every check of a
+// verifying IsCouchDBRunningFunc. Each host is only visited once, so its
+// transport keeps a single idle connection per host, reused by the requests
+// of one check, and drops idle connections soon after. Throttling is left
+// out, as its latency window would mix every host scanned.
+func newVerifyHTTPClient(opts ClientOptions, output io.Writer) *http.Client {
+    transport := newTransport(opts)
+    transport.MaxIdleConnsPerHost = 1
+    transport.IdleConnTimeout = 10 * time.Second
+    opts.LatencyThreshold = 0
+    return wrapTransport(transport, opts, output)
+}
+
+// wrapTransport builds an HTTP client sending requests through transport,
+// with the limits, authentication, timeout and throttling set in opts.
+func wrapTransport(transport http.RoundTripper, opts ClientOptions, output io.Writer) *http.Client {
+    maxBytes := opts.MaxResponseBytes
+    if maxBytes == 0 {
+        maxBytes = DefaultMaxResponseBytes
+    }
+    if maxBytes > 0 {
+        transport = &limitTransport{maxBytes: maxBytes, next: transport}
+    }
+    if opts.Username != "" {
+        transport = &basicAuthTransport{
+            username: opts.Username,
+            password: opts.Password,
+            next:     transport,
+        }
+    }
+
+    if opts.CorrelationID != "" {
+        transport = &headerTransport{
+            name:  "X-Correlation-Id",
+            value: opts.CorrelationID,
+            next:  transport,
+        }
+    }
+
+    if opts.RequestTimeout > 0 {
+        transport = &timeoutTransport{
+            timeout: opts.RequestTimeout,
+            next:    transport,
+        }
+    }
+
+    if opts.LatencyThreshold > 0 {
+        transport = &throttleTransport{
+            threshold: opts.LatencyThreshold,
+            next:      transport,
+            output:    output,
+        }
+    }
+
+    return &http.Client{
+        Transport: transport,
+    }
+}
+
+// TimeoutError is returned when a request to CouchDB, or reading its
+// response, does not finish within the request timeout.
+type TimeoutError struct {
+    Op  string
+    URL string
+    Err error
+}
+
+// Error implements the error interface.
+func (e *TimeoutError) Error() string {
+    return fmt.Sprintf("%s %s timed out: %v", e.Op, e.URL, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TimeoutError) Unwrap() error {
+    return e.Err
+}
+
+// Timeout reports true, so a TimeoutError satisfies net.Error checks.
+func (e *TimeoutError) Timeout() bool {
+    return true
+}
+
+// IsTimeout reports whether err was caused by a request timing out.
+func IsTimeout(err error) bool {
+    var timeoutErr *TimeoutError
+    return errors.As(err, &timeoutErr)
+}
+
+// wrapTimeout returns err as a *TimeoutError for req if it is a timeout, and
+// unchanged otherwise.
+func wrapTimeout(req *http.Request, err error) error {
+    var netErr net.Error
+    if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+        return &TimeoutError{Op: req.Method, URL: req.URL.Redacted(), Err: err}
+    }
+    return err
+}
+
+// timeoutTransport bounds each request, including reading its response body,
+// by timeout and reports timeouts as a *TimeoutError. It replaces
+// http.Client.Timeout, whose errors do not carry a type.
+type timeoutTransport struct {
+    timeout time.Duration
+    next    http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+    resp, err := t.next.RoundTrip(req.WithContext(ctx))
+    if err != nil {
+        cancel()
+        return nil, wrapTimeout(req, err)
+    }
+    resp.Body = &timeoutBody{ReadCloser: resp.Body, req: req, cancel: cancel}
+    return resp, nil
+}
+
+// timeoutBody releases the request's deadline once the body is closed.
+type timeoutBody struct {
+    io.ReadCloser
+    req    *http.Request
+    cancel context.CancelFunc
+}
+
+// Read implements io.Reader.
+func (b *timeoutBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    if err != nil && err != io.EOF {
+        err = wrapTimeout(b.req, err)
+    }
+    return n, err
+}
+
+// Close implements io.Closer.
+func (b *timeoutBody) Close() error {
+    defer b.cancel()
+    return b.ReadCloser.Close()
+}
+
+// limitTransport fails reads of response bodies larger than maxBytes with
+// ErrResponseTooLarge. It wraps the decompressed body, so the limit applies to
+// what callers read rather than to what is sent over the wire.
+type limitTransport struct {
+    maxBytes int64
+    next     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    resp, err := t.next.RoundTrip(req)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body = &limitedBody{
+        Reader:   io.LimitReader(resp.Body, t.maxBytes+1),
+        body:     resp.Body,
+        req:      req,
+        maxBytes: t.maxBytes,
+    }
+    return resp, nil
+}
+
+// limitedBody reads at most one byte past maxBytes, so an oversized body is
+// detected without reading all of it.
+type limitedBody struct {
+    io.Reader
+    body     io.ReadCloser
+    req      *http.Request
+    maxBytes int64
+    read     int64
+}
+
+// Read implements io.Reader.
+func (b *limitedBody) Read(p []byte) (int, error) {
+    n, err := b.Reader.Read(p)
+    b.read += int64(n)
+    if b.read > b.maxBytes {
+        return n - int(b.read-b.maxBytes), fmt.Errorf("%s %s: body exceeds %d bytes: %w", b.req.Method, b.req.URL.Redacted(), b.maxBytes, ErrResponseTooLarge)
+    }
+    return n, err
+}
+
+// Close implements io.Closer.
+func (b *limitedBody) Close() error {
+    return b.body.Close()
+}
+
+// headerTransport sets a header on every request.
+type headerTransport struct {
+    name  string
+    value string
+    next  http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.Header.Set(t.name, t.value)
+    return t.next.RoundTrip(req)
+}
+
+// basicAuthTransport adds HTTP basic auth credentials to every request except
+// those marked as anonymous.
+type basicAuthTransport struct {
+    username string
+    password string
+    next     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if anonymous(req) {
+        return t.next.RoundTrip(req)
+    }
+    req = req.Clone(req.Context())
+    req.SetBasicAuth(t.username, t.password)
+    return t.next.RoundTrip(req)
+}
@@ -0,0 +1,47 @@
+package couchdb
+
+import (
+	neturl "net/url"
+	"strings"
+)
+
+// dbURL returns the URL of the database. Database names may contain slashes,
+// so the name is escaped as a single path segment.
+func (c *CouchDBClient) dbURL() string {
+    return c.BaseURL + "/" + neturl.PathEscape(c.DBName)
+}
+
+// designPrefix is the ID prefix of design documents.
+const designPrefix = "_design/"
+
+// documentURL returns the URL of a document. The ID is escaped as a single
+// path segment, so IDs containing slashes, spaces or characters such as ? and
+// # address the right document. Local and design documents are addressed
+// under the _local/ and _design/ path segments, which must not be escaped.
+func (c *CouchDBClient) documentURL(docID string) string {
+    for _, prefix := range []string{localPrefix, designPrefix} {
+        if name, found := strings.CutPrefix(docID, prefix); found {
+            return c.dbURL() + "/" + prefix + neturl.PathEscape(name)
+        }
+    }
+    return c.dbURL() + "/" + neturl.PathEscape(docID)
+}
+
+// designDocURL returns the URL of the design document named name, which may
+// be given with or without its _design/ prefix. Everything after the prefix
+// is escaped, so names may contain slashes and other special characters.
+func (c *CouchDBClient) designDocURL(name string) string {
+    return c.documentURL(designPrefix + strings.TrimPrefix(name, designPrefix))
+}
+
+// withQuery appends the encoded query parameters to url.
+func withQuery(url string, query neturl.Values) string {
+    if len(query) == 0 {
+        return url
+    }
+    separator := "?"
+    if strings.Contains(url, "?") {
+        separator = "&"
+    }
+    return url + separator + query.Encode()
+}
@@ -0,0 +1,39 @@
+package events
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "testing"
+)
+
+// TestJSONEmitter checks that each event is written as one line of JSON.
+func TestJSONEmitter(t *testing.T) {
+    var buf bytes.Buffer
+    emitter := NewJSONEmitter(&buf)
+    if err := emitter.Emit(Event{Type: InstanceFound, Instance: "10.0.0.1:5984", Version: "3.3.2"}); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if err := emitter.Emit(Event{Type: RevisionDeleted, Instance: "10.0.0.1:5984", DocID: "doc1", Revisions: []string{"2-b"}}); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    var got []Event
+    scanner := bufio.NewScanner(&buf)
+    for scanner.Scan() {
+        var ev Event
+        if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+            t.Fatalf("Expected a JSON line, got %q: %v", scanner.Text(), err)
+        }
+        got = append(got, ev)
+    }
+    if len(got) != 2 {
+        t.Fatalf("Expected 2 events, got %d", len(got))
+    }
+    if got[0].Type != InstanceFound || got[0].Time.IsZero() {
+        t.Errorf("Expected a timestamped instance_found event, got %+v", got[0])
+    }
+    if got[1].DocID != "doc1" || len(got[1].Revisions) != 1 {
+        t.Errorf("Expected the deleted revision of doc1, got %+v", got[1])
+    }
+}
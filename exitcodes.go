@@ -0,0 +1,43 @@
+package main
+
+import (
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+)
+
+// Exit codes of the tool, so that scripts running it can tell outcomes
+// apart.
+const (
+    // exitOK means every instance found succeeded or was skipped.
+    exitOK = 0
+
+    // exitFailure means the inspect or build-index subcommand failed.
+    exitFailure = 1
+
+    // exitConfigError means the flags or configuration were invalid, or a
+    // file they name could not be read, so nothing was done.
+    exitConfigError = 2
+
+    // exitNoInstances means no CouchDB instance was found to process.
+    exitNoInstances = 3
+
+    // exitPartialFailure means some instances failed and others did not.
+    exitPartialFailure = 4
+
+    // exitAllFailed means every instance found failed.
+    exitAllFailed = 5
+)
+
+// exitCode returns the exit code for a run over instances CouchDB instances
+// that produced report.
+func exitCode(report summary.Report, instances int) int {
+    switch {
+    case instances == 0:
+        return exitNoInstances
+    case len(report.Failed) == 0:
+        return exitOK
+    case len(report.Failed) >= instances:
+        return exitAllFailed
+    default:
+        return exitPartialFailure
+    }
+}
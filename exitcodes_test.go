@@ -0,0 +1,31 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+)
+
+// TestExitCode checks the exit code for each outcome of a run.
+func TestExitCode(t *testing.T) {
+    s := summary.New()
+    s.AddSuccess("10.0.0.1:5984")
+    s.AddSkipped("10.0.0.2:5984", "maintenance")
+    if code := exitCode(s.Report(), 2); code != exitOK {
+        t.Errorf("Expected %d with no failures, got %d", exitOK, code)
+    }
+    if code := exitCode(summary.New().Report(), 0); code != exitNoInstances {
+        t.Errorf("Expected %d with no instances, got %d", exitNoInstances, code)
+    }
+
+    s.AddFailure("10.0.0.3:5984", errors.New("connection refused"))
+    if code := exitCode(s.Report(), 3); code != exitPartialFailure {
+        t.Errorf("Expected %d with some failures, got %d", exitPartialFailure, code)
+    }
+
+    s = summary.New()
+    s.AddFailure("10.0.0.1:5984", errors.New("connection refused"))
+    if code := exitCode(s.Report(), 1); code != exitAllFailed {
+        t.Errorf("Expected %d with every instance failing, got %d", exitAllFailed, code)
+    }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/config"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "net"
+    "os"
+)
+
+// runInspect implements the inspect subcommand, which prints the revision tree
+// of a single document without changing anything:
+//
+//     couch-revision-purge inspect -dbname=mydb -host=10.0.0.5 [-json] <docID>
+//
+func runInspect(args []string) error {
+    fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+    configFile := fs.String("config", "config.json", "Path to the configuration file")
+    dbName := fs.String("dbname", "", "CouchDB database name")
+    host := fs.String("host", "", "CouchDB host, optionally with :port")
+    jsonOutput := fs.Bool("json", false, "Print the revision tree as JSON")
+    fs.Parse(args)
+
+    if *dbName == "" || *host == "" || fs.NArg() != 1 {
+        return fmt.Errorf("usage: inspect -dbname=<db> -host=<host[:port]> [-json] <docID>")
+    }
+    docID := fs.Arg(0)
+
+    cfg, err := config.LoadConfig(*configFile)
+    if err != nil {
+        return fmt.Errorf("failed to load configuration: %v", err)
+    }
+    clientOpts, err := clientOptions(cfg)
+    if err != nil {
+        return err
+    }
+
+    ip, port, err := net.SplitHostPort(*host)
+    if err != nil {
+        ip, port = *host, cfg.CouchDBPort
+    }
+    client := couchdb.NewCouchDBClient(couchdb.BuildBaseURL(cfg.CouchDBScheme, ip, port, cfg.CouchDBPathPrefix), *dbName, clientOpts)
+
+    tree, err := client.InspectDocument(docID)
+    if err != nil {
+        return err
+    }
+
+    if *jsonOutput {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        return encoder.Encode(tree)
+    }
+
+    fmt.Printf("Document:          %s\n", tree.DocID)
+    fmt.Printf("Current revision:  %s\n", tree.CurrentRev)
+    fmt.Printf("Revisions:         %d\n", tree.RevisionCount)
+    fmt.Printf("Generations:       %d-%d\n", tree.MinGeneration, tree.MaxGeneration)
+    fmt.Printf("Conflicts:         %v\n", tree.Conflicts)
+    fmt.Printf("Deleted conflicts: %v\n", tree.DeletedConflicts)
+    fmt.Printf("Approximate size:  %d bytes\n", tree.SizeBytes)
+    return nil
+}
@@ -0,0 +1,111 @@
+package logger
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+)
+
+// asyncWriter queues writes on a channel and writes them to the underlying
+// writer from a single goroutine, through a buffer that is flushed whenever
+// the queue runs empty. Callers only wait when the queue is full.
+type asyncWriter struct {
+    mu     sync.Mutex
+    closed bool
+    queue  chan []byte
+    done   chan struct{}
+    out    io.Writer
+    buf    *bufio.Writer
+}
+
+// newAsyncWriter starts writing to out with room for size queued writes.
+func newAsyncWriter(out io.Writer, size int) *asyncWriter {
+    a := &asyncWriter{
+        queue: make(chan []byte, size),
+        done:  make(chan struct{}),
+        out:   out,
+        buf:   bufio.NewWriter(out),
+    }
+    go a.run()
+    return a
+}
+
+// run writes queued messages until the queue is closed, then flushes.
+func (a *asyncWriter) run() {
+    defer close(a.done)
+    for p := range a.queue {
+        a.buf.Write(p)
+        if len(a.queue) == 0 {
+            a.buf.Flush()
+        }
+    }
+    a.buf.Flush()
+}
+
+// Write implements io.Writer. p is copied, as log.Logger reuses its buffer.
+// Once closed, writes go straight to the underlying writer.
+func (a *asyncWriter) Write(p []byte) (int, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.closed {
+        return a.out.Write(p)
+    }
+    a.queue <- append([]byte(nil), p...)
+    return len(p), nil
+}
+
+// Close writes out everything queued and stops the goroutine.
+func (a *asyncWriter) Close() error {
+    a.mu.Lock()
+    if !a.closed {
+        a.closed = true
+        close(a.queue)
+    }
+    a.mu.Unlock()
+    <-a.done
+    return nil
+}
+
+// SetAsync makes the Logger hand messages to a background goroutine that
+// writes them in batches, instead of writing each one as it is logged. It
+// saves a write per message when many goroutines log at once, such as during
+// a verbose scan. Up to queueSize messages wait to be written; once that many
+// are queued, logging waits for the writer. Close must be called before the
+// program exits so queued messages are not lost; Fatalf does so itself.
+// Messages sent to syslog are not affected.
+//
+// Parameters:
+// - queueSize: The number of messages that can be queued.
+//
+// Example usage:
+//
+//     logger, _ := logger.NewLogger("app.log")
+//     logger.SetAsync(1024)
+//     defer logger.Close()
+//
+func (l *Logger) SetAsync(queueSize int) {
+    if l.async != nil {
+        return
+    }
+    l.async = newAsyncWriter(l.Logger.Writer(), queueSize)
+    l.Logger.SetOutput(l.async)
+}
+
+// Close writes out any messages queued by SetAsync. It does nothing for a
+// Logger that writes synchronously, and is safe to call more than once.
+func (l *Logger) Close() error {
+    if l.async == nil {
+        return nil
+    }
+    return l.async.Close()
+}
+
+// Fatalf writes a message like Printf, writes out queued messages and exits
+// with status 1.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+    l.Logger.Output(2, fmt.Sprintf(format, v...))
+    l.Close()
+    os.Exit(1)
+}
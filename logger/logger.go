@@ -5,9 +5,12 @@ package logger
 
 import (
     "fmt"
+    "io"
     "log"
     "os"
+    "path/filepath"
     "runtime"
+    "strings"
     "time"
 )
 
@@ -16,6 +19,96 @@ import (
 // from where the log entry was generated.
 type Logger struct {
     *log.Logger
+    level Level
+
+    // console, when set, also receives warnings and errors, colorized by
+    // level when color is true. The log file never contains color codes.
+    console io.Writer
+    color   bool
+
+    // sys, when set, receives leveled messages with the matching syslog
+    // severity instead of the embedded log.Logger.
+    sys syslogWriter
+
+    // async, when set, is the embedded log.Logger's output, writing in the
+    // background. See SetAsync.
+    async *asyncWriter
+
+    // prefix is put before every leveled message. See WithPrefix.
+    prefix string
+}
+
+// syslogWriter is the part of *syslog.Writer the Logger uses to send a
+// message at a given severity.
+type syslogWriter interface {
+    Debug(m string) error
+    Info(m string) error
+    Warning(m string) error
+    Err(m string) error
+}
+
+// ANSI escape sequences used to colorize console output.
+const (
+    colorRed    = "\033[31m"
+    colorYellow = "\033[33m"
+    colorReset  = "\033[0m"
+)
+
+// Level is the minimum severity of the messages a Logger writes.
+type Level int
+
+const (
+    LevelDebug Level = iota
+    LevelInfo
+    LevelWarn
+    LevelError
+)
+
+// String returns the name of the level as accepted by ParseLevel.
+func (l Level) String() string {
+    switch l {
+    case LevelDebug:
+        return "debug"
+    case LevelInfo:
+        return "info"
+    case LevelWarn:
+        return "warn"
+    case LevelError:
+        return "error"
+    }
+    return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel converts a level name (debug, info, warn or error, in any case)
+// to a Level.
+//
+// Parameters:
+// - name: The level name.
+//
+// Returns:
+// - The matching Level.
+// - An error if name is not a known level.
+//
+// Example usage:
+//
+//     level, err := logger.ParseLevel("debug")
+//     if err != nil {
+//         log.Fatalf("Invalid log level: %v", err)
+//     }
+//     logger.SetLevel(level)
+//
+func ParseLevel(name string) (Level, error) {
+    switch strings.ToLower(name) {
+    case "debug":
+        return LevelDebug, nil
+    case "info":
+        return LevelInfo, nil
+    case "warn", "warning":
+        return LevelWarn, nil
+    case "error":
+        return LevelError, nil
+    }
+    return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
 }
 
 
@@ -23,6 +116,8 @@ type Logger struct {
 // The Logger prefixes log messages with a custom timestamp format (yyyy-mm-dd hh:mm:ss),
 // the file name, and the line number from where the log entry was generated.
 //
+// The parent directory of logFile is created if it does not exist yet.
+//
 // Parameters:
 // - logFile: The path to the log file where logs will be written.
 //
@@ -39,13 +134,187 @@ type Logger struct {
 //     logger.Println("This is a log message.")
 //
 func NewLogger(logFile string) (*Logger, error) {
+    if dir := filepath.Dir(logFile); dir != "." {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, fmt.Errorf("failed to create log directory %s: %v", dir, err)
+        }
+    }
+
     file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
     if err != nil {
         return nil, err
     }
 
     logger := log.New(file, "", 0) // Disable default flags
-    return &Logger{logger}, nil
+    return &Logger{Logger: logger, level: LevelInfo}, nil
+}
+
+// NewWriterLogger creates a Logger that writes to w, such as os.Stdout, in the
+// same format as a Logger returned by NewLogger.
+//
+// Parameters:
+// - w: Where to write log messages.
+//
+// Returns:
+// - A pointer to a Logger instance.
+//
+// Example usage:
+//
+//     logger := logger.NewWriterLogger(os.Stdout)
+//     logger.Println("This is a log message.")
+//
+func NewWriterLogger(w io.Writer) *Logger {
+    return &Logger{Logger: log.New(w, "", 0), level: LevelInfo}
+}
+
+// SetLevel sets the minimum level of the messages the Logger writes. Messages
+// below it are discarded. New loggers start at LevelInfo.
+//
+// Parameters:
+// - level: The minimum level to write.
+//
+// Example usage:
+//
+//     logger, _ := logger.NewLogger("app.log")
+//     logger.SetLevel(logger.LevelDebug)
+//     logger.Debugf("Request took %s", elapsed)
+//
+func (l *Logger) SetLevel(level Level) {
+    l.level = level
+}
+
+// SetConsole makes the Logger also write warnings and errors to console, such
+// as os.Stderr, so they are seen without opening the log file. With color,
+// errors are printed in red and warnings in yellow; the log file is never
+// colorized.
+//
+// Parameters:
+// - console: Where to mirror warnings and errors, or nil to stop mirroring.
+// - color: Whether to colorize the console output, usually ColorEnabled(console).
+//
+// Example usage:
+//
+//     logger, _ := logger.NewLogger("app.log")
+//     logger.SetConsole(os.Stderr, logger.ColorEnabled(os.Stderr))
+//     logger.Warnf("Replication is active")
+//
+func (l *Logger) SetConsole(console io.Writer, color bool) {
+    l.console = console
+    l.color = color
+}
+
+// ColorEnabled reports whether output to w should be colorized: w must be a
+// terminal and the NO_COLOR environment variable must not be set.
+//
+// Parameters:
+// - w: The writer the console output goes to.
+//
+// Returns:
+// - true if w is a terminal and color has not been disabled.
+//
+// Example usage:
+//
+//     color := !*noColor && logger.ColorEnabled(os.Stderr)
+//
+func ColorEnabled(w io.Writer) bool {
+    if os.Getenv("NO_COLOR") != "" {
+        return false
+    }
+    file, ok := w.(*os.File)
+    if !ok {
+        return false
+    }
+    info, err := file.Stat()
+    if err != nil {
+        return false
+    }
+    return info.Mode()&os.ModeCharDevice != 0
+}
+
+// WithPrefix returns a Logger writing to the same place as l, with the same
+// settings, that puts prefix before each message, such as an ID tying the
+// messages about one piece of work together. Changing the settings of one
+// does not change the other.
+//
+// Parameters:
+// - prefix: The text to put before each message.
+//
+// Returns:
+// - A pointer to a Logger instance.
+//
+// Example usage:
+//
+//     instanceLogger := logger.WithPrefix("[3f9a2c1e] ")
+//     instanceLogger.Printf("Resetting document")
+//
+func (l *Logger) WithPrefix(prefix string) *Logger {
+    child := *l
+    child.prefix = l.prefix + prefix
+    return &child
+}
+
+// Debugf writes a message prefixed with "DEBUG:" when the level is LevelDebug.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+    l.logf(LevelDebug, "DEBUG: ", format, v...)
+}
+
+// Printf writes a message at LevelInfo, in the same format as log.Printf.
+func (l *Logger) Printf(format string, v ...interface{}) {
+    l.logf(LevelInfo, "", format, v...)
+}
+
+// Println writes a message at LevelInfo, in the same format as log.Println.
+func (l *Logger) Println(v ...interface{}) {
+    if l.level <= LevelInfo {
+        l.Logger.Output(2, l.prefix+fmt.Sprintln(v...))
+    }
+}
+
+// Warnf writes a message prefixed with "WARN:" unless the level is LevelError.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+    l.logf(LevelWarn, "WARN: ", format, v...)
+}
+
+// Errorf writes a message prefixed with "ERROR:". Errors are always written.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+    l.logf(LevelError, "ERROR: ", format, v...)
+}
+
+// logf writes a formatted message with prefix if level is enabled.
+func (l *Logger) logf(level Level, prefix, format string, v ...interface{}) {
+    if level < l.level {
+        return
+    }
+    message := prefix + l.prefix + fmt.Sprintf(format, v...)
+    if l.sys != nil {
+        writeSyslog(l.sys, level, l.prefix+fmt.Sprintf(format, v...))
+    } else {
+        l.Logger.Output(3, message)
+    }
+
+    if l.console != nil && level >= LevelWarn {
+        if l.color {
+            color := colorYellow
+            if level >= LevelError {
+                color = colorRed
+            }
+            message = color + message + colorReset
+        }
+        fmt.Fprintln(l.console, message)
+    }
+}
+
+// writeSyslog sends message to w with the syslog severity matching level.
+func writeSyslog(w syslogWriter, level Level, message string) error {
+    switch level {
+    case LevelDebug:
+        return w.Debug(message)
+    case LevelWarn:
+        return w.Warning(message)
+    case LevelError:
+        return w.Err(message)
+    }
+    return w.Info(message)
 }
 
 // Write implements the io.Writer interface for Logger and adds a custom log entry format.
@@ -0,0 +1,148 @@
+package logger
+
+import (
+    "bytes"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// TestNewLoggerCreatesDirectory checks that a log file can be opened in a
+// directory that does not exist yet.
+func TestNewLoggerCreatesDirectory(t *testing.T) {
+    logFile := filepath.Join(t.TempDir(), "missing", "nested", "app.log")
+
+    logger, err := NewLogger(logFile)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    logger.Println("hello")
+
+    content, err := os.ReadFile(logFile)
+    if err != nil {
+        t.Fatalf("Expected log file to exist, got %v", err)
+    }
+    if !strings.Contains(string(content), "hello") {
+        t.Errorf("Expected log file to contain the message, got %q", content)
+    }
+}
+
+// TestConsoleColor checks that warnings and errors are colorized on the
+// console but written to the log file without color codes.
+func TestConsoleColor(t *testing.T) {
+    logFile := filepath.Join(t.TempDir(), "app.log")
+
+    logger, err := NewLogger(logFile)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    var console bytes.Buffer
+    logger.SetConsole(&console, true)
+    logger.Printf("info")
+    logger.Warnf("careful")
+    logger.Errorf("broken")
+
+    if strings.Contains(console.String(), "info") {
+        t.Errorf("Expected info messages to stay off the console, got %q", console.String())
+    }
+    if !strings.Contains(console.String(), colorYellow+"WARN: careful"+colorReset) {
+        t.Errorf("Expected a yellow warning on the console, got %q", console.String())
+    }
+    if !strings.Contains(console.String(), colorRed+"ERROR: broken"+colorReset) {
+        t.Errorf("Expected a red error on the console, got %q", console.String())
+    }
+
+    content, err := os.ReadFile(logFile)
+    if err != nil {
+        t.Fatalf("Expected log file to exist, got %v", err)
+    }
+    if strings.Contains(string(content), "\033[") {
+        t.Errorf("Expected no color codes in the log file, got %q", content)
+    }
+}
+
+// fakeSyslog records the severity of each message sent to it.
+type fakeSyslog struct {
+    messages []string
+}
+
+func (f *fakeSyslog) Debug(m string) error   { f.messages = append(f.messages, "debug "+m); return nil }
+func (f *fakeSyslog) Info(m string) error    { f.messages = append(f.messages, "info "+m); return nil }
+func (f *fakeSyslog) Warning(m string) error { f.messages = append(f.messages, "warning "+m); return nil }
+func (f *fakeSyslog) Err(m string) error     { f.messages = append(f.messages, "err "+m); return nil }
+
+// TestSyslogSeverities checks that each level is sent to syslog with the
+// matching severity.
+func TestSyslogSeverities(t *testing.T) {
+    sys := &fakeSyslog{}
+    logger := NewWriterLogger(io.Discard)
+    logger.sys = sys
+    logger.SetLevel(LevelDebug)
+
+    logger.Debugf("one")
+    logger.Printf("two")
+    logger.Warnf("three")
+    logger.Errorf("four")
+
+    expected := []string{"debug one", "info two", "warning three", "err four"}
+    if strings.Join(sys.messages, ",") != strings.Join(expected, ",") {
+        t.Errorf("Expected %v, got %v", expected, sys.messages)
+    }
+}
+
+// TestAsyncLogger logs from many goroutines through SetAsync and checks that
+// every message is written once Close returns.
+func TestAsyncLogger(t *testing.T) {
+    var buf bytes.Buffer
+    logger := NewWriterLogger(&buf)
+    logger.SetAsync(4)
+
+    done := make(chan struct{})
+    for i := 0; i < 10; i++ {
+        go func(i int) {
+            for j := 0; j < 20; j++ {
+                logger.Printf("goroutine %d message %d", i, j)
+            }
+            done <- struct{}{}
+        }(i)
+    }
+    for i := 0; i < 10; i++ {
+        <-done
+    }
+    if err := logger.Close(); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    if len(lines) != 200 {
+        t.Errorf("Expected 200 lines, got %d", len(lines))
+    }
+    logger.Printf("after close")
+    if !strings.Contains(buf.String(), "after close") {
+        t.Errorf("Expected messages after Close to be written directly")
+    }
+}
+
+// TestWithPrefix checks that a prefixed Logger puts its prefix before each
+// message and leaves the original Logger unchanged.
+func TestWithPrefix(t *testing.T) {
+    var buf bytes.Buffer
+    logger := NewWriterLogger(&buf)
+    prefixed := logger.WithPrefix("[abc] ")
+    prefixed.Printf("first")
+    prefixed.Warnf("second")
+    logger.Println("third")
+
+    lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+    expected := []string{"[abc] first", "WARN: [abc] second", "third"}
+    if len(lines) != len(expected) {
+        t.Fatalf("Expected %d lines, got %q", len(expected), lines)
+    }
+    for i, line := range lines {
+        if line != expected[i] {
+            t.Errorf("Expected %q, got %q", expected[i], line)
+        }
+    }
+}
@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+    "fmt"
+    "log"
+    "log/syslog"
+)
+
+// NewSyslogLogger creates a Logger that sends its messages to the local syslog
+// daemon with the daemon facility and the given tag. Debugf, Printf, Warnf and
+// Errorf map to the debug, info, warning and err severities; messages written
+// through the embedded log.Logger are sent as info.
+//
+// Parameters:
+// - tag: The program name syslog records with each message.
+//
+// Returns:
+// - A pointer to a Logger instance.
+// - An error if syslog cannot be reached.
+//
+// Example usage:
+//
+//     logger, err := logger.NewSyslogLogger("couch-revision-purge")
+//     if err != nil {
+//         log.Fatalf("Failed to connect to syslog: %v", err)
+//     }
+//     logger.Warnf("This is logged with the warning severity.")
+//
+func NewSyslogLogger(tag string) (*Logger, error) {
+    writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+    }
+    return &Logger{Logger: log.New(writer, "", 0), level: LevelInfo, sys: writer}, nil
+}
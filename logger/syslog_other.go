@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package logger
+
+import "errors"
+
+// NewSyslogLogger is not supported on this platform, which has no syslog.
+func NewSyslogLogger(tag string) (*Logger, error) {
+    return nil, errors.New("syslog is not supported on this platform")
+}
@@ -1,116 +1,598 @@
 package main
 
 import (
+    "crypto/tls"
+    "encoding/json"
     "flag"
     "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/audit"
     "github.com/pradeep-sanjaya/couch-revision-purge/config"
     "github.com/pradeep-sanjaya/couch-revision-purge/logger"
     "github.com/pradeep-sanjaya/couch-revision-purge/network"
     "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
-    // "github.com/pradeep-sanjaya/couch-revision-purge/pulseapi"
+    "github.com/pradeep-sanjaya/couch-revision-purge/events"
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+    "github.com/pradeep-sanjaya/couch-revision-purge/pulseapi"
     "log"
+    "net"
+    "os"
+    "strings"
+    "time"
 )
 
+// defaultMapFunction selects documents whose revision generation exceeds 100000.
+const defaultMapFunction = "function(doc) { var revGen = parseInt(doc._rev.split(\"-\")[0]); if(revGen > 100000) { emit(doc._id, doc); } }"
+
+// conflictsMapFunction selects every document with deleted conflicts,
+// whatever its revision generation.
+const conflictsMapFunction = "function(doc) { if (doc._deleted_conflicts) { emit(doc._id, doc); } }"
+
+// builtinViews are the extra candidate views that can be selected by name
+// with --view.
+var builtinViews = map[string]string{
+    "conflicts": conflictsMapFunction,
+}
+
+// viewFlags collects the repeatable --view flag.
+type viewFlags []string
+
+func (v *viewFlags) String() string {
+    return strings.Join(*v, ",")
+}
+
+func (v *viewFlags) Set(value string) error {
+    *v = append(*v, value)
+    return nil
+}
+
+// conflictViews returns the only candidate view used with --only-conflicts:
+// the built-in conflicts view.
+func conflictViews() []candidateView {
+    return []candidateView{{name: "conflicts", definition: map[string]interface{}{"map": conflictsMapFunction}}}
+}
+
+// candidateViews builds the views of the rev_filter design document: the
+// high_rev_gen view, with the default map function unless mapFile is given,
+// followed by each of extra, given as name=map-file or a built-in view name.
+func candidateViews(mapFile, reduceFile string, extra viewFlags) ([]candidateView, error) {
+    view := map[string]interface{}{
+        "map": defaultMapFunction,
+    }
+    if mapFile != "" {
+        mapFunc, err := couchdb.LoadViewFunction(mapFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load map function: %v", err)
+        }
+        view["map"] = mapFunc
+    }
+    if reduceFile != "" {
+        reduceFunc, err := couchdb.LoadViewFunction(reduceFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load reduce function: %v", err)
+        }
+        view["reduce"] = reduceFunc
+    }
+
+    views := []candidateView{{name: "high_rev_gen", definition: view}}
+    seenViews := map[string]bool{"high_rev_gen": true}
+    for _, spec := range extra {
+        name, path, hasPath := strings.Cut(spec, "=")
+        if seenViews[name] {
+            return nil, fmt.Errorf("view %s is defined more than once", name)
+        }
+        seenViews[name] = true
+
+        mapFunc, builtin := builtinViews[name]
+        if hasPath {
+            var err error
+            mapFunc, err = couchdb.LoadViewFunction(path)
+            if err != nil {
+                return nil, fmt.Errorf("failed to load map function for view %s: %v", name, err)
+            }
+        } else if !builtin {
+            return nil, fmt.Errorf("unknown view %s; use name=map-file for a custom view", name)
+        }
+        views = append(views, candidateView{name: name, definition: map[string]interface{}{"map": mapFunc}})
+    }
+    return views, nil
+}
+
+// newLogger opens the log target selected by the configuration.
+func newLogger(cfg *config.Config) (*logger.Logger, error) {
+    switch cfg.LogTarget {
+    case "syslog":
+        return logger.NewSyslogLogger("couch-revision-purge")
+    case "stdout":
+        return logger.NewWriterLogger(os.Stdout), nil
+    }
+    return logger.NewLogger(cfg.LogFile)
+}
+
+// newAuditLogger opens the audit trail selected by the configuration, or
+// returns nil if none is.
+func newAuditLogger(cfg *config.Config, clientOpts couchdb.ClientOptions) (audit.Logger, error) {
+    operator := cfg.AuditOperator
+    if operator == "" {
+        operator = audit.DefaultOperator()
+    }
+    switch {
+    case cfg.AuditFile != "":
+        return audit.NewFileLogger(cfg.AuditFile, operator)
+    case cfg.AuditURL != "":
+        return audit.NewDatabaseLogger(couchdb.NewCouchDBClient(cfg.AuditURL, cfg.AuditDatabase, clientOpts), operator)
+    }
+    return nil, nil
+}
+
+// clientOptions builds the CouchDB client options from the configuration.
+func clientOptions(cfg *config.Config) (couchdb.ClientOptions, error) {
+    clientOpts := couchdb.ClientOptions{
+        RequestTimeout: cfg.RequestTimeout.Duration,
+        WriteQuorum:    cfg.WriteQuorum,
+        Gzip:           cfg.Gzip,
+        Socks5Proxy:    cfg.Socks5Proxy,
+
+        MaxResponseBytes: cfg.MaxResponseBytes,
+        LatencyThreshold: cfg.LatencyThreshold.Duration,
+
+        ConditionalDeletes: cfg.ConditionalDeletes,
+    }
+    var err error
+    clientOpts.Protocol, err = couchdb.ParseHTTPProtocol(cfg.HTTPProtocol)
+    if err != nil {
+        return clientOpts, err
+    }
+    if cfg.ClientCertFile != "" {
+        cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+        if err != nil {
+            return clientOpts, fmt.Errorf("failed to load client certificate %s with key %s: %v", cfg.ClientCertFile, cfg.ClientKeyFile, err)
+        }
+        clientOpts.ClientCertificate = &cert
+    }
+    if cfg.CredentialsFile != "" {
+        clientOpts.Username, clientOpts.Password, err = config.LoadCredentials(cfg.CredentialsFile)
+        if err != nil {
+            return clientOpts, fmt.Errorf("failed to load credentials: %v", err)
+        }
+    }
+    return clientOpts, nil
+}
+
 func main() {
+    os.Exit(runMain())
+}
+
+// runMain runs the tool and returns its exit code, one of the exit*
+// constants.
+func runMain() int {
+    if len(os.Args) > 1 && os.Args[1] == "inspect" {
+        if err := runInspect(os.Args[2:]); err != nil {
+            log.Printf("Inspect failed: %v\n", err)
+            return exitFailure
+        }
+        return exitOK
+    }
+    if len(os.Args) > 1 && os.Args[1] == "build-index" {
+        if err := runBuildIndex(os.Args[2:]); err != nil {
+            log.Printf("Build index failed: %v\n", err)
+            return exitFailure
+        }
+        return exitOK
+    }
+
     configFile := flag.String("config", "config.json", "Path to the configuration file")
     dbName := flag.String("dbname", "", "CouchDB database name")
+    requiredFields := flag.String("required-fields", "", "Comma-separated fields a document must have before it is reset")
+    cleanupViews := flag.Bool("cleanup-views", false, "Trigger _view_cleanup after purging to remove index files of the replaced design document")
+    noCompact := flag.Bool("no-compact", false, "Skip database compaction")
+    compactAll := flag.Bool("compact-all", false, "After purging, also trigger compaction of the other databases on each instance that the database allowlist permits and whose fragmentation reaches the compaction threshold, leaving out system databases")
+    compactSystem := flag.Bool("compact-system", false, "With --compact-all, also compact system databases such as _users and _replicator")
+    compactAllConcurrency := flag.Int("compact-all-concurrency", 4, "With --compact-all, the number of databases to trigger compaction on at once")
+    changesRevThreshold := flag.Int("changes-rev-threshold", 0, "Flag documents whose leaf revision count in the _changes feed reaches this value (0 to disable)")
+    mapFile := flag.String("map-file", "", "Path to a JavaScript file with the map function for the high_rev_gen view")
+    reduceFile := flag.String("reduce-file", "", "Path to a JavaScript file with an optional reduce function for the high_rev_gen view")
+    var extraViews viewFlags
+    flag.Var(&extraViews, "view", "Additional candidate view, as name=map-file or the name of a built-in view (conflicts); may be repeated")
+    jsonOutput := flag.Bool("json", false, "Print the document reset results as JSON to stdout")
+    hostsFile := flag.String("hosts", "", "Read CouchDB instances from a hosts file instead of scanning")
+    saveHosts := flag.String("save-hosts", "", "Write the discovered CouchDB instances to a hosts file")
+    deleteConcurrency := flag.Int("delete-concurrency", 1, "Number of conflict revisions of a document to delete in parallel")
+    instanceConcurrency := flag.Int("instance-concurrency", 1, "Number of instances to process in parallel")
+    startJitter := flag.Duration("start-jitter", 0, "Delay the start of each instance, and of each database with --compact-all, by a random time up to this, e.g. 2s, so concurrent workers do not start at once")
+    instanceDelay := flag.Duration("instance-delay", 0, "Pause this long before starting each instance after the first, e.g. 5s")
+    force := flag.Bool("force", false, "Purge even when replication involving the database is active")
+    flushBeforeCompact := flag.Bool("flush-before-compact", false, "Call _ensure_full_commit before compacting on CouchDB 2.x, where writes may still be buffered")
+    quiesceWindow := flag.Duration("quiesce-window", 0, "Only compact once the database's update_seq has not changed for this long, e.g. 30s, skipping compaction if writes do not stop")
+    waitCompaction := flag.Bool("wait-compaction", false, "Wait for compaction to finish, logging its progress")
+    verifyHTTP := flag.Bool("verify-http", false, "While scanning, only keep hosts that answer over HTTP as CouchDB")
+    noColor := flag.Bool("no-color", false, "Do not colorize warnings and errors printed to the terminal")
+    verbose := flag.Bool("verbose", false, "Log every IP address as it is scanned")
+    backupDir := flag.String("backup-dir", "", "Directory to save each database's _security document to before purging")
+    restoreSecurity := flag.String("restore-security", "", "Replace the database's _security document on --restore-host with the contents of this JSON file")
+    restoreHost := flag.String("restore-host", "", "The single instance, host or host:port, whose _security document --restore-security replaces")
+    tombstonesOnly := flag.Bool("tombstones-only", false, "Purge only deleted documents instead of resetting and resolving conflicts")
+    purgeFallback := flag.Bool("purge-fallback", false, "With --tombstones-only, reset the document and delete its conflicts instead on nodes where _purge is disabled")
+    onlyConflicts := flag.Bool("only-conflicts", false, "Only delete the deleted conflicts of documents and the losing revisions of live conflicts, without resetting the document, setting the revs limit or compacting")
+    pageSize := flag.Int("page-size", 1000, "Number of view rows to fetch per query page")
+    sortBySavings := flag.Bool("sort-by-savings", false, "Estimate the bytes freed by removing each document's conflict revisions and handle the largest first within each view page")
+    sinceSeq := flag.String("since-seq", "", "Only handle documents changed after this update sequence; requires a view keyed by document ID")
+    checkpointEvery := flag.Int("checkpoint-every", 0, "With --state-file, save progress at least every this many documents instead of after each --page-size page")
+    stateFile := flag.String("state-file", "", "Record each instance's update sequence here and resume from it on the next run")
+    resetStrategy := flag.String("reset-strategy", "recreate", "How to reset the document: recreate (delete and recreate) or bulk-docs (purge the history and write the current revision back under the same ID, tombstoning the others, replication-safe)")
+    noRecreate := flag.Bool("no-recreate", false, "Delete and purge the document instead of recreating it: the document and its history are gone afterwards, not reset")
+    verify := flag.Bool("verify", false, "Re-read each reset document and check it matches what was written")
+    deleteDatabase := flag.Bool("delete-database", false, "Delete the database on every instance instead of purging; requires confirming the database name")
+    confirmDBName := flag.String("confirm-dbname", "", "Database name confirming --delete-database; prompted for when empty")
+    diffDesign := flag.Bool("diff-design", false, "Log how the rev_filter design document would change on each instance, then stop without changing anything")
+    ensureDB := flag.Bool("ensure-db", false, "Create the database on each instance if it does not exist")
+    logFile := flag.String("logfile", "", "Write the log to this file; overrides logfile in the configuration file")
+    logLevel := flag.String("log-level", "", "Minimum log level (debug, info, warn or error); overrides logLevel in the configuration file")
+    asyncLog := flag.Bool("async-log", false, "Write the log from a background goroutine in batches, for verbose runs with many log messages")
+    quiet := flag.Bool("quiet", false, "Print nothing to stdout unless something fails; progress still goes to the log file")
+    cidr := flag.String("cidr", "", "CIDR range to scan; overrides cidr in the configuration file")
+    cidrFile := flag.String("cidr-file", "", "Scan every CIDR range listed in this file, one per line, instead of a single CIDR")
+    port := flag.String("port", "", "CouchDB port; overrides couchdbPort in the configuration file")
+    eventsJSON := flag.String("events-json", "", "Write newline-delimited JSON progress events to this file or named pipe, or to stdout with -")
+    maxDocs := flag.Int("max-docs", 0, "Maximum number of documents to process per run (0 for no limit)")
     flag.Parse()
 
     if *dbName == "" {
-        log.Fatalf("Database name is required")
-        return
+        log.Printf("Database name is required")
+        return exitConfigError
+    }
+    if *startJitter < 0 {
+        log.Printf("--start-jitter must not be negative, got %s\n", *startJitter)
+        return exitConfigError
+    }
+    if *instanceDelay < 0 {
+        log.Printf("--instance-delay must not be negative, got %s\n", *instanceDelay)
+        return exitConfigError
+    }
+    if *eventsJSON == "-" && *jsonOutput {
+        log.Printf("--events-json - and --json cannot both write to stdout\n")
+        return exitConfigError
+    }
+    if *onlyConflicts && (*tombstonesOnly || *mapFile != "" || *reduceFile != "" || len(extraViews) > 0) {
+        log.Printf("--only-conflicts cannot be combined with --tombstones-only, --map-file, --reduce-file or --view\n")
+        return exitConfigError
+    }
+    if *compactAll && (*noCompact || *onlyConflicts) {
+        log.Printf("--compact-all cannot be combined with --no-compact or --only-conflicts\n")
+        return exitConfigError
+    }
+    if *pageSize < 1 {
+        log.Printf("--page-size must be at least 1, got %d\n", *pageSize)
+        return exitConfigError
+    }
+    if *checkpointEvery < 0 {
+        log.Printf("--checkpoint-every must not be negative, got %d\n", *checkpointEvery)
+        return exitConfigError
+    }
+    if *checkpointEvery > 0 && *stateFile == "" {
+        log.Printf("--checkpoint-every needs --state-file to save progress to\n")
+        return exitConfigError
     }
 
     cfg, err := config.LoadConfig(*configFile)
     if err != nil {
-        log.Fatalf("Failed to load configuration: %v\n", err)
-        return
+        log.Printf("Failed to load configuration: %v\n", err)
+        return exitConfigError
+    }
+    if *cidr != "" {
+        cfg.CIDR = *cidr
+    }
+    cidrs := []string{cfg.CIDR}
+    if *cidrFile != "" {
+        if *cidr != "" {
+            log.Printf("--cidr and --cidr-file cannot both be given\n")
+            return exitConfigError
+        }
+        cidrs, err = network.ReadCIDRFile(*cidrFile)
+        if err != nil {
+            log.Printf("Failed to read CIDR file: %v\n", err)
+            return exitConfigError
+        }
+    }
+    if *port != "" {
+        cfg.CouchDBPort = *port
+    }
+
+    if cidrs[0] == "" || cfg.CouchDBPort == "" || len(cfg.Endpoints()) == 0 {
+        log.Printf("Please provide a valid CIDR, CouchDB port, and API endpoint in the configuration file or with --cidr or --cidr-file and --port.\n")
+        return exitConfigError
     }
 
-    if cfg.CIDR == "" || cfg.CouchDBPort == "" || cfg.APIEndpoint == "" {
-        fmt.Println("Please provide a valid CIDR, CouchDB port, and API endpoint in the configuration file.")
-        return
+    if err := cfg.Validate(); err != nil {
+        log.Printf("Invalid configuration: %v\n", err)
+        return exitConfigError
+    }
+    if cfg.LogTarget == "stdout" {
+        // With the log on stdout, --json output would be mixed into it and
+        // --quiet could not keep stdout quiet
+        if *jsonOutput {
+            log.Printf("--json cannot share stdout with logTarget stdout\n")
+            return exitConfigError
+        }
+        if *quiet {
+            log.Printf("--quiet cannot be combined with logTarget stdout\n")
+            return exitConfigError
+        }
+    }
+    if *logFile != "" {
+        cfg.LogFile = *logFile
+    }
+    if *logLevel != "" {
+        cfg.LogLevel = *logLevel
+    }
+    level := logger.LevelInfo
+    if cfg.LogLevel != "" {
+        level, err = logger.ParseLevel(cfg.LogLevel)
+        if err != nil {
+            log.Printf("Invalid --log-level: %v\n", err)
+            return exitConfigError
+        }
     }
 
-    logger, err := logger.NewLogger(cfg.LogFile)
+    clientOpts, err := clientOptions(cfg)
     if err != nil {
-        log.Fatalf("Failed to open log file: %v\n", err)
+        log.Printf("%v\n", err)
+        return exitConfigError
+    }
+
+    color := !*noColor && logger.ColorEnabled(os.Stderr)
+    logger, err := newLogger(cfg)
+    if err != nil {
+        log.Printf("Failed to open log: %v\n", err)
+        return exitConfigError
+    }
+    logger.SetLevel(level)
+    defer logger.Close()
+    if *asyncLog {
+        logger.SetAsync(1024)
+    }
+    if cfg.LogTarget != "stdout" {
+        logger.SetConsole(os.Stderr, color)
+    }
+    clientOpts.VerifyResets = *verify
+    clientOpts.ResetStrategy, err = couchdb.ParseResetStrategy(*resetStrategy)
+    if err != nil {
+        log.Printf("Invalid --reset-strategy: %v\n", err)
+        return exitConfigError
+    }
+    if *noRecreate {
+        if clientOpts.ResetStrategy != couchdb.ResetRecreate {
+            log.Printf("--no-recreate cannot be combined with --reset-strategy %s\n", *resetStrategy)
+            return exitConfigError
+        }
+        clientOpts.ResetStrategy = couchdb.ResetRemove
+    }
+    if *quiet {
+        clientOpts.Output = logger.Writer()
+    }
+
+    var emitter events.Emitter
+    if *eventsJSON != "" {
+        if *eventsJSON == "-" {
+            if cfg.LogTarget == "stdout" {
+                logger.Errorf("--events-json - cannot share stdout with logTarget stdout")
+                return exitConfigError
+            }
+            // Keep stdout for the event stream alone
+            clientOpts.Output = logger.Writer()
+        }
+        stream, err := events.Open(*eventsJSON)
+        if err != nil {
+            logger.Errorf("Failed to open event stream: %v", err)
+            return exitConfigError
+        }
+        defer stream.Close()
+        emitter = stream
     }
 
     // Use logger for all log output
-    logger.Printf("Starting scan for CIDR: %s", cfg.CIDR)
-    foundInstances := network.ScanNetwork(cfg.CIDR, cfg.CouchDBPort, logger, couchdb.IsCouchDBRunning)
-    logger.Printf("Found %d CouchDB instances on the network.", foundInstances)
+    var instances []string
+    if *hostsFile != "" {
+        instances, err = network.ReadHostsFile(*hostsFile, cfg.CouchDBPort)
+        if err != nil {
+            logger.Errorf("Failed to read hosts file: %v", err)
+            return exitConfigError
+        }
+        logger.Printf("Loaded %d CouchDB instances from %s.", len(instances), *hostsFile)
+    } else {
+        if cfg.Socks5Proxy != "" {
+            logger.Warnf("The network scan does not go through socks5Proxy %s; use --hosts to list nodes only reachable through it.", cfg.Socks5Proxy)
+        }
+        logger.Printf("Starting scan for CIDR: %s", strings.Join(cidrs, ", "))
+        isCouchDBRunning := couchdb.IsCouchDBRunning
+        if cfg.ScanRetries > 0 {
+            isCouchDBRunning = couchdb.NewIsCouchDBRunningWithRetry(cfg.ScanRetries, 200*time.Millisecond)
+        }
+        if *verifyHTTP {
+            isCouchDBRunning = couchdb.NewVerifyingIsCouchDBRunning(isCouchDBRunning, cfg.CouchDBScheme, cfg.CouchDBPathPrefix, clientOpts)
+        }
+        foundIPs := network.ScanNetworks(cidrs, cfg.CouchDBPort, logger, isCouchDBRunning, network.ScanOptions{
+            Verbose: *verbose,
+            Exclude: append(append([]string{}, cfg.ExcludeIPs...), cfg.ExcludeCIDRs...),
+        })
+        logger.Printf("Found %d CouchDB instances on the network.", len(foundIPs))
 
-    foundIPs := network.ScanNetwork(cfg.CIDR, cfg.CouchDBPort, logger, couchdb.IsCouchDBRunning)
+        if *saveHosts != "" {
+            if err := network.WriteHostsFile(*saveHosts, foundIPs, cfg.CouchDBPort); err != nil {
+                logger.Printf("Failed to save hosts file: %v", err)
+            } else {
+                logger.Printf("Saved discovered instances to %s.", *saveHosts)
+            }
+        }
 
-    if len(foundIPs) > 0 {
         for _, ip := range foundIPs {
-            couchdbURL := fmt.Sprintf("http://%s:%s", ip, cfg.CouchDBPort)
-            client := couchdb.NewCouchDBClient(couchdbURL, *dbName)
+            instances = append(instances, net.JoinHostPort(ip, cfg.CouchDBPort))
+        }
+    }
 
-            // Example: Resetting a document by deleting all its revisions and recreating it
-            err := client.ResetDocument(*dbName, logger)
-            if err != nil {
-                logger.Fatalf("Failed to reset document: %v", err)
+    if *deleteDatabase {
+        if err := confirmDatabaseName(*dbName, *confirmDBName, os.Stdin, os.Stderr); err != nil {
+            log.Printf("Not deleting database: %v\n", err)
+            return exitConfigError
+        }
+        failed, err := deleteDatabases(cfg, clientOpts, logger, *dbName, instances)
+        if err != nil {
+            logger.Errorf("Not deleting database: %v", err)
+            return exitConfigError
+        }
+        if failed > 0 {
+            fmt.Fprintf(os.Stderr, "Failed to delete database %s on %d of %d instances\n", *dbName, failed, len(instances))
+            if failed == len(instances) {
+                return exitAllFailed
             }
+            return exitPartialFailure
+        }
+        if len(instances) == 0 {
+            return exitNoInstances
+        }
+        return exitOK
+    }
 
-            // Check and delete the existing design document
-            deleteMsg, err := client.CheckAndDeleteDesignDocument("rev_filter")
-            if err != nil {
-                logger.Fatalf("Failed to check and delete existing design document: %v", err)
-            }
-            logger.Println(deleteMsg)
-
-            designDoc := map[string]interface{}{
-                "views": map[string]interface{}{
-                    "high_rev_gen": map[string]interface{}{
-                        "map": "function(doc) { var revGen = parseInt(doc._rev.split(\"-\")[0]); if(revGen > 100000) { emit(doc._id, doc); } }",
-                    },
-                },
-            }
-            
-            response, err := client.CreateDesignDocument("rev_filter", designDoc)
-            if err != nil {
-                logger.Fatalf("Failed to create design document: %v", err)
-            }
-            logger.Println("Design document created:", response)
+    views, err := candidateViews(*mapFile, *reduceFile, extraViews)
+    if err != nil {
+        log.Printf("%v\n", err)
+        return exitConfigError
+    }
+    if *onlyConflicts {
+        views = conflictViews()
+    }
 
-            // Execute the GET request to query the design document
-            queryResp, err := client.QueryDesignDocument("rev_filter")
-            if err != nil {
-                logger.Fatalf("Failed to query design document: %v", err)
-            }
-            logger.Println("Query result:", queryResp)
+    var compactAllOpts *couchdb.CompactAllOptions
+    if *compactAll {
+        compactAllOpts = &couchdb.CompactAllOptions{
+            Concurrency:   *compactAllConcurrency,
+            IncludeSystem: *compactSystem,
+            Jitter:        *startJitter,
+            Allow:         cfg.AllowsDatabase,
+            Threshold:     cfg.CompactionThreshold,
+            QuiesceWindow: *quiesceWindow,
+        }
+    }
 
-            // Handle the query response to delete conflicts
-            err = client.HandleQueryResponse([]byte(queryResp))
-            if err != nil {
-                logger.Fatalf("Failed to handle query response: %v", err)
-            }
+    var validate couchdb.DocumentValidator
+    if *requiredFields != "" {
+        validate = couchdb.RequireFields(strings.Split(*requiredFields, ",")...)
+    }
 
-            // Trigger database compaction
-            compactResp, err := client.CompactDatabase()
-            if err != nil {
-                logger.Fatalf("Failed to compact database: %v", err)
-            }
-            logger.Println("Database compaction triggered:", compactResp)
+    var security map[string]interface{}
+    restoreInstance := ""
+    if *restoreSecurity != "" {
+        if *restoreHost == "" {
+            logger.Errorf("--restore-security needs --restore-host naming the one instance to restore")
+            return exitConfigError
+        }
+        restoreInstance = *restoreHost
+        if _, _, err := net.SplitHostPort(restoreInstance); err != nil {
+            restoreInstance = net.JoinHostPort(restoreInstance, cfg.CouchDBPort)
+        }
+        content, err := os.ReadFile(*restoreSecurity)
+        if err != nil {
+            logger.Errorf("Failed to read security document: %v", err)
+            return exitConfigError
+        }
+        if err := json.Unmarshal(content, &security); err != nil {
+            logger.Errorf("Failed to parse security document: %v", err)
+            return exitConfigError
         }
+    }
+
+    var state *runState
+    if *stateFile != "" {
+        state, err = loadRunState(*stateFile)
+        if err != nil {
+            logger.Errorf("Failed to read state file: %v", err)
+            return exitConfigError
+        }
+    }
+
+    auditor, err := newAuditLogger(cfg, clientOpts)
+    if err != nil {
+        logger.Errorf("Failed to open audit trail: %v", err)
+        return exitConfigError
+    }
+    if auditor != nil {
+        defer auditor.Close()
+    }
+
+    r := &runner{
+        cfg:                 cfg,
+        logger:              logger,
+        newClient:           couchdb.NewCouchDB,
+        clientOpts:          clientOpts,
+        dbName:              *dbName,
+        maxDocs:             *maxDocs,
+        noCompact:           *noCompact,
+        compactAll:          compactAllOpts,
+        cleanupViews:        *cleanupViews,
+        changesRevThreshold: *changesRevThreshold,
+        validate:            validate,
+        views:               views,
+        concurrency:         *instanceConcurrency,
+        instanceDelay:       *instanceDelay,
+        startJitter:         *startJitter,
+        force:               *force,
+        waitCompaction:      *waitCompaction,
+        backupDir:           *backupDir,
+        restoreSecurity:     security,
+        restoreHost:         restoreInstance,
+        tombstonesOnly:      *tombstonesOnly,
+        onlyConflicts:       *onlyConflicts,
+        purgeFallback:       *purgeFallback,
+        pageSize:            *pageSize,
+        checkpointEvery:     *checkpointEvery,
+        sortBySavings:       *sortBySavings,
+        sinceSeq:            *sinceSeq,
+        state:               state,
+        ensureDB:            *ensureDB,
+        diffDesign:          *diffDesign,
+        audit:               auditor,
+        events:              emitter,
+        flushBeforeCompact:  *flushBeforeCompact,
+        quiesceWindow:       *quiesceWindow,
+        deleteConcurrency:   *deleteConcurrency,
+        summary:             summary.New(),
+    }
+
+    if len(instances) > 0 {
+        r.run(instances)
     } else {
         logger.Println("No CouchDB instances found.")
     }
 
-    // expectedInstances, err := pulseapi.GetCouchDBInstanceCount(cfg.APIEndpoint)
-    // if err != nil {
-    //     logger.Fatalf("Failed to get CouchDB instance count from API: %v", err)
-    // }
-    // logger.Printf("API reports %d CouchDB instances.", expectedInstances)
+    multi, err := pulseapi.GetExpectedInstancesFrom(cfg.Endpoints(), pulseapi.Options{
+        Timeout: cfg.APITimeout.Duration,
+        Retries: cfg.APIRetries,
+        Backoff: time.Second,
+    })
+    if err != nil {
+        logger.Printf("Failed to get expected CouchDB instances from API: %v", err)
+    } else {
+        reconcileInstances(logger, r.summary, instances, multi)
+    }
+
+    report := r.summary.Report()
+    logger.Printf("Run summary: %s", report)
 
-    // if len(foundIPs) == expectedInstances {
-    //     logger.Println("The number of CouchDB instances matches the API report.")
-    // } else {
-    //     logger.Printf("Mismatch: found %d instances, but API reports %d instances.", len(foundIPs), expectedInstances)
-    // }
+    if *jsonOutput {
+        output, err := json.MarshalIndent(report.ResetResults, "", "  ")
+        if err != nil {
+            logger.Printf("Failed to encode reset results: %v", err)
+        } else {
+            fmt.Println(string(output))
+        }
+    }
 
-    logger.Println("Scan completed successfully.")
+    if len(report.Failed) > 0 {
+        for instance, reason := range report.Failed {
+            fmt.Fprintf(os.Stderr, "Instance %s failed: %s\n", instance, reason)
+        }
+        logger.Printf("Scan completed with %d of %d instances failing.", len(report.Failed), len(instances))
+    } else {
+        logger.Println("Scan completed successfully.")
+    }
+    return exitCode(report, len(instances))
 }
\ No newline at end of file
@@ -3,21 +3,69 @@
 package network
 
 import (
+    "bufio"
+    "fmt"
     "net"
+    "os"
+    "strings"
     "sync"
     "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
-    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
 )
 
+// Logger is the subset of logging methods ScanNetwork needs. It is satisfied by
+// both *log.Logger and *logger.Logger.
+type Logger interface {
+    Printf(format string, v ...interface{})
+    Println(v ...interface{})
+    Fatalf(format string, v ...interface{})
+}
+
+// ScanOptions controls optional ScanNetwork behaviour.
+type ScanOptions struct {
+    // Verbose logs every IP as it is scanned, not just the ones where
+    // CouchDB was found.
+    Verbose bool
+
+    // Exclude lists IP addresses and CIDR ranges, such as gateways or the
+    // scanning host itself, that are skipped without being dialed.
+    Exclude []string
+}
+
 // ScanNetwork scans all IPs in the provided CIDR network range for CouchDB instances.
-// It uses goroutines to perform the scan concurrently and returns the number of
+// It uses goroutines to perform the scan concurrently and returns the IPs of the
 // instances found. The IsCouchDBRunning function is passed as a parameter to allow
 // for mocking in tests.
-func ScanNetwork(cidr string, couchDBPort string, logger *logger.Logger, isCouchDBRunning couchdb.IsCouchDBRunningFunc) []string {
-    logger.Printf("Starting concurrent network scan on %s for CouchDB instances on port %s\n", cidr, couchDBPort)
-    ips, err := Hosts(cidr)
-    if err != nil {
-        logger.Fatalf("Error parsing CIDR: %v\n", err)
+func ScanNetwork(cidr string, couchDBPort string, logger Logger, isCouchDBRunning couchdb.IsCouchDBRunningFunc, opts ScanOptions) []string {
+    return ScanNetworks([]string{cidr}, couchDBPort, logger, isCouchDBRunning, opts)
+}
+
+// ScanNetworks scans all IPs in the provided CIDR ranges like ScanNetwork.
+// An address in several overlapping ranges is only scanned, and returned,
+// once.
+func ScanNetworks(cidrs []string, couchDBPort string, logger Logger, isCouchDBRunning couchdb.IsCouchDBRunningFunc, opts ScanOptions) []string {
+    logger.Printf("Starting concurrent network scan on %s for CouchDB instances on port %s\n", strings.Join(cidrs, ", "), couchDBPort)
+    var ips []string
+    seen := make(map[string]bool)
+    for _, cidr := range cidrs {
+        hosts, err := Hosts(cidr)
+        if err != nil {
+            logger.Fatalf("Error parsing CIDR: %v\n", err)
+        }
+        for _, ip := range hosts {
+            if !seen[ip] {
+                seen[ip] = true
+                ips = append(ips, ip)
+            }
+        }
+    }
+    var err error
+    if len(opts.Exclude) > 0 {
+        before := len(ips)
+        ips, err = ExcludeHosts(ips, opts.Exclude)
+        if err != nil {
+            logger.Fatalf("Error parsing exclusions: %v\n", err)
+        }
+        logger.Printf("Excluded %d of %d addresses from the scan\n", before-len(ips), before)
     }
 
     var foundIPs []string
@@ -27,8 +75,10 @@ func ScanNetwork(cidr string, couchDBPort string, logger *logger.Logger, isCouch
     for _, ip := range ips {
         wg.Add(1)
         go func(ip string) {
-            logger.Printf("Scanning IP: %s\n", ip)
             defer wg.Done()
+            if opts.Verbose {
+                logger.Printf("Scanning IP: %s\n", ip)
+            }
             if isCouchDBRunning(ip, couchDBPort) {
                 logger.Printf("CouchDB running on IP: %s\n", ip)
                 mu.Lock()
@@ -45,7 +95,8 @@ func ScanNetwork(cidr string, couchDBPort string, logger *logger.Logger, isCouch
 
 // Hosts generates all possible IP addresses in the given CIDR range.
 // It returns a slice of IP addresses as strings, excluding the network
-// address and broadcast address.
+// address and broadcast address. Ranges with no room for those, such as /31
+// point-to-point links and /32 single hosts, return every address in the range.
 //
 // Example usage:
 //
@@ -66,9 +117,103 @@ func Hosts(cidr string) ([]string, error) {
         ips = append(ips, ip.String())
     }
 
+    ones, bits := ipnet.Mask.Size()
+    if bits-ones <= 1 {
+        return ips, nil
+    }
+
     return ips[1 : len(ips)-1], nil
 }
 
+// ReadCIDRFile reads a file listing one CIDR range per line, such as
+// "10.1.2.0/24". Blank lines and lines starting with # are ignored; a line
+// that is not a valid CIDR is reported with its line number.
+//
+// Example usage:
+//
+//     cidrs, err := ReadCIDRFile("subnets.txt")
+//     if err != nil {
+//         log.Fatalf("Failed to read CIDR file: %v", err)
+//     }
+//
+func ReadCIDRFile(path string) ([]string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var cidrs []string
+    scanner := bufio.NewScanner(file)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if _, _, err := net.ParseCIDR(line); err != nil {
+            return nil, fmt.Errorf("%s:%d: invalid CIDR %q", path, lineNum, line)
+        }
+        cidrs = append(cidrs, line)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if len(cidrs) == 0 {
+        return nil, fmt.Errorf("%s: no CIDR ranges", path)
+    }
+
+    return cidrs, nil
+}
+
+// ExcludeHosts returns the IPs in ips that are not listed in exclude, whose
+// entries are either single IP addresses or CIDR ranges.
+//
+// Example usage:
+//
+//     ips, err := ExcludeHosts(ips, []string{"192.168.1.1", "192.168.1.128/25"})
+//     if err != nil {
+//         log.Fatalf("Invalid exclusion: %v", err)
+//     }
+//
+func ExcludeHosts(ips []string, exclude []string) ([]string, error) {
+    var nets []*net.IPNet
+    for _, entry := range exclude {
+        if strings.Contains(entry, "/") {
+            _, ipnet, err := net.ParseCIDR(entry)
+            if err != nil {
+                return nil, err
+            }
+            nets = append(nets, ipnet)
+            continue
+        }
+        ip := net.ParseIP(entry)
+        if ip == nil {
+            return nil, fmt.Errorf("invalid IP address %q", entry)
+        }
+        bits := 8 * net.IPv6len
+        if ip.To4() != nil {
+            ip, bits = ip.To4(), 8*net.IPv4len
+        }
+        nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+    }
+
+    var kept []string
+    for _, host := range ips {
+        ip := net.ParseIP(host)
+        excluded := false
+        for _, ipnet := range nets {
+            if ip != nil && ipnet.Contains(ip) {
+                excluded = true
+                break
+            }
+        }
+        if !excluded {
+            kept = append(kept, host)
+        }
+    }
+    return kept, nil
+}
+
 // inc increments the IP address to iterate over all addresses in the range.
 //
 // Example usage:
@@ -84,4 +229,89 @@ func inc(ip net.IP) {
             break
         }
     }
-}
\ No newline at end of file
+}
+
+// WriteHostsFile writes the given IPs to path as one "ip:port" entry per line,
+// in the format read back by ReadHostsFile.
+//
+// Example usage:
+//
+//     err := WriteHostsFile("hosts.txt", foundIPs, "5984")
+//
+func WriteHostsFile(path string, ips []string, port string) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    writer := bufio.NewWriter(file)
+    for _, ip := range ips {
+        if _, err := fmt.Fprintln(writer, net.JoinHostPort(ip, port)); err != nil {
+            return err
+        }
+    }
+    return writer.Flush()
+}
+
+// ReadHostsFile reads a hosts file as written by WriteHostsFile and returns its
+// entries as "host:port" strings. Lines holding only an IP address or hostname
+// use defaultPort.
+// Blank lines and lines starting with # are ignored.
+//
+// Example usage:
+//
+//     hosts, err := ReadHostsFile("hosts.txt", "5984")
+//     if err != nil {
+//         log.Fatalf("Failed to read hosts file: %v", err)
+//     }
+//
+func ReadHostsFile(path string, defaultPort string) ([]string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var hosts []string
+    scanner := bufio.NewScanner(file)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        host, port, err := net.SplitHostPort(line)
+        if err != nil {
+            if net.ParseIP(line) == nil && !isHostname(line) {
+                return nil, fmt.Errorf("%s:%d: invalid host entry %q", path, lineNum, line)
+            }
+            host, port = line, defaultPort
+        }
+        hosts = append(hosts, net.JoinHostPort(host, port))
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    return hosts, nil
+}
+
+// isHostname reports whether s is a plain DNS hostname such as "couch-1" or
+// "db.example.com".
+func isHostname(s string) bool {
+    if len(s) > 253 {
+        return false
+    }
+    for _, label := range strings.Split(s, ".") {
+        if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+            return false
+        }
+        for _, c := range label {
+            if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+                return false
+            }
+        }
+    }
+    return true
+}
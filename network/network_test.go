@@ -2,8 +2,14 @@ package network
 
 import (
     "log"
+    "net"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
     "sync"
     "testing"
+    "time"
     "fmt"
 )
 
@@ -51,10 +57,237 @@ func TestScanNetwork(t *testing.T) {
         return ip == "192.168.1.1"
     }
 
-    count := ScanNetwork(cidr, "5984", log.New(logger, "", 0), mockIsCouchDBRunning)
+    foundIPs := ScanNetwork(cidr, "5984", log.New(logger, "", 0), mockIsCouchDBRunning, ScanOptions{})
+    count := len(foundIPs)
     expectedCount := 1
 
     if count != expectedCount {
         t.Errorf("Expected %d CouchDB instances, found %d", expectedCount, count)
     }
-}
\ No newline at end of file
+}
+
+// assertNoGoroutineLeak runs fn and fails the test if more goroutines are
+// running afterwards than before. Goroutines that are finishing are given a
+// moment to exit before the counts are compared.
+func assertNoGoroutineLeak(t *testing.T, fn func()) {
+    t.Helper()
+    before := runtime.NumGoroutine()
+    fn()
+
+    deadline := time.Now().Add(2 * time.Second)
+    after := runtime.NumGoroutine()
+    for after > before && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+        after = runtime.NumGoroutine()
+    }
+    if after > before {
+        buf := make([]byte, 1<<16)
+        t.Errorf("Expected at most %d goroutines after the scan, got %d:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+    }
+}
+
+// TestScanNetworkNoGoroutineLeak scans a /24 in which one host accepts
+// connections and every other dial times out, and checks no goroutine
+// outlives the scan.
+func TestScanNetworkNoGoroutineLeak(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    defer listener.Close()
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            conn.Close()
+        }
+    }()
+
+    // Every host but 10.0.0.1 dials with a deadline that has already passed,
+    // so the dial times out without depending on the test machine's network.
+    isCouchDBRunning := func(ip, port string) bool {
+        dialer := net.Dialer{Deadline: time.Now().Add(-time.Second)}
+        if ip == "10.0.0.1" {
+            dialer.Deadline = time.Time{}
+        }
+        conn, err := dialer.Dial("tcp", listener.Addr().String())
+        if err != nil {
+            return false
+        }
+        conn.Close()
+        return true
+    }
+
+    var foundIPs []string
+    assertNoGoroutineLeak(t, func() {
+        foundIPs = ScanNetwork("10.0.0.0/24", "5984", log.New(&mockLogger{}, "", 0), isCouchDBRunning, ScanOptions{})
+    })
+    if len(foundIPs) != 1 || foundIPs[0] != "10.0.0.1" {
+        t.Errorf("Expected only 10.0.0.1 to be found, got %v", foundIPs)
+    }
+}
+
+// TestHosts verifies that Hosts returns the usable addresses for a range of
+// CIDR sizes, including the /31 and /32 edge cases.
+func TestHosts(t *testing.T) {
+    tests := []struct {
+        cidr     string
+        expected []string
+    }{
+        {"192.168.1.0/30", []string{"192.168.1.1", "192.168.1.2"}},
+        {"192.168.1.0/31", []string{"192.168.1.0", "192.168.1.1"}},
+        {"192.168.1.7/32", []string{"192.168.1.7"}},
+    }
+
+    for _, tt := range tests {
+        ips, err := Hosts(tt.cidr)
+        if err != nil {
+            t.Fatalf("Hosts(%s): expected no error, got %v", tt.cidr, err)
+        }
+        if fmt.Sprint(ips) != fmt.Sprint(tt.expected) {
+            t.Errorf("Hosts(%s): expected %v, got %v", tt.cidr, tt.expected, ips)
+        }
+    }
+
+    ips, err := Hosts("10.0.0.0/24")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if len(ips) != 254 {
+        t.Errorf("Expected 254 hosts in a /24, got %d", len(ips))
+    }
+
+    if _, err := Hosts("not-a-cidr"); err == nil {
+        t.Errorf("Expected an error for an invalid CIDR")
+    }
+}
+
+// TestExcludeHosts checks that single addresses and ranges are both removed.
+func TestExcludeHosts(t *testing.T) {
+    ips, err := Hosts("192.168.1.0/28")
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    kept, err := ExcludeHosts(ips, []string{"192.168.1.1", "192.168.1.8/29"})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    expected := []string{"192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7"}
+    if fmt.Sprint(kept) != fmt.Sprint(expected) {
+        t.Errorf("Expected %v, got %v", expected, kept)
+    }
+
+    if _, err := ExcludeHosts(ips, []string{"not-an-ip"}); err == nil {
+        t.Errorf("Expected an error for an invalid exclusion")
+    }
+}
+
+// TestHostsFileRoundTrip verifies that a hosts file written by WriteHostsFile
+// is read back unchanged by ReadHostsFile.
+func TestHostsFileRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "hosts.txt")
+    if err := WriteHostsFile(path, []string{"192.168.1.1", "192.168.1.2"}, "5984"); err != nil {
+        t.Fatalf("Expected no error writing hosts file, got %v", err)
+    }
+
+    hosts, err := ReadHostsFile(path, "1234")
+    if err != nil {
+        t.Fatalf("Expected no error reading hosts file, got %v", err)
+    }
+
+    expected := []string{"192.168.1.1:5984", "192.168.1.2:5984"}
+    if fmt.Sprint(hosts) != fmt.Sprint(expected) {
+        t.Errorf("Expected %v, got %v", expected, hosts)
+    }
+}
+
+// TestReadHostsFile verifies that bare IPs and hostnames get the default port
+// and that a malformed entry is rejected.
+func TestReadHostsFile(t *testing.T) {
+    tests := []struct {
+        name     string
+        content  string
+        expected []string
+        wantErr  bool
+    }{
+        {"ip", "192.168.1.1\n", []string{"192.168.1.1:5984"}, false},
+        {"ip and port", "192.168.1.1:1234\n", []string{"192.168.1.1:1234"}, false},
+        {"hostname", "# cluster\ncouch-1.example.com\n\n", []string{"couch-1.example.com:5984"}, false},
+        {"hostname and port", "couch-1:1234\n", []string{"couch-1:1234"}, false},
+        {"invalid", "couch 1\n", nil, true},
+        {"invalid label", "-couch.example.com\n", nil, true},
+    }
+
+    for _, tt := range tests {
+        path := filepath.Join(t.TempDir(), "hosts.txt")
+        if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+            t.Fatalf("Failed to write hosts file: %v", err)
+        }
+
+        hosts, err := ReadHostsFile(path, "5984")
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("%s: expected an error, got %v", tt.name, hosts)
+            }
+            continue
+        }
+        if err != nil {
+            t.Fatalf("%s: expected no error, got %v", tt.name, err)
+        }
+        if fmt.Sprint(hosts) != fmt.Sprint(tt.expected) {
+            t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, hosts)
+        }
+    }
+}
+
+// TestScanNetworksOverlap verifies that an address in overlapping CIDR ranges
+// is only scanned and returned once.
+func TestScanNetworksOverlap(t *testing.T) {
+    var mu sync.Mutex
+    scanned := make(map[string]int)
+    isCouchDBRunning := func(ip, port string) bool {
+        mu.Lock()
+        defer mu.Unlock()
+        scanned[ip]++
+        return ip == "10.0.0.2"
+    }
+
+    foundIPs := ScanNetworks([]string{"10.0.0.0/29", "10.0.0.0/30", "10.0.1.0/30"}, "5984", log.New(&mockLogger{}, "", 0), isCouchDBRunning, ScanOptions{})
+    if fmt.Sprint(foundIPs) != "[10.0.0.2]" {
+        t.Errorf("Expected [10.0.0.2], got %v", foundIPs)
+    }
+    if len(scanned) != 8 {
+        t.Errorf("Expected 8 addresses scanned, got %d", len(scanned))
+    }
+    for ip, n := range scanned {
+        if n != 1 {
+            t.Errorf("Expected %s to be scanned once, got %d", ip, n)
+        }
+    }
+}
+
+// TestReadCIDRFile verifies that comments are skipped and an invalid line is
+// reported with its line number.
+func TestReadCIDRFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "cidrs.txt")
+    if err := os.WriteFile(path, []byte("# office\n10.0.0.0/24\n\n10.0.1.0/28\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    cidrs, err := ReadCIDRFile(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if fmt.Sprint(cidrs) != "[10.0.0.0/24 10.0.1.0/28]" {
+        t.Errorf("Expected both ranges, got %v", cidrs)
+    }
+
+    if err := os.WriteFile(path, []byte("10.0.0.0/24\n10.0.1.0\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := ReadCIDRFile(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+        t.Errorf("Expected an error on line 2, got %v", err)
+    }
+}
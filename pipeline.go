@@ -0,0 +1,1076 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    mathrand "math/rand"
+    "github.com/pradeep-sanjaya/couch-revision-purge/audit"
+    "github.com/pradeep-sanjaya/couch-revision-purge/config"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "github.com/pradeep-sanjaya/couch-revision-purge/events"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Strategies recorded in the summary for a --tombstones-only run.
+const (
+    strategyPurge    = "purge"
+    strategyRecreate = "recreate"
+)
+
+// skippedError marks an instance that was deliberately not processed.
+type skippedError struct {
+    reason string
+}
+
+func (e *skippedError) Error() string {
+    return e.reason
+}
+
+// skip returns an error recording that an instance was skipped because of err.
+func skip(err error) error {
+    return &skippedError{reason: err.Error()}
+}
+
+// errDocCountDropped marks an instance whose database lost more documents
+// than maxDocCountDrop allows. It aborts the rest of the run.
+var errDocCountDropped = errors.New("doc_count dropped unexpectedly")
+
+// candidateView is a view of the rev_filter design document whose rows are
+// the documents to delete conflicts from. Each row's value must be the
+// document, including its _deleted_conflicts.
+type candidateView struct {
+    name       string
+    definition map[string]interface{}
+}
+
+// runner holds the settings shared by every instance processed in a run.
+type runner struct {
+    cfg        *config.Config
+    logger     *logger.Logger
+    newClient  couchdb.NewCouchDBFunc
+    clientOpts couchdb.ClientOptions
+
+    // sleep, when set, replaces time.Sleep for the waits between and before
+    // instances.
+    sleep func(time.Duration)
+
+    dbName              string
+    maxDocs             int
+    noCompact           bool
+    compactAll          *couchdb.CompactAllOptions
+    cleanupViews        bool
+    changesRevThreshold int
+    validate            couchdb.DocumentValidator
+    views               []candidateView
+    concurrency         int
+    instanceDelay       time.Duration
+    startJitter         time.Duration
+    force               bool
+    waitCompaction      bool
+    backupDir           string
+    restoreSecurity     map[string]interface{}
+    restoreHost         string
+    tombstonesOnly      bool
+    onlyConflicts       bool
+    purgeFallback       bool
+    pageSize            int
+    checkpointEvery     int
+    sortBySavings       bool
+    sinceSeq            string
+    state               *runState
+    ensureDB            bool
+    diffDesign          bool
+    audit               audit.Logger
+    events              events.Emitter
+    flushBeforeCompact  bool
+    quiesceWindow       time.Duration
+    deleteConcurrency   int
+
+    summary *summary.Summary
+
+    // correlationID identifies the instance being processed in log messages,
+    // events and the X-Correlation-Id header of requests. It is only set on
+    // the copy of the runner made for each instance.
+    correlationID string
+}
+
+// newCorrelationID returns a short random ID.
+func newCorrelationID() string {
+    id := make([]byte, 4)
+    rand.Read(id)
+    return hex.EncodeToString(id)
+}
+
+// forInstance returns a copy of the runner whose log messages, events and
+// requests carry a new correlation ID.
+func (r *runner) forInstance() *runner {
+    instanceRunner := *r
+    instanceRunner.correlationID = newCorrelationID()
+    instanceRunner.logger = r.logger.WithPrefix("[" + instanceRunner.correlationID + "] ")
+    instanceRunner.clientOpts.CorrelationID = instanceRunner.correlationID
+    return &instanceRunner
+}
+
+// processInstance runs the purge pipeline against the CouchDB instance at
+// instance, given as "host:port".
+// Instances that are skipped (database outside safeDBPrefix, incompatible
+// version, in maintenance, missing database or document) return a *skippedError; any other failure is returned
+// as is so the caller can record it and carry on with the next instance. A
+// failure on a node that has gone into maintenance since the run started is
+// also treated as a skip.
+func (r *runner) processInstance(instance string) (err error) {
+    logger := r.logger
+    ip, port, err := net.SplitHostPort(instance)
+    if err != nil {
+        return err
+    }
+    couchdbURL := couchdb.BuildBaseURL(r.cfg.CouchDBScheme, ip, port, r.cfg.CouchDBPathPrefix)
+    if !r.cfg.AllowsDatabase(r.dbName) {
+        return skip(fmt.Errorf("database %s does not start with safeDBPrefix %q", r.dbName, r.cfg.SafeDBPrefix))
+    }
+    client := r.newClient(couchdbURL, r.dbName, r.clientOpts)
+    defer func() {
+        var skipped *skippedError
+        if err == nil || errors.As(err, &skipped) || errors.Is(err, errDocCountDropped) {
+            return
+        }
+        if upErr := client.Up(); errors.Is(upErr, couchdb.ErrMaintenance) {
+            err = skip(fmt.Errorf("%v (%v)", upErr, err))
+        }
+    }()
+
+    version, err := client.ServerVersion()
+    if errors.Is(err, couchdb.ErrNotCouchDB) {
+        return skip(err)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to get server version: %w", err)
+    }
+    if err := couchdb.CheckVersionCompatibility(version); err != nil {
+        return skip(err)
+    }
+    if err := client.Up(); errors.Is(err, couchdb.ErrMaintenance) {
+        return skip(err)
+    } else if err != nil {
+        logger.Printf("Failed to check whether %s is up: %v", instance, err)
+        r.countTimeout(err)
+    }
+    logger.Printf("CouchDB %s running on %s", version, ip)
+    r.emit(events.Event{Type: events.InstanceFound, Instance: instance, Version: version})
+
+    r.checkAuthMode(client, instance)
+
+    setupState, err := client.ClusterSetupState()
+    if err != nil {
+        logger.Printf("Failed to read cluster setup state of %s: %v", instance, err)
+        r.countTimeout(err)
+    } else {
+        r.summary.AddSetupState(instance, setupState)
+        if !couchdb.SetupFinished(setupState) {
+            logger.Warnf("%s has not finished setting up (%s); system databases such as _users may be missing", instance, setupState)
+        }
+    }
+
+    if r.diffDesign {
+        return r.showDesignDiff(client, instance)
+    }
+
+    if r.ensureDB {
+        if err := client.CreateDatabase(); err != nil {
+            return fmt.Errorf("failed to ensure database exists: %w", err)
+        }
+        logger.Printf("Database %s exists on %s", r.dbName, instance)
+    }
+
+    if r.backupDir != "" {
+        if err := r.backupSecurity(client, instance); err != nil {
+            return fmt.Errorf("failed to back up security document: %w", err)
+        }
+    }
+    replications, err := client.ActiveReplications()
+    if errors.Is(err, couchdb.ErrUnauthorized) {
+        logger.Warnf("Cannot determine replication status on %s: %v", instance, err)
+        if !r.force {
+            return skip(fmt.Errorf("replication status of database %s is unknown without admin credentials, use --force to purge anyway", r.dbName))
+        }
+    } else if err != nil {
+        return fmt.Errorf("failed to check replication status: %w", err)
+    }
+    if len(replications) > 0 {
+        for _, replication := range replications {
+            logger.Warnf("Replication %s (%s -> %s) is %s on %s", replication.ID, replication.Source, replication.Target, replication.State, instance)
+        }
+        if !r.force {
+            return skip(fmt.Errorf("%d active replications involve database %s, use --force to purge anyway", len(replications), r.dbName))
+        }
+    }
+
+    // Restore only once every guard has passed, and only on the one
+    // instance the security document was saved from
+    if r.restoreSecurity != nil && instance == r.restoreHost {
+        if err := client.SetSecurity(r.restoreSecurity); err != nil {
+            return fmt.Errorf("failed to restore security document: %w", err)
+        }
+        logger.Printf("Restored security document for %s on %s", r.dbName, instance)
+    }
+
+    if r.changesRevThreshold > 0 {
+        changes, err := client.GetChanges(couchdb.ChangesOptions{AllDocs: true})
+        if err != nil {
+            logger.Printf("Failed to read changes feed: %v", err)
+            r.countTimeout(err)
+        } else {
+            for _, change := range changes.FilterByRevisionCount(r.changesRevThreshold) {
+                logger.Printf("Document %s has %d leaf revisions", change.ID, change.RevisionCount())
+            }
+        }
+    }
+
+    if r.cfg.WarnRevCount > 0 {
+        over, err := client.FindDocsOverRevCount(r.cfg.WarnRevCount, 1000)
+        if err != nil {
+            logger.Printf("Failed to check revision counts: %v", err)
+            r.countTimeout(err)
+        } else {
+            for _, doc := range over {
+                logger.Warnf("Document %s has %d revisions, at or above the %d threshold", doc.ID, doc.Generation, r.cfg.WarnRevCount)
+            }
+            if len(over) > 0 {
+                logger.Warnf("%d documents in %s on %s have at least %d revisions.", len(over), r.dbName, instance, r.cfg.WarnRevCount)
+            }
+            r.summary.AddDocsOverRevCount(len(over))
+        }
+    }
+
+    // Record where this run starts so the next one can resume from here.
+    info, err := client.GetDatabaseInfo()
+    if err != nil {
+        return fmt.Errorf("failed to get database info: %w", err)
+    }
+    startSeq := string(info.UpdateSeq)
+    progress := r.progress(instance)
+    if progress != nil {
+        startSeq = progress.StartSeq
+        logger.Printf("Resuming unfinished run on %s at view %s", instance, progress.View)
+    }
+
+    if limit := r.cfg.RevsLimitFor(r.dbName); limit > 0 && !r.onlyConflicts {
+        if err := client.SetRevsLimit(limit); err != nil {
+            return fmt.Errorf("failed to set revs limit: %w", err)
+        }
+        logger.Printf("Set _revs_limit of %s on %s to %d", r.dbName, instance, limit)
+    }
+
+    // finished is false when --max-docs stopped the run before every
+    // candidate document was handled
+    finished := true
+    if r.tombstonesOnly {
+        strategy := strategyPurge
+        err := r.purgeTombstones(client, instance)
+        if errors.Is(err, couchdb.ErrPurgeDisabled) && r.purgeFallback {
+            logger.Warnf("Falling back to resetting %s on %s: %v", r.dbName, instance, err)
+            strategy = strategyRecreate
+            finished, err = r.purgeRevisions(client, instance, startSeq, nil)
+        }
+        if err != nil {
+            return err
+        }
+        r.summary.AddStrategy(instance, strategy)
+    } else {
+        finished, err = r.purgeRevisions(client, instance, startSeq, progress)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Check before compacting, while what was lost can still be recovered
+    if err := r.checkDocCount(client, instance, info.DocCount); err != nil {
+        return err
+    }
+
+    // Only move the recorded sequence on once every document was handled;
+    // otherwise keep it and the saved progress, so the next run continues
+    // with the documents the limit cut off
+    if r.state != nil && finished {
+        if err := r.state.Save(instance, startSeq); err != nil {
+            logger.Printf("Failed to save run state: %v", err)
+        }
+    }
+
+    if r.onlyConflicts {
+        logger.Println("Skipping compaction (--only-conflicts).")
+    } else {
+        if err := r.compact(client, instance, version); err != nil {
+            return err
+        }
+        if r.compactAll != nil {
+            compacted, err := client.CompactAll(*r.compactAll, logger)
+            logger.Printf("Triggered compaction of %d databases on %s", compacted, instance)
+            if err != nil {
+                return fmt.Errorf("failed to compact all databases: %w", err)
+            }
+        }
+    }
+
+    if r.cleanupViews {
+        // Remove index files left behind by the replaced design document
+        cleanupResp, err := client.CleanupViews()
+        if err != nil {
+            return fmt.Errorf("failed to clean up views: %w", err)
+        }
+        logger.Println("View cleanup triggered:", cleanupResp)
+    }
+    return nil
+}
+
+// checkAuthMode warns when the credentials given, or their absence, do not
+// suit how instance treats anonymous requests.
+func (r *runner) checkAuthMode(client couchdb.CouchDB, instance string) {
+    mode, err := client.DetectAuthMode()
+    if err != nil {
+        r.logger.Printf("Failed to detect authentication mode of %s: %v", instance, err)
+        r.countTimeout(err)
+        return
+    }
+    hasCredentials := r.clientOpts.Username != ""
+    switch {
+    case mode == couchdb.AuthAdminParty && hasCredentials:
+        r.logger.Warnf("%s is in admin party and does not need the credentials from credentialsFile; it accepts admin requests from anyone", instance)
+    case mode == couchdb.AuthRequired && !hasCredentials:
+        r.logger.Warnf("%s requires authentication but no credentials were given; set credentialsFile, or admin-only steps such as reading replication status will fail", instance)
+    default:
+        r.logger.Debugf("Authentication mode of %s: %s", instance, mode)
+    }
+}
+
+// checkDocCount compares the doc_count of the database with before, its
+// value when processing started, and fails with errDocCountDropped if more
+// documents are gone than maxDocCountDrop allows. The document removed by
+// --no-recreate is expected to go; tombstone purges and conflict deletions do
+// not change doc_count.
+func (r *runner) checkDocCount(client couchdb.CouchDB, instance string, before int) error {
+    if r.cfg.MaxDocCountDrop <= 0 || before == 0 {
+        return nil
+    }
+    info, err := client.GetDatabaseInfo()
+    if err != nil {
+        return fmt.Errorf("failed to get database info: %w", err)
+    }
+    expected := 0
+    if r.clientOpts.ResetStrategy == couchdb.ResetRemove && !r.onlyConflicts {
+        expected = 1
+    }
+    dropped := before - info.DocCount - expected
+    r.logger.Debugf("doc_count of %s on %s went from %d to %d", r.dbName, instance, before, info.DocCount)
+    if float64(dropped) <= r.cfg.MaxDocCountDrop*float64(before) {
+        return nil
+    }
+    err = fmt.Errorf("%w: %s on %s went from %d to %d documents, more than the %.1f%% maxDocCountDrop allows",
+        errDocCountDropped, r.dbName, instance, before, info.DocCount, r.cfg.MaxDocCountDrop*100)
+    r.logger.Errorf("POSSIBLE DATA LOSS: %v. Aborting the run before compaction; check the database before running again.", err)
+    return err
+}
+
+// showDesignDiff logs how the rev_filter design document on instance differs
+// from the one a run would install, and skips the instance without writing
+// anything.
+func (r *runner) showDesignDiff(client couchdb.CouchDB, instance string) error {
+    existing, err := client.GetDesignDocument("rev_filter")
+    if err != nil && !errors.Is(err, couchdb.ErrNotFound) {
+        return fmt.Errorf("failed to fetch existing design document: %w", err)
+    }
+    diff := couchdb.DiffDesignDocuments(existing, r.designDoc())
+    for _, change := range diff {
+        r.logger.Printf("Design document rev_filter on %s: %s", instance, change)
+    }
+    if len(diff) == 0 {
+        r.logger.Printf("Design document rev_filter on %s is unchanged", instance)
+    }
+    return skip(errors.New("--diff-design given, nothing changed"))
+}
+
+// designDoc returns the rev_filter design document holding the candidate
+// views.
+func (r *runner) designDoc() map[string]interface{} {
+    return designDocument(r.views)
+}
+
+// designDocument returns a design document holding views.
+func designDocument(views []candidateView) map[string]interface{} {
+    definitions := make(map[string]interface{}, len(views))
+    for _, view := range views {
+        definitions[view.name] = view.definition
+    }
+    return map[string]interface{}{
+        "views": definitions,
+    }
+}
+
+// designDigest returns a digest of designDoc, to tell whether a design
+// document recorded in the state file is the one a run would install.
+func designDigest(designDoc map[string]interface{}) string {
+    content, _ := json.Marshal(designDoc)
+    sum := sha256.Sum256(content)
+    return hex.EncodeToString(sum[:])
+}
+
+// since returns the sequence to resume instance from: the one recorded in the
+// state file, else --since-seq. An empty result means a full run.
+func (r *runner) since(instance string) string {
+    if r.state != nil {
+        if seq := r.state.Since(instance); seq != "" {
+            return seq
+        }
+    }
+    return r.sinceSeq
+}
+
+// progress returns where an unfinished run on instance got to, or nil if
+// there is none to resume. Progress recorded for a tombstone purge or from a
+// different starting sequence is ignored.
+func (r *runner) progress(instance string) *runProgress {
+    if r.state == nil || r.tombstonesOnly {
+        return nil
+    }
+    progress := r.state.Progress(instance)
+    if progress == nil || progress.Since != r.since(instance) {
+        return nil
+    }
+    for _, view := range r.views {
+        if view.name == progress.View {
+            return progress
+        }
+    }
+    return nil
+}
+
+// saveProgress records progress for instance in the state file, if there is
+// one.
+func (r *runner) saveProgress(instance string, progress runProgress) {
+    if r.state == nil {
+        return
+    }
+    if err := r.state.SaveProgress(instance, progress); err != nil {
+        r.logger.Printf("Failed to save run state: %v", err)
+    }
+}
+
+// purgeRevisions resets the target document, unless --only-conflicts was
+// given, and deletes the conflicts of the documents selected by the candidate
+// views. A document selected by several
+// views is only handled once. Progress through the views is saved after each
+// page against startSeq; a non-nil progress continues an unfinished run. It
+// reports whether every candidate document was handled, which is not the case
+// when the --max-docs limit stopped it.
+func (r *runner) purgeRevisions(client couchdb.CouchDB, instance, startSeq string, progress *runProgress) (bool, error) {
+    logger := r.logger
+    designDoc := r.designDoc()
+    digest := designDigest(designDoc)
+
+    // A design document recorded by an earlier run with the same views is
+    // only revalidated, not fetched again, if it is still there unchanged
+    if r.state != nil {
+        if etag, recorded := r.state.Design(instance); etag != "" && recorded == digest {
+            client.RememberDesignDocument("rev_filter", etag, designDoc)
+        }
+    }
+    existing, err := client.GetDesignDocument("rev_filter")
+    if err != nil && !errors.Is(err, couchdb.ErrNotFound) {
+        return false, fmt.Errorf("failed to fetch existing design document: %w", err)
+    }
+    designDiff := couchdb.DiffDesignDocuments(existing, designDoc)
+    for _, change := range designDiff {
+        logger.Debugf("Design document rev_filter on %s: %s", instance, change)
+    }
+
+    if !r.onlyConflicts {
+        // Example: Resetting a document by deleting all its revisions and recreating it
+        resetResult, err := client.ResetDocument(r.dbName, logger, r.validate)
+        resetResult.Instance = instance
+        r.summary.AddResetResult(resetResult)
+        if errors.Is(err, couchdb.ErrNotFound) {
+            return false, skip(err)
+        }
+        if err != nil {
+            return false, fmt.Errorf("failed to reset document: %w", err)
+        }
+        action, eventType := audit.ActionReset, events.DocReset
+        if resetResult.Removed {
+            action, eventType = audit.ActionRemove, events.DocRemoved
+        }
+        r.recordAudit(audit.Record{Instance: instance, DocID: r.dbName, Action: action, RevisionsAffected: resetResult.RevisionsDeleted})
+        r.emit(events.Event{Type: eventType, Instance: instance, DocID: r.dbName})
+    }
+
+    if existing != nil && len(designDiff) == 0 {
+        // Keep the design document, and the index already built for it
+        logger.Println("Design document rev_filter is unchanged, not reinstalling it")
+    } else {
+        // Check and delete the existing design document
+        deleteMsg, err := client.CheckAndDeleteDesignDocument("rev_filter")
+        if err != nil {
+            return false, fmt.Errorf("failed to check and delete existing design document: %w", err)
+        }
+        logger.Println(deleteMsg)
+
+        response, err := client.CreateDesignDocument("rev_filter", designDoc)
+        if err != nil {
+            return false, fmt.Errorf("failed to create design document: %w", err)
+        }
+        logger.Println("Design document created:", response)
+    }
+    if r.state != nil {
+        if etag := client.DesignDocumentETag("rev_filter"); etag != "" {
+            if err := r.state.SaveDesign(instance, etag, digest); err != nil {
+                logger.Printf("Failed to save run state: %v", err)
+            }
+        }
+    }
+
+    handleOpts := couchdb.HandleOptions{
+        MinGenerationAge: r.cfg.ConflictMinGenerationAge,
+        SortBySavings:    r.sortBySavings,
+        Seen:             make(map[string]bool),
+
+        DeleteConcurrency: r.deleteConcurrency,
+    }
+
+    var changedIDs []string
+    since := r.since(instance)
+    if since != "" {
+        changedIDs, err = r.changedSince(client, since)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    conflictsFailed := 0
+    limited := false
+    for i, view := range r.views {
+        bookmark := ""
+        if progress != nil {
+            if view.name != progress.View {
+                continue
+            }
+            bookmark = progress.Bookmark
+            progress = nil
+        }
+        checkpoint := func(bookmark string) {
+            r.logger.Debugf("Checkpoint on %s: view %s at %s", instance, view.name, bookmark)
+            r.saveProgress(instance, runProgress{StartSeq: startSeq, Since: since, View: view.name, Bookmark: bookmark})
+        }
+
+        var handled couchdb.HandleResult
+        if since != "" {
+            handled, err = r.handleKeys(client, instance, view.name, changedIDs, bookmark, handleOpts, checkpoint)
+        } else {
+            handled, err = r.handleView(client, instance, view.name, bookmark, handleOpts, checkpoint)
+        }
+        conflictsFailed += handled.ConflictsFailed
+        if err != nil {
+            return false, err
+        }
+        if handled.LimitReached {
+            logger.Printf("Reached --max-docs limit of %d, stopping.", r.maxDocs)
+            limited = true
+            break
+        }
+        if i+1 < len(r.views) {
+            r.saveProgress(instance, runProgress{StartSeq: startSeq, Since: since, View: r.views[i+1].name})
+        }
+    }
+
+    if r.onlyConflicts && !limited {
+        // The conflicts view only selects deleted conflicts; resolve the
+        // live ones too
+        handled, err := r.resolveLiveConflicts(client, instance, handleOpts)
+        conflictsFailed += handled.ConflictsFailed
+        if err != nil {
+            return false, err
+        }
+        if handled.LimitReached {
+            logger.Printf("Reached --max-docs limit of %d, stopping.", r.maxDocs)
+            limited = true
+        }
+    }
+
+    if conflictsFailed > 0 {
+        return false, fmt.Errorf("failed to delete %d conflict revisions", conflictsFailed)
+    }
+    return !limited, nil
+}
+
+// remainingDocs sets handleOpts.MaxDocs to what is left of --max-docs and
+// reports whether the limit has been reached.
+func (r *runner) remainingDocs(handleOpts *couchdb.HandleOptions) bool {
+    if r.maxDocs <= 0 {
+        return false
+    }
+    handleOpts.MaxDocs = r.maxDocs - r.summary.DocsHandled()
+    return handleOpts.MaxDocs <= 0
+}
+
+// handlePage deletes the conflicts of the documents in one page of view rows
+// and adds what was done to total.
+func (r *runner) handlePage(client couchdb.CouchDB, instance, viewName, queryResp string, handleOpts couchdb.HandleOptions, total *couchdb.HandleResult) error {
+    r.logger.Debugf("Query result for %s: %s", viewName, queryResp)
+
+    handled, err := client.HandleQueryResponse([]byte(queryResp), handleOpts)
+    r.recordHandled(instance, handled)
+    total.DocsHandled += handled.DocsHandled
+    total.ConflictsDeleted += handled.ConflictsDeleted
+    total.ConflictsFailed += handled.ConflictsFailed
+    total.ConflictsKept += handled.ConflictsKept
+    total.DocsChanged += handled.DocsChanged
+    total.TimedOut += handled.TimedOut
+    total.LimitReached = handled.LimitReached
+    if err != nil {
+        return fmt.Errorf("failed to handle query response: %w", err)
+    }
+    r.logger.Printf("Processed %d documents from %s: deleted %d conflict revisions, failed to delete %d, kept %d recent ones, skipped %d changed documents.",
+        handled.DocsHandled, viewName, handled.ConflictsDeleted, handled.ConflictsFailed, handled.ConflictsKept, handled.DocsChanged)
+    return nil
+}
+
+// recordHandled adds what one page or pass of conflict deletion did on
+// instance to the summary, the audit trail and the event stream.
+func (r *runner) recordHandled(instance string, handled couchdb.HandleResult) {
+    r.summary.AddDocsHandled(handled.DocsHandled)
+    r.summary.AddConflicts(handled.ConflictsDeleted, handled.ConflictsFailed)
+    r.summary.AddTimeouts(handled.TimedOut)
+    for docID, revs := range handled.DeletedRevisions {
+        r.recordAudit(audit.Record{Instance: instance, DocID: docID, Action: audit.ActionDeleteConflicts, Revisions: revs, RevisionsAffected: len(revs)})
+        r.emit(events.Event{Type: events.RevisionDeleted, Instance: instance, DocID: docID, Revisions: revs})
+    }
+}
+
+// resolveLiveConflicts deletes the losing revisions of every document with
+// live conflicts on instance, found through _all_docs rather than the
+// candidate views. LimitReached in the result tells whether the --max-docs
+// limit stopped it.
+func (r *runner) resolveLiveConflicts(client couchdb.CouchDB, instance string, handleOpts couchdb.HandleOptions) (couchdb.HandleResult, error) {
+    if r.remainingDocs(&handleOpts) {
+        return couchdb.HandleResult{LimitReached: true}, nil
+    }
+    handled, err := client.ResolveConflicts(r.pageSize, handleOpts)
+    r.recordHandled(instance, handled)
+    if err != nil {
+        return handled, fmt.Errorf("failed to resolve live conflicts: %w", err)
+    }
+    r.logger.Printf("Resolved live conflicts of %d documents: deleted %d losing revisions, failed to delete %d, kept %d recent ones, skipped %d changed documents.",
+        handled.DocsHandled, handled.ConflictsDeleted, handled.ConflictsFailed, handled.ConflictsKept, handled.DocsChanged)
+    return handled, nil
+}
+
+// handleRows handles one page of view rows, queryResp, and adds what was done
+// to total. With --checkpoint-every the rows are handled that many at a time,
+// and checkpoint is called with the position of the last row of each batch but
+// the final one, so progress is saved within large pages too.
+func (r *runner) handleRows(client couchdb.CouchDB, instance, viewName, queryResp string, handleOpts couchdb.HandleOptions, total *couchdb.HandleResult, position func(couchdb.ViewRow) (string, error), checkpoint func(string)) error {
+    if r.checkpointEvery <= 0 {
+        return r.handlePage(client, instance, viewName, queryResp, handleOpts, total)
+    }
+    var page couchdb.QueryResponse
+    if err := json.Unmarshal([]byte(queryResp), &page); err != nil {
+        return fmt.Errorf("failed to handle query response: %w", err)
+    }
+    if len(page.Rows) <= r.checkpointEvery {
+        return r.handlePage(client, instance, viewName, queryResp, handleOpts, total)
+    }
+
+    rows := page.Rows
+    for start := 0; start < len(rows); start += r.checkpointEvery {
+        end := start + r.checkpointEvery
+        if end > len(rows) {
+            end = len(rows)
+        }
+        if r.remainingDocs(&handleOpts) {
+            total.LimitReached = true
+            return nil
+        }
+        page.Rows = rows[start:end]
+        batch, err := json.Marshal(page)
+        if err != nil {
+            return err
+        }
+        if err := r.handlePage(client, instance, viewName, string(batch), handleOpts, total); err != nil || total.LimitReached {
+            return err
+        }
+        if end < len(rows) {
+            next, err := position(rows[end-1])
+            if err != nil {
+                return err
+            }
+            checkpoint(next)
+        }
+    }
+    return nil
+}
+
+// handleView pages through the view from bookmark, deleting the conflicts of
+// each page, and returns the totals over all pages. checkpoint is called with
+// the bookmark of the next page after each page is handled.
+func (r *runner) handleView(client couchdb.CouchDB, instance, viewName, bookmark string, handleOpts couchdb.HandleOptions, checkpoint func(string)) (couchdb.HandleResult, error) {
+    var total couchdb.HandleResult
+    for {
+        if r.remainingDocs(&handleOpts) {
+            total.LimitReached = true
+            return total, nil
+        }
+
+        queryResp, next, err := client.QueryDesignDocumentPage("rev_filter", viewName, r.pageSize, bookmark)
+        if err != nil {
+            return total, fmt.Errorf("failed to query design document: %w", err)
+        }
+
+        if err := r.handleRows(client, instance, viewName, queryResp, handleOpts, &total, couchdb.RowBookmark, checkpoint); err != nil || total.LimitReached {
+            return total, err
+        }
+
+        if next == "" {
+            return total, nil
+        }
+        checkpoint(next)
+        bookmark = next
+    }
+}
+
+// changedSince returns the IDs of the documents changed after since, leaving
+// out design documents.
+func (r *runner) changedSince(client couchdb.CouchDB, since string) ([]string, error) {
+    changes, err := client.GetChanges(couchdb.ChangesOptions{Since: since})
+    if err != nil {
+        return nil, fmt.Errorf("failed to read changes feed: %w", err)
+    }
+    var ids []string
+    for _, change := range changes.Results {
+        if !strings.HasPrefix(change.ID, "_design/") {
+            ids = append(ids, change.ID)
+        }
+    }
+    r.logger.Printf("Resuming from sequence %s: %d documents changed since.", since, len(ids))
+    return ids, nil
+}
+
+// handleKeys handles only the view rows of the documents in ids, looked up
+// by key, and returns the totals. It assumes the view is keyed by document ID,
+// as the default map function is. A non-empty after skips the IDs up to and
+// including it; checkpoint is called with the last ID of each page handled.
+func (r *runner) handleKeys(client couchdb.CouchDB, instance, viewName string, ids []string, after string, handleOpts couchdb.HandleOptions, checkpoint func(string)) (couchdb.HandleResult, error) {
+    var total couchdb.HandleResult
+    first := 0
+    if after != "" {
+        for i, id := range ids {
+            if id == after {
+                first = i + 1
+                break
+            }
+        }
+    }
+    for start := first; start < len(ids); start += r.pageSize {
+        end := start + r.pageSize
+        if end > len(ids) {
+            end = len(ids)
+        }
+        if r.remainingDocs(&handleOpts) {
+            total.LimitReached = true
+            return total, nil
+        }
+
+        queryResp, err := client.QueryDesignDocumentKeys("rev_filter", viewName, ids[start:end])
+        if err != nil {
+            return total, fmt.Errorf("failed to query design document: %w", err)
+        }
+
+        rowID := func(row couchdb.ViewRow) (string, error) { return row.ID, nil }
+        if err := r.handleRows(client, instance, viewName, queryResp, handleOpts, &total, rowID, checkpoint); err != nil || total.LimitReached {
+            return total, err
+        }
+        if end < len(ids) {
+            checkpoint(ids[end-1])
+        }
+    }
+    return total, nil
+}
+
+// purgeTombstones purges every deleted document in the database, leaving live
+// documents untouched.
+func (r *runner) purgeTombstones(client couchdb.CouchDB, instance string) error {
+    deleted, err := client.FindDeletedDocuments(1000)
+    if err != nil {
+        return fmt.Errorf("failed to find deleted documents: %w", err)
+    }
+    r.logger.Printf("Found %d deleted documents in %s on %s", len(deleted), r.dbName, instance)
+
+    batch := make(map[string][]string)
+    flush := func() error {
+        if len(batch) == 0 {
+            return nil
+        }
+        purgeResp, err := client.PurgeDocuments(batch)
+        if err != nil {
+            return fmt.Errorf("failed to purge deleted documents: %w", err)
+        }
+        r.summary.AddDocsHandled(len(purgeResp.Purged))
+        for docID, revs := range purgeResp.Purged {
+            r.recordAudit(audit.Record{Instance: instance, DocID: docID, Action: audit.ActionPurge, Revisions: revs, RevisionsAffected: len(revs)})
+            r.emit(events.Event{Type: events.DocPurged, Instance: instance, DocID: docID, Revisions: revs})
+        }
+        r.logger.Printf("Purged %d deleted documents", len(purgeResp.Purged))
+        batch = make(map[string][]string)
+        return nil
+    }
+
+    for docID, revs := range deleted {
+        if r.maxDocs > 0 && r.summary.DocsHandled()+len(batch) >= r.maxDocs {
+            r.logger.Printf("Reached --max-docs limit of %d, stopping.", r.maxDocs)
+            break
+        }
+        batch[docID] = revs
+        if len(batch) >= 100 {
+            if err := flush(); err != nil {
+                return err
+            }
+        }
+    }
+    return flush()
+}
+
+// countTimeout counts err in the summary if it is a timeout that was logged
+// rather than failing the instance.
+func (r *runner) countTimeout(err error) {
+    if couchdb.IsTimeout(err) {
+        r.summary.AddTimeouts(1)
+    }
+}
+
+// recordAudit writes rec, for the run's database, to the audit trail if one
+// is configured. The action has already happened, so a failure to record it
+// is logged rather than returned.
+func (r *runner) recordAudit(rec audit.Record) {
+    if r.audit == nil {
+        return
+    }
+    rec.Database = r.dbName
+    if err := r.audit.Log(rec); err != nil {
+        r.logger.Errorf("Failed to record %s of %s on %s in the audit trail: %v", rec.Action, rec.DocID, rec.Instance, err)
+    }
+}
+
+// emit sends ev, for the run's database, to the event stream if one is
+// configured. Like the audit trail, a failure to send it is only logged.
+func (r *runner) emit(ev events.Event) {
+    if r.events == nil {
+        return
+    }
+    ev.Database = r.dbName
+    ev.CorrelationID = r.correlationID
+    if err := r.events.Emit(ev); err != nil {
+        r.logger.Errorf("Failed to emit %s event for %s: %v", ev.Type, ev.Instance, err)
+    }
+}
+
+// compact triggers compaction unless --no-compact was given.
+// Compaction itself is skipped when the database is less fragmented than the
+// configured threshold. With --flush-before-compact, servers older than 3.0
+// are first asked to flush the purge to disk.
+func (r *runner) compact(client couchdb.CouchDB, instance, version string) error {
+    logger := r.logger
+
+    if r.noCompact {
+        logger.Println("Skipping compaction (--no-compact).")
+        return nil
+    }
+
+    if r.flushBeforeCompact {
+        if couchdb.NeedsFullCommit(version) {
+            if err := client.EnsureFullCommit(); err != nil {
+                return fmt.Errorf("failed to flush database before compaction: %w", err)
+            }
+            logger.Printf("Flushed %s on %s to disk.", r.dbName, instance)
+        } else {
+            logger.Debugf("CouchDB %s commits every write, no flush needed before compaction.", version)
+        }
+    }
+
+    needed, ratio, err := client.NeedsCompaction(r.cfg.CompactionThreshold)
+    if err != nil {
+        return fmt.Errorf("failed to check fragmentation: %w", err)
+    }
+    r.summary.AddFragmentation(instance, ratio)
+    if needed {
+        logger.Printf("Database fragmentation is %.1f%%.", ratio*100)
+        if r.quiesceWindow > 0 {
+            err := client.WaitForQuiescence(r.quiesceWindow)
+            if errors.Is(err, couchdb.ErrNotQuiescent) {
+                logger.Warnf("Skipping compaction of %s on %s: %v", r.dbName, instance, err)
+                return nil
+            }
+            if err != nil {
+                return fmt.Errorf("failed to wait for writes to stop: %w", err)
+            }
+        }
+        if err := r.compactDatabase(client, instance); err != nil {
+            return err
+        }
+    } else {
+        logger.Printf("Skipping compaction: fragmentation %.1f%% is below the %.1f%% threshold.", ratio*100, r.cfg.CompactionThreshold*100)
+    }
+
+    return nil
+}
+
+// defaultCompactionMaxWait bounds --wait-compaction when compactionMaxWait is
+// not configured.
+const defaultCompactionMaxWait = time.Hour
+
+// compactDatabase triggers compaction and, with --wait-compaction, waits for it
+// to finish.
+func (r *runner) compactDatabase(client couchdb.CouchDB, instance string) error {
+    logger := r.logger
+
+    // Trigger database compaction
+    compactResp, err := client.CompactDatabase()
+    if err != nil {
+        return fmt.Errorf("failed to compact database: %w", err)
+    }
+    logger.Println("Database compaction triggered:", compactResp)
+    r.emit(events.Event{Type: events.CompactionStarted, Instance: instance})
+
+    if r.waitCompaction {
+        maxWait := r.cfg.CompactionMaxWait.Duration
+        if maxWait == 0 {
+            maxWait = defaultCompactionMaxWait
+        }
+        if err := client.WaitForCompaction(5*time.Second, maxWait, logger); err != nil {
+            return fmt.Errorf("failed to monitor compaction: %w", err)
+        }
+        logger.Println("Database compaction finished.")
+        r.emit(events.Event{Type: events.CompactionFinished, Instance: instance})
+    }
+
+    return nil
+}
+
+// backupSecurity writes the database's _security document for instance to a
+// JSON file in r.backupDir.
+func (r *runner) backupSecurity(client couchdb.CouchDB, instance string) error {
+    security, err := client.GetSecurity()
+    if err != nil {
+        return err
+    }
+
+    content, err := json.MarshalIndent(security, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    name := strings.NewReplacer(":", "_", "/", "_").Replace(instance + "_" + r.dbName + "_security.json")
+    path := filepath.Join(r.backupDir, name)
+    if err := os.WriteFile(path, content, 0600); err != nil {
+        return err
+    }
+    r.logger.Printf("Saved security document for %s on %s to %s", r.dbName, instance, path)
+    return nil
+}
+
+// run processes the instances, up to r.concurrency at a time, recording the
+// outcome of each in the runner's summary. With more than one worker the
+// --max-docs limit is checked as each instance starts, so concurrent
+// instances may overshoot it slightly. r.instanceDelay is waited before each
+// instance after the first is started, and each instance also waits a random
+// time up to r.startJitter before starting. Once the run is aborted, as when an
+// instance fails the doc_count check, no further instances are started.
+func (r *runner) run(instances []string) {
+    concurrency := r.concurrency
+    if concurrency < 1 {
+        concurrency = 1
+    }
+
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, concurrency)
+
+    for i, instance := range instances {
+        if r.maxDocs > 0 && r.summary.DocsHandled() >= r.maxDocs {
+            r.logger.Printf("Reached --max-docs limit of %d, skipping remaining instances.", r.maxDocs)
+            break
+        }
+
+        sem <- struct{}{}
+        if reason := r.summary.Aborted(); reason != "" {
+            <-sem
+            r.logger.Errorf("Run aborted, skipping remaining instances: %s", reason)
+            break
+        }
+        if i > 0 && r.instanceDelay > 0 {
+            // Give the nodes a pause between instances
+            r.pause(r.instanceDelay)
+        }
+        wg.Add(1)
+        go func(instance string) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            if delay := jitterDelay(r.startJitter); delay > 0 {
+                // Spread out workers starting together
+                r.pause(delay)
+            }
+            r.runInstance(instance)
+        }(instance)
+    }
+
+    wg.Wait()
+}
+
+// jitterDelay returns a random delay in [0, max), or zero if max is not
+// positive.
+func jitterDelay(max time.Duration) time.Duration {
+    if max <= 0 {
+        return 0
+    }
+    return time.Duration(mathrand.Int63n(int64(max)))
+}
+
+// pause waits for d, with r.sleep if it is set.
+func (r *runner) pause(d time.Duration) {
+    if r.sleep != nil {
+        r.sleep(d)
+        return
+    }
+    time.Sleep(d)
+}
+
+// runInstance processes a single instance and records its outcome. Its log
+// messages, events and requests share a correlation ID.
+func (r *runner) runInstance(instance string) {
+    r = r.forInstance()
+    r.logger.Debugf("Processing %s with correlation ID %s", instance, r.correlationID)
+    err := r.processInstance(instance)
+    var skipped *skippedError
+    switch {
+    case errors.As(err, &skipped):
+        r.logger.Warnf("Skipping %s: %v", instance, err)
+        r.summary.AddSkipped(instance, skipped.reason)
+        r.emit(events.Event{Type: events.InstanceFinished, Instance: instance, Status: events.StatusSkipped, Message: skipped.reason})
+    case err != nil:
+        r.logger.Errorf("Instance %s failed: %v", instance, err)
+        r.summary.AddFailure(instance, err)
+        if errors.Is(err, errDocCountDropped) {
+            r.summary.Abort(err.Error())
+        }
+        r.emit(events.Event{Type: events.InstanceFinished, Instance: instance, Status: events.StatusFailed, Message: err.Error()})
+    default:
+        r.summary.AddSuccess(instance)
+        r.emit(events.Event{Type: events.InstanceFinished, Instance: instance, Status: events.StatusSucceeded})
+    }
+}
@@ -0,0 +1,920 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/pradeep-sanjaya/couch-revision-purge/config"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "github.com/pradeep-sanjaya/couch-revision-purge/events"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+)
+
+// fakeCouchDB is an in-memory couchdb.CouchDB that records the calls made to it.
+type fakeCouchDB struct {
+    version   string
+    resetErr  error
+    upErr     error
+    purgeErr  error
+    replErr   error
+    compacted bool
+    cleaned   bool
+    revsLimit int
+    deleted   map[string][]string
+    purged    []int
+    updateSeq string
+
+    // nextPage maps a view page bookmark to the bookmark of the page after
+    // it; queried records the bookmarks asked for and limits the page sizes.
+    // Querying failPage fails.
+    nextPage map[string]string
+    failPage string
+    queried  []string
+    limits   []int
+
+    // pageRows is the number of rows each view page holds. handled counts
+    // the calls to HandleQueryResponse, and the failHandle-th one fails.
+    pageRows   int
+    handled    int
+    failHandle int
+
+    // writes records the writes other than purging made to the database.
+    writes []string
+
+    // compactedAll records that CompactAll was called.
+    compactedAll bool
+
+    // docCounts are the doc_count values GetDatabaseInfo returns, in turn.
+    docCounts []int
+
+    // quiesceErr is returned by WaitForQuiescence.
+    quiesceErr error
+
+    // design is the rev_filter design document on the instance, or nil, and
+    // designETag its ETag. designPuts counts the design documents created and
+    // remembered is the ETag last handed to RememberDesignDocument.
+    design     map[string]interface{}
+    designETag string
+    designPuts int
+    remembered string
+
+    // resolved records that ResolveConflicts was called.
+    resolved bool
+}
+
+func (f *fakeCouchDB) ServerVersion() (string, error) { return f.version, nil }
+
+func (f *fakeCouchDB) ActiveReplications() ([]couchdb.Replication, error) { return nil, f.replErr }
+
+func (f *fakeCouchDB) GetChanges(opts couchdb.ChangesOptions) (*couchdb.ChangesResponse, error) {
+    return &couchdb.ChangesResponse{}, nil
+}
+
+func (f *fakeCouchDB) ResetDocument(docID string, logger *logger.Logger, validate couchdb.DocumentValidator) (*couchdb.ResetResult, error) {
+    result := &couchdb.ResetResult{DocID: docID, Recreated: f.resetErr == nil}
+    if f.resetErr != nil {
+        result.Error = f.resetErr.Error()
+    }
+    return result, f.resetErr
+}
+
+func (f *fakeCouchDB) CheckAndDeleteDesignDocument(designDocName string) (string, error) {
+    return "deleted", nil
+}
+
+func (f *fakeCouchDB) CreateDesignDocument(designDocName string, designDoc map[string]interface{}) (string, error) {
+    f.designPuts++
+    f.design = designDoc
+    f.designETag = fmt.Sprintf(`"%d-abc"`, f.designPuts)
+    return "created", nil
+}
+
+func (f *fakeCouchDB) QueryDesignDocument(designDocName string) (string, error) {
+    return `{"rows": []}`, nil
+}
+
+func (f *fakeCouchDB) QueryDesignDocumentPage(designDocName, viewName string, limit int, bookmark string) (string, string, error) {
+    f.queried = append(f.queried, bookmark)
+    f.limits = append(f.limits, limit)
+    if f.failPage != "" && bookmark == f.failPage {
+        return "", "", errors.New("connection reset")
+    }
+    rows := make([]string, f.pageRows)
+    for i := range rows {
+        rows[i] = fmt.Sprintf(`{"id": "doc%d", "key": "doc%d", "value": null}`, i+1, i+1)
+    }
+    return `{"rows": [` + strings.Join(rows, ",") + `]}`, f.nextPage[bookmark], nil
+}
+
+func (f *fakeCouchDB) BuildIndex(designDocName, viewName string) error { return nil }
+
+func (f *fakeCouchDB) QueryDesignDocumentKeys(designDocName, viewName string, keys []string) (string, error) {
+    return `{"rows": []}`, nil
+}
+
+func (f *fakeCouchDB) HandleQueryResponse(queryResponse []byte, opts couchdb.HandleOptions) (couchdb.HandleResult, error) {
+    f.handled++
+    if f.handled == f.failHandle {
+        return couchdb.HandleResult{}, errors.New("connection reset")
+    }
+    return couchdb.HandleResult{DocsHandled: 1}, nil
+}
+
+func (f *fakeCouchDB) ResolveConflicts(pageSize int, opts couchdb.HandleOptions) (couchdb.HandleResult, error) {
+    f.resolved = true
+    return couchdb.HandleResult{DocsHandled: 2, ConflictsDeleted: 3, DeletedRevisions: map[string][]string{"doc1": {"2-b", "3-c"}, "doc2": {"2-x"}}}, nil
+}
+
+func (f *fakeCouchDB) CompactDatabase() (string, error) {
+    f.compacted = true
+    return "compacted", nil
+}
+
+func (f *fakeCouchDB) CompactAll(opts couchdb.CompactAllOptions, logger *logger.Logger) (int, error) {
+    f.compactedAll = true
+    return 1, nil
+}
+
+func (f *fakeCouchDB) WaitForCompaction(interval, maxWait time.Duration, logger *logger.Logger) error {
+    return nil
+}
+
+func (f *fakeCouchDB) WaitForQuiescence(window time.Duration) error { return f.quiesceErr }
+
+func (f *fakeCouchDB) NeedsCompaction(threshold float64) (bool, float64, error) {
+    return true, 0.5, nil
+}
+
+func (f *fakeCouchDB) GetDatabaseInfo() (*couchdb.DatabaseInfo, error) {
+    info := &couchdb.DatabaseInfo{UpdateSeq: "42"}
+    if f.updateSeq != "" {
+        info.UpdateSeq = couchdb.Seq(f.updateSeq)
+    }
+    if len(f.docCounts) > 0 {
+        info.DocCount = f.docCounts[0]
+        f.docCounts = f.docCounts[1:]
+    }
+    return info, nil
+}
+
+func (f *fakeCouchDB) CreateDatabase() error {
+    f.writes = append(f.writes, "create")
+    return nil
+}
+
+func (f *fakeCouchDB) EnsureFullCommit() error { return nil }
+
+func (f *fakeCouchDB) GetDesignDocument(designDocName string) (map[string]interface{}, error) {
+    if f.design == nil {
+        return nil, couchdb.ErrNotFound
+    }
+    return f.design, nil
+}
+
+func (f *fakeCouchDB) DesignDocumentETag(designDocName string) string { return f.designETag }
+
+func (f *fakeCouchDB) RememberDesignDocument(designDocName, etag string, designDoc map[string]interface{}) {
+    f.remembered = etag
+}
+
+func (f *fakeCouchDB) ClusterSetupState() (string, error) { return "single_node_finished", nil }
+
+func (f *fakeCouchDB) Up() error { return f.upErr }
+
+func (f *fakeCouchDB) DetectAuthMode() (couchdb.AuthMode, error) { return couchdb.AuthRequired, nil }
+
+func (f *fakeCouchDB) SetRevsLimit(limit int) error {
+    f.writes = append(f.writes, "revs_limit")
+    f.revsLimit = limit
+    return nil
+}
+
+func (f *fakeCouchDB) CleanupViews() (string, error) {
+    f.cleaned = true
+    return "cleaned", nil
+}
+
+func (f *fakeCouchDB) GetSecurity() (map[string]interface{}, error) {
+    return map[string]interface{}{}, nil
+}
+
+func (f *fakeCouchDB) SetSecurity(security map[string]interface{}) error {
+    f.writes = append(f.writes, "security")
+    return nil
+}
+
+func (f *fakeCouchDB) FindDeletedDocuments(pageSize int) (map[string][]string, error) {
+    if f.deleted == nil {
+        return map[string][]string{}, nil
+    }
+    return f.deleted, nil
+}
+
+func (f *fakeCouchDB) FindDocsOverRevCount(threshold, pageSize int) ([]couchdb.DocRevCount, error) {
+    return nil, nil
+}
+
+func (f *fakeCouchDB) PurgeDocuments(revs map[string][]string) (*couchdb.PurgeResponse, error) {
+    if f.purgeErr != nil {
+        return nil, f.purgeErr
+    }
+    f.purged = append(f.purged, len(revs))
+    return &couchdb.PurgeResponse{Purged: revs}, nil
+}
+
+// newTestRunner returns a runner whose clients are looked up in fakes by base URL.
+func newTestRunner(t *testing.T, fakes map[string]*fakeCouchDB) *runner {
+    log, err := logger.NewLogger(filepath.Join(t.TempDir(), "test.log"))
+    if err != nil {
+        t.Fatalf("Failed to create logger: %v", err)
+    }
+
+    return &runner{
+        cfg:    &config.Config{},
+        logger: log,
+        newClient: func(baseURL, dbName string, opts couchdb.ClientOptions) couchdb.CouchDB {
+            return fakes[baseURL]
+        },
+        dbName:   "testdb",
+        views:    []candidateView{{name: "high_rev_gen", definition: map[string]interface{}{"map": defaultMapFunction}}},
+        pageSize: 100,
+        summary:  summary.New(),
+    }
+}
+
+// TestRunnerRecordsOutcomes runs the pipeline against a healthy, an
+// incompatible, a missing and a failing instance and checks each outcome is
+// recorded without stopping the run.
+func TestRunnerRecordsOutcomes(t *testing.T) {
+    healthy := &fakeCouchDB{version: "3.3.3"}
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": healthy,
+        "http://10.0.0.2:5984": {version: "1.7.2"},
+        "http://10.0.0.3:5984": {version: "3.3.3", resetErr: couchdb.ErrNotFound},
+        "http://10.0.0.4:5984": {version: "3.3.3", resetErr: errors.New("boom")},
+    }
+
+    r := newTestRunner(t, fakes)
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984", "10.0.0.3:5984", "10.0.0.4:5984"})
+
+    report := r.summary.Report()
+    if len(report.Succeeded) != 1 || len(report.Skipped) != 2 || len(report.Failed) != 1 {
+        t.Errorf("Expected 1 succeeded, 2 skipped and 1 failed, got %s", report)
+    }
+    if !healthy.compacted {
+        t.Errorf("Expected the healthy instance to be compacted")
+    }
+}
+
+// recordingEmitter keeps the events emitted to it.
+type recordingEmitter struct {
+    events []events.Event
+}
+
+func (e *recordingEmitter) Emit(ev events.Event) error {
+    e.events = append(e.events, ev)
+    return nil
+}
+
+// TestRunnerEmitsEvents checks the events emitted for a purged and a skipped
+// instance.
+func TestRunnerEmitsEvents(t *testing.T) {
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": {version: "3.3.3"},
+        "http://10.0.0.2:5984": {version: "1.7.2"},
+    }
+    emitter := &recordingEmitter{}
+    r := newTestRunner(t, fakes)
+    r.events = emitter
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984"})
+
+    var got []string
+    for _, ev := range emitter.events {
+        if ev.Database != "testdb" {
+            t.Errorf("Expected events for testdb, got %+v", ev)
+        }
+        got = append(got, ev.Type+":"+ev.Instance+":"+ev.Status)
+    }
+    want := []string{
+        "instance_found:10.0.0.1:5984:",
+        "doc_reset:10.0.0.1:5984:",
+        "compaction_started:10.0.0.1:5984:",
+        "instance_finished:10.0.0.1:5984:succeeded",
+        "instance_finished:10.0.0.2:5984:skipped",
+    }
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("Expected events %v, got %v", want, got)
+    }
+}
+
+// TestRunnerCorrelationID checks that each instance gets its own correlation
+// ID, shared by its client and its events.
+func TestRunnerCorrelationID(t *testing.T) {
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": {version: "3.3.3"},
+        "http://10.0.0.2:5984": {version: "3.3.3"},
+    }
+    emitter := &recordingEmitter{}
+    r := newTestRunner(t, fakes)
+    r.events = emitter
+    clientIDs := make(map[string]string)
+    r.newClient = func(baseURL, dbName string, opts couchdb.ClientOptions) couchdb.CouchDB {
+        clientIDs[baseURL] = opts.CorrelationID
+        return fakes[baseURL]
+    }
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984"})
+
+    eventIDs := make(map[string]string)
+    for _, ev := range emitter.events {
+        if id, seen := eventIDs[ev.Instance]; seen && id != ev.CorrelationID {
+            t.Errorf("Expected one correlation ID for %s, got %s and %s", ev.Instance, id, ev.CorrelationID)
+        }
+        eventIDs[ev.Instance] = ev.CorrelationID
+    }
+    first, second := eventIDs["10.0.0.1:5984"], eventIDs["10.0.0.2:5984"]
+    if first == "" || first == second {
+        t.Errorf("Expected distinct correlation IDs, got %q and %q", first, second)
+    }
+    if clientIDs["http://10.0.0.1:5984"] != first || clientIDs["http://10.0.0.2:5984"] != second {
+        t.Errorf("Expected the clients to send the instances' correlation IDs, got %v", clientIDs)
+    }
+}
+
+// TestRunnerSavesState checks that a successful instance's starting update
+// sequence is written to the state file and read back on the next run.
+func TestRunnerSavesState(t *testing.T) {
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": {version: "3.3.3"},
+    }
+    path := filepath.Join(t.TempDir(), "state.json")
+
+    r := newTestRunner(t, fakes)
+    state, err := loadRunState(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    r.state = state
+    r.run([]string{"10.0.0.1:5984"})
+
+    reloaded, err := loadRunState(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if since := reloaded.Since("10.0.0.1:5984"); since != "42" {
+        t.Errorf("Expected sequence 42, got %q", since)
+    }
+}
+
+// TestRunnerKeepsUnchangedDesign checks that a design document already
+// holding the candidate views is not deleted and created again, and that its
+// ETag is recorded in the state file and handed back on the next run.
+func TestRunnerKeepsUnchangedDesign(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3"}
+    path := filepath.Join(t.TempDir(), "state.json")
+
+    for i := 0; i < 2; i++ {
+        r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+        state, err := loadRunState(path)
+        if err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        r.state = state
+        r.run([]string{"10.0.0.1:5984"})
+    }
+
+    if fake.designPuts != 1 {
+        t.Errorf("Expected the design document to be created once, got %d", fake.designPuts)
+    }
+    if fake.remembered != `"1-abc"` {
+        t.Errorf("Expected the recorded ETag to be handed back, got %q", fake.remembered)
+    }
+    state, err := loadRunState(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if etag, _ := state.Design("10.0.0.1:5984"); etag != `"1-abc"` {
+        t.Errorf("Expected ETag \"1-abc\" in the state file, got %q", etag)
+    }
+}
+
+// TestRunnerSetsRevsLimit checks that a database's own revs limit takes
+// precedence over the default.
+func TestRunnerSetsRevsLimit(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3"}
+    fakes := map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake}
+
+    r := newTestRunner(t, fakes)
+    r.cfg.DefaultRevsLimit = 1000
+    r.run([]string{"10.0.0.1:5984"})
+    if fake.revsLimit != 1000 {
+        t.Errorf("Expected the default revs limit 1000, got %d", fake.revsLimit)
+    }
+
+    r.cfg.RevsLimits = map[string]int{"testdb": 50}
+    r.run([]string{"10.0.0.1:5984"})
+    if fake.revsLimit != 50 {
+        t.Errorf("Expected revs limit 50 for testdb, got %d", fake.revsLimit)
+    }
+}
+
+// TestRunnerOnlyConflicts checks that --only-conflicts handles the candidate
+// views and resolves live conflicts without resetting the document, setting
+// the revs limit or compacting.
+func TestRunnerOnlyConflicts(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3", resetErr: errors.New("reset attempted")}
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.onlyConflicts = true
+    r.views = conflictViews()
+    r.cfg.DefaultRevsLimit = 1000
+    r.run([]string{"10.0.0.1:5984"})
+
+    report := r.summary.Report()
+    if len(report.Succeeded) != 1 {
+        t.Fatalf("Expected the instance to succeed, got %s", report)
+    }
+    if !fake.resolved || report.DocsHandled != 3 || report.ConflictsDeleted != 3 {
+        t.Errorf("Expected the conflicts view and the live conflicts to be handled, got %d documents and %d conflicts", report.DocsHandled, report.ConflictsDeleted)
+    }
+    if fake.compacted || fake.revsLimit != 0 {
+        t.Errorf("Expected no compaction or revs limit, got compacted %v and revs limit %d", fake.compacted, fake.revsLimit)
+    }
+}
+
+// TestRunnerSkipsMaintenance checks that a node in maintenance mode is
+// skipped, whether it is found so at the start or after a failure.
+func TestRunnerSkipsMaintenance(t *testing.T) {
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": {version: "3.3.3", upErr: couchdb.ErrMaintenance},
+        "http://10.0.0.2:5984": {version: "3.3.3"},
+    }
+    r := newTestRunner(t, fakes)
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984"})
+
+    report := r.summary.Report()
+    if len(report.Skipped) != 1 || len(report.Succeeded) != 1 {
+        t.Fatalf("Expected 1 skipped and 1 succeeded, got %s", report)
+    }
+    if fakes["http://10.0.0.1:5984"].compacted {
+        t.Errorf("Expected the node in maintenance to be left alone")
+    }
+
+    // A node that fails while in maintenance is skipped, not failed.
+    fake := &fakeCouchDB{version: "3.3.3", resetErr: errors.New("503 Service Unavailable")}
+    r = newTestRunner(t, nil)
+    r.newClient = func(baseURL, dbName string, opts couchdb.ClientOptions) couchdb.CouchDB {
+        return &maintenanceAfterReset{fake}
+    }
+    r.run([]string{"10.0.0.1:5984"})
+    report = r.summary.Report()
+    if len(report.Skipped) != 1 || len(report.Failed) != 0 {
+        t.Errorf("Expected the failure in maintenance to be skipped, got %s", report)
+    }
+}
+
+// maintenanceAfterReset is a fakeCouchDB that goes into maintenance once
+// ResetDocument has been called.
+type maintenanceAfterReset struct {
+    *fakeCouchDB
+}
+
+func (f *maintenanceAfterReset) ResetDocument(docID string, logger *logger.Logger, validate couchdb.DocumentValidator) (*couchdb.ResetResult, error) {
+    f.upErr = couchdb.ErrMaintenance
+    return f.fakeCouchDB.ResetDocument(docID, logger, validate)
+}
+
+// TestRunnerSafeDBPrefix checks that a database outside safeDBPrefix is
+// skipped without being touched.
+func TestRunnerSafeDBPrefix(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3"}
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.cfg.SafeDBPrefix = "sandbox_"
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Skipped) != 1 || fake.compacted {
+        t.Errorf("Expected testdb to be skipped untouched, got %s", report)
+    }
+
+    r = newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.cfg.SafeDBPrefix = "sandbox_"
+    r.dbName = "sandbox_testdb"
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Succeeded) != 1 {
+        t.Errorf("Expected sandbox_testdb to be purged, got %s", report)
+    }
+}
+
+// TestRunnerDocCountDrop checks that an unexpected drop in doc_count fails
+// the instance before compaction and aborts the rest of the run.
+func TestRunnerDocCountDrop(t *testing.T) {
+    first := &fakeCouchDB{version: "3.3.3", docCounts: []int{1000, 500}}
+    second := &fakeCouchDB{version: "3.3.3"}
+    r := newTestRunner(t, map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": first,
+        "http://10.0.0.2:5984": second,
+    })
+    r.cfg.MaxDocCountDrop = 0.1
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984"})
+    report := r.summary.Report()
+    if len(report.Failed) != 1 || report.Aborted == "" {
+        t.Fatalf("Expected a failed instance and an aborted run, got %s", report)
+    }
+    if first.compacted || second.compacted || len(report.Succeeded) != 0 {
+        t.Errorf("Expected nothing compacted or processed after the drop, got %s", report)
+    }
+
+    // A drop within the threshold passes
+    fake := &fakeCouchDB{version: "3.3.3", docCounts: []int{1000, 950}}
+    r = newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.cfg.MaxDocCountDrop = 0.1
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Succeeded) != 1 || report.Aborted != "" {
+        t.Errorf("Expected a drop of 5%% to pass, got %s", report)
+    }
+}
+
+// TestRunnerQuiesceWindow checks that compaction is skipped, without failing
+// the instance, when the database does not stop being written to.
+func TestRunnerQuiesceWindow(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3", quiesceErr: couchdb.ErrNotQuiescent}
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.quiesceWindow = time.Second
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Succeeded) != 1 || fake.compacted {
+        t.Errorf("Expected success without compaction, got %s (compacted %v)", report, fake.compacted)
+    }
+
+    fake.quiesceErr = nil
+    r.run([]string{"10.0.0.1:5984"})
+    if !fake.compacted {
+        t.Errorf("Expected compaction once the database is quiescent")
+    }
+}
+
+// TestRunnerCompactAll checks that every database is only compacted with
+// --compact-all.
+func TestRunnerCompactAll(t *testing.T) {
+    for _, compactAll := range []bool{false, true} {
+        fake := &fakeCouchDB{version: "3.3.3"}
+        r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+        if compactAll {
+            r.compactAll = &couchdb.CompactAllOptions{Concurrency: 2}
+        }
+        r.run([]string{"10.0.0.1:5984"})
+        if fake.compactedAll != compactAll {
+            t.Errorf("compact-all %v: expected CompactAll called %v, got %v", compactAll, compactAll, fake.compactedAll)
+        }
+    }
+}
+
+// TestRunnerCleanupViews checks that view cleanup only runs with
+// --cleanup-views.
+func TestRunnerCleanupViews(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3"}
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.run([]string{"10.0.0.1:5984"})
+    if fake.cleaned {
+        t.Errorf("Expected no view cleanup without --cleanup-views")
+    }
+
+    r.cleanupViews = true
+    r.run([]string{"10.0.0.1:5984"})
+    if !fake.cleaned {
+        t.Errorf("Expected view cleanup with --cleanup-views")
+    }
+}
+
+// TestRunnerUnknownReplicationStatus checks that an instance whose
+// replication status cannot be read is skipped unless --force is given.
+func TestRunnerUnknownReplicationStatus(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3", replErr: fmt.Errorf("replication status: %w", couchdb.ErrUnauthorized)}
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Skipped) != 1 {
+        t.Errorf("Expected the instance to be skipped, got %s", report)
+    }
+
+    r = newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.force = true
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Succeeded) != 1 {
+        t.Errorf("Expected the instance to succeed with --force, got %s", report)
+    }
+}
+
+// TestRunnerPurgeTombstones checks that deleted documents are purged in
+// batches of 100 and that --max-docs stops the purge part way through.
+func TestRunnerPurgeTombstones(t *testing.T) {
+    deleted := make(map[string][]string)
+    for i := 0; i < 250; i++ {
+        deleted[fmt.Sprintf("doc%d", i)] = []string{"2-a"}
+    }
+
+    tests := []struct {
+        maxDocs  int
+        expected []int
+    }{
+        {0, []int{100, 100, 50}},
+        {120, []int{100, 20}},
+    }
+
+    for _, tt := range tests {
+        fake := &fakeCouchDB{version: "3.3.3", deleted: deleted}
+        r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+        r.maxDocs = tt.maxDocs
+
+        if err := r.purgeTombstones(fake, "10.0.0.1:5984"); err != nil {
+            t.Fatalf("Expected no error, got %v", err)
+        }
+        if fmt.Sprint(fake.purged) != fmt.Sprint(tt.expected) {
+            t.Errorf("max-docs %d: expected batches %v, got %v", tt.maxDocs, tt.expected, fake.purged)
+        }
+    }
+}
+
+// TestRunnerPurgeFallback checks that a tombstone purge on a node with _purge
+// disabled fails unless --purge-fallback is given, in which case the document
+// is reset instead and the strategy recorded.
+func TestRunnerPurgeFallback(t *testing.T) {
+    for _, fallback := range []bool{false, true} {
+        fake := &fakeCouchDB{version: "3.3.3", deleted: map[string][]string{"doc1": {"2-a"}}, purgeErr: couchdb.ErrPurgeDisabled}
+        r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+        r.tombstonesOnly = true
+        r.purgeFallback = fallback
+        r.run([]string{"10.0.0.1:5984"})
+
+        report := r.summary.Report()
+        if !fallback {
+            if len(report.Failed) != 1 {
+                t.Errorf("Expected the instance to fail without --purge-fallback, got %s", report)
+            }
+            continue
+        }
+        if len(report.Succeeded) != 1 || len(report.ResetResults) != 1 {
+            t.Errorf("Expected the document to be reset instead, got %s", report)
+        }
+        if report.Strategies["10.0.0.1:5984"] != "recreate" {
+            t.Errorf("Expected the recreate strategy to be recorded, got %v", report.Strategies)
+        }
+    }
+}
+
+// TestRunnerResumesFromPage interrupts a run part way through a view and
+// checks that the next run continues from the last saved page and records
+// the sequence the interrupted run started from.
+func TestRunnerResumesFromPage(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3", nextPage: map[string]string{"": "p2", "p2": "p3"}, failPage: "p3"}
+    path := filepath.Join(t.TempDir(), "state.json")
+
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    state, err := loadRunState(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    r.state = state
+    r.run([]string{"10.0.0.1:5984"})
+
+    reloaded, err := loadRunState(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    progress := reloaded.Progress("10.0.0.1:5984")
+    if progress == nil || progress.Bookmark != "p3" || progress.StartSeq != "42" {
+        t.Fatalf("Expected progress at page p3 from sequence 42, got %+v", progress)
+    }
+
+    fake.failPage = ""
+    fake.queried = nil
+    fake.updateSeq = "50"
+    r = newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.state = reloaded
+    r.run([]string{"10.0.0.1:5984"})
+
+    if fmt.Sprint(fake.queried) != "[p3]" {
+        t.Errorf("Expected only page p3 to be queried, got %v", fake.queried)
+    }
+    if reloaded.Progress("10.0.0.1:5984") != nil {
+        t.Errorf("Expected progress to be cleared after the run completed")
+    }
+    if since := reloaded.Since("10.0.0.1:5984"); since != "42" {
+        t.Errorf("Expected sequence 42, got %q", since)
+    }
+}
+
+// TestRunnerMaxDocsKeepsState checks that a run stopped by --max-docs keeps
+// its progress instead of recording its sequence, so the next run handles the
+// documents the limit cut off.
+func TestRunnerMaxDocsKeepsState(t *testing.T) {
+    // Each page of the fake view holds one candidate document
+    fake := &fakeCouchDB{version: "3.3.3", nextPage: map[string]string{"": "p2"}}
+    state, err := loadRunState(filepath.Join(t.TempDir(), "state.json"))
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.state = state
+    r.maxDocs = 1
+    r.run([]string{"10.0.0.1:5984"})
+
+    if since := state.Since("10.0.0.1:5984"); since != "" {
+        t.Errorf("Expected no sequence recorded after hitting the limit, got %q", since)
+    }
+    if progress := state.Progress("10.0.0.1:5984"); progress == nil || progress.Bookmark != "p2" {
+        t.Fatalf("Expected progress at the second document, got %+v", progress)
+    }
+
+    fake.queried = nil
+    r = newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.state = state
+    r.maxDocs = 1
+    r.run([]string{"10.0.0.1:5984"})
+    if fmt.Sprint(fake.queried) != "[p2]" {
+        t.Errorf("Expected the second document to be handled, got queries %v", fake.queried)
+    }
+    if report := r.summary.Report(); report.DocsHandled != 1 {
+        t.Errorf("Expected 1 document handled, got %d", report.DocsHandled)
+    }
+    if since := state.Since("10.0.0.1:5984"); since != "42" || state.Progress("10.0.0.1:5984") != nil {
+        t.Errorf("Expected sequence 42 recorded once every document was handled, got %q", since)
+    }
+}
+
+// TestRunnerCheckpointEvery checks that --checkpoint-every saves progress
+// TestRunnerCheckpointEvery checks that --checkpoint-every saves progress
+// within a page, every that many rows, without changing the page size.
+func TestRunnerCheckpointEvery(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3", nextPage: map[string]string{"": "p2"}, pageRows: 25, failHandle: 3}
+    state, err := loadRunState(filepath.Join(t.TempDir(), "state.json"))
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.state = state
+    r.checkpointEvery = 10
+    r.run([]string{"10.0.0.1:5984"})
+
+    if fmt.Sprint(fake.limits) != "[100]" {
+        t.Errorf("Expected pages of 100 rows, got %v", fake.limits)
+    }
+    if fake.handled != 3 {
+        t.Errorf("Expected the page to be handled in batches of 10 rows, got %d batches", fake.handled)
+    }
+    // The third batch failed, so the run resumes after the 20th row
+    want, err := couchdb.RowBookmark(couchdb.ViewRow{ID: "doc20", Key: json.RawMessage(`"doc20"`)})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if progress := state.Progress("10.0.0.1:5984"); progress == nil || progress.Bookmark != want {
+        t.Errorf("Expected progress after doc20, got %+v", progress)
+    }
+}
+
+// TestLoadRunStateBareSequence checks that state files holding a bare
+// sequence per instance are still read.
+func TestLoadRunStateBareSequence(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state.json")
+    if err := os.WriteFile(path, []byte(`{"10.0.0.1:5984": "17-abc"}`), 0644); err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    state, err := loadRunState(path)
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if since := state.Since("10.0.0.1:5984"); since != "17-abc" {
+        t.Errorf("Expected sequence 17-abc, got %q", since)
+    }
+}
+
+// TestRunnerDiffDesignWritesNothing checks that --diff-design stops before
+// any write, even with options that would otherwise change the database.
+func TestRunnerDiffDesignWritesNothing(t *testing.T) {
+    fake := &fakeCouchDB{version: "3.3.3", resetErr: errors.New("reset attempted")}
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": fake})
+    r.diffDesign = true
+    r.ensureDB = true
+    r.restoreSecurity = map[string]interface{}{"admins": map[string]interface{}{}}
+    r.cfg.DefaultRevsLimit = 5
+    r.run([]string{"10.0.0.1:5984"})
+
+    if len(fake.writes) != 0 {
+        t.Errorf("Expected no writes, got %v", fake.writes)
+    }
+    report := r.summary.Report()
+    if len(report.Skipped) != 1 || len(report.ResetResults) != 0 {
+        t.Errorf("Expected the instance to be skipped without a reset, got %+v", report)
+    }
+}
+
+// TestRunnerRestoreSecurity checks that the security document is only
+// restored on --restore-host, and not on an instance skipped by the
+// replication guard.
+func TestRunnerRestoreSecurity(t *testing.T) {
+    target := &fakeCouchDB{version: "3.3.3"}
+    other := &fakeCouchDB{version: "3.3.3"}
+    r := newTestRunner(t, map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": target,
+        "http://10.0.0.2:5984": other,
+    })
+    r.restoreSecurity = map[string]interface{}{"admins": map[string]interface{}{}}
+    r.restoreHost = "10.0.0.1:5984"
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984"})
+    if fmt.Sprint(target.writes) != "[security]" || len(other.writes) != 0 {
+        t.Errorf("Expected only 10.0.0.1 to be restored, got %v and %v", target.writes, other.writes)
+    }
+
+    target = &fakeCouchDB{version: "3.3.3", replErr: couchdb.ErrUnauthorized}
+    r = newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": target})
+    r.restoreSecurity = map[string]interface{}{"admins": map[string]interface{}{}}
+    r.restoreHost = "10.0.0.1:5984"
+    r.run([]string{"10.0.0.1:5984"})
+    if report := r.summary.Report(); len(report.Skipped) != 1 || len(target.writes) != 0 {
+        t.Errorf("Expected the skipped instance to be left alone, got %v (writes %v)", report, target.writes)
+    }
+}
+
+// TestRunnerBackupSecurity checks that the security document of each
+// instance is saved to --backup-dir.
+func TestRunnerBackupSecurity(t *testing.T) {
+    dir := t.TempDir()
+    r := newTestRunner(t, map[string]*fakeCouchDB{"http://10.0.0.1:5984": {version: "3.3.3"}})
+    r.backupDir = dir
+    r.run([]string{"10.0.0.1:5984"})
+
+    content, err := os.ReadFile(filepath.Join(dir, "10.0.0.1_5984_testdb_security.json"))
+    if err != nil {
+        t.Fatalf("Expected the security document to be saved, got %v", err)
+    }
+    if string(content) != "{}" {
+        t.Errorf("Expected {}, got %s", content)
+    }
+}
+
+// TestRunnerInstanceDelay checks that instances are started
+// --instance-delay apart.
+func TestRunnerInstanceDelay(t *testing.T) {
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": {version: "3.3.3"},
+        "http://10.0.0.2:5984": {version: "3.3.3"},
+        "http://10.0.0.3:5984": {version: "3.3.3"},
+    }
+    r := newTestRunner(t, fakes)
+    r.instanceDelay = 30 * time.Millisecond
+
+    start := time.Now()
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984", "10.0.0.3:5984"})
+    if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+        t.Errorf("Expected at least 60ms between three instances, took %s", elapsed)
+    }
+    if report := r.summary.Report(); len(report.Succeeded) != 3 {
+        t.Errorf("Expected 3 successes, got %v", report)
+    }
+}
+
+// TestRunnerStartJitter checks that each concurrent instance waits a random
+// time within [0, jitter) before starting, and that no jitter means no wait.
+func TestRunnerStartJitter(t *testing.T) {
+    fakes := map[string]*fakeCouchDB{
+        "http://10.0.0.1:5984": {version: "3.3.3"},
+        "http://10.0.0.2:5984": {version: "3.3.3"},
+        "http://10.0.0.3:5984": {version: "3.3.3"},
+    }
+    var mu sync.Mutex
+    var delays []time.Duration
+    r := newTestRunner(t, fakes)
+    r.concurrency = 3
+    r.startJitter = 50 * time.Millisecond
+    r.sleep = func(d time.Duration) {
+        mu.Lock()
+        defer mu.Unlock()
+        delays = append(delays, d)
+    }
+    r.run([]string{"10.0.0.1:5984", "10.0.0.2:5984", "10.0.0.3:5984"})
+
+    if report := r.summary.Report(); len(report.Succeeded) != 3 {
+        t.Errorf("Expected 3 successes, got %v", report)
+    }
+    if len(delays) > 3 {
+        t.Errorf("Expected at most one wait per instance, got %v", delays)
+    }
+    for _, delay := range delays {
+        if delay < 0 || delay >= r.startJitter {
+            t.Errorf("Expected a delay within [0, %s), got %s", r.startJitter, delay)
+        }
+    }
+
+    for _, jitter := range []time.Duration{0, -time.Second} {
+        if delay := jitterDelay(jitter); delay != 0 {
+            t.Errorf("Expected no delay for a jitter of %s, got %s", jitter, delay)
+        }
+    }
+    for i := 0; i < 100; i++ {
+        if delay := jitterDelay(time.Millisecond); delay < 0 || delay >= time.Millisecond {
+            t.Fatalf("Expected a delay within [0, 1ms), got %s", delay)
+        }
+    }
+}
@@ -1,26 +1,153 @@
 package pulseapi
 
 import (
+    "errors"
+    "fmt"
     "time"
+    "net/http"
     "encoding/json"
     "github.com/pradeep-sanjaya/couch-revision-purge/restclient"
 )
 
 type Response struct {
-    CouchDBInstances int `json:"couchdb_instances"`
+    CouchDBInstances int        `json:"couchdb_instances"`
+    Instances        []Instance `json:"instances"`
+}
+
+// Instance is a CouchDB instance the Pulse API expects to exist.
+type Instance struct {
+    IP      string `json:"ip"`
+    Version string `json:"version"`
+}
+
+// IPs returns the IP addresses of the expected instances.
+func (r *Response) IPs() []string {
+    ips := make([]string, 0, len(r.Instances))
+    for _, instance := range r.Instances {
+        ips = append(ips, instance.IP)
+    }
+    return ips
+}
+
+// Options controls how the Pulse API is called.
+type Options struct {
+    // Timeout bounds each request. Zero uses a 10 second timeout.
+    Timeout time.Duration
+    // Retries is the number of extra attempts made after a transport error,
+    // such as a timeout, or a 5xx response.
+    Retries int
+    // Backoff is the wait before the first retry; it doubles on each retry.
+    Backoff time.Duration
 }
 
 func GetCouchDBInstanceCount(apiURL string) (int, error) {
-    client := restclient.NewRestClient(10 * time.Second)
-    body, err := client.Get(apiURL)
+    return GetCouchDBInstanceCountWithOptions(apiURL, Options{})
+}
+
+// GetCouchDBInstanceCountWithOptions fetches the expected number of CouchDB
+// instances, retrying transport and server errors as configured by opts.
+func GetCouchDBInstanceCountWithOptions(apiURL string, opts Options) (int, error) {
+    apiResponse, err := GetExpectedInstances(apiURL, opts)
     if err != nil {
         return 0, err
     }
+    return apiResponse.CouchDBInstances, nil
+}
+
+// GetExpectedInstances fetches the full Pulse API response, including the IP
+// address and version of every expected instance, retrying transport and
+// server errors as configured by opts.
+func GetExpectedInstances(apiURL string, opts Options) (*Response, error) {
+    timeout := opts.Timeout
+    if timeout == 0 {
+        timeout = 10 * time.Second
+    }
+    client := restclient.NewRestClient(timeout, restclient.WithRetries(restclient.RetryPolicy{
+        Attempts: opts.Retries + 1,
+        Backoff:  opts.Backoff,
+        RetryableStatusCodes: []int{
+            http.StatusInternalServerError,
+            http.StatusBadGateway,
+            http.StatusServiceUnavailable,
+            http.StatusGatewayTimeout,
+        },
+    }))
+
+    body, err := client.Get(apiURL)
+    if err != nil {
+        return nil, err
+    }
 
     var apiResponse Response
     if err := json.Unmarshal(body, &apiResponse); err != nil {
-        return 0, err
+        return nil, err
+    }
+    if apiResponse.CouchDBInstances == 0 {
+        apiResponse.CouchDBInstances = len(apiResponse.Instances)
     }
 
-    return apiResponse.CouchDBInstances, nil
-}
\ No newline at end of file
+    return &apiResponse, nil
+}
+
+// EndpointResult is the outcome of querying one Pulse API endpoint.
+type EndpointResult struct {
+    URL      string
+    Response *Response
+    Err      error
+}
+
+// MultiResponse combines the responses of several Pulse API endpoints, such
+// as one per region.
+type MultiResponse struct {
+    // Endpoints holds the result of each endpoint, in the order given.
+    Endpoints []EndpointResult
+    // Total sums the instance counts and joins the instance lists of the
+    // endpoints that answered.
+    Total Response
+}
+
+// Failed returns the results of the endpoints that could not be queried.
+func (m *MultiResponse) Failed() []EndpointResult {
+    var failed []EndpointResult
+    for _, result := range m.Endpoints {
+        if result.Err != nil {
+            failed = append(failed, result)
+        }
+    }
+    return failed
+}
+
+// Partial reports whether some, but not all, endpoints failed, so Total
+// undercounts the expected instances.
+func (m *MultiResponse) Partial() bool {
+    failed := len(m.Failed())
+    return failed > 0 && failed < len(m.Endpoints)
+}
+
+// GetExpectedInstancesFrom queries each of apiURLs with GetExpectedInstances,
+// retrying as configured by opts, and adds up the results. An endpoint that
+// fails does not affect the others; an error is only returned if every
+// endpoint fails.
+func GetExpectedInstancesFrom(apiURLs []string, opts Options) (*MultiResponse, error) {
+    if len(apiURLs) == 0 {
+        return nil, errors.New("no API endpoints given")
+    }
+
+    multi := &MultiResponse{Total: Response{Instances: []Instance{}}}
+    var errs []error
+    for _, apiURL := range apiURLs {
+        response, err := GetExpectedInstances(apiURL, opts)
+        multi.Endpoints = append(multi.Endpoints, EndpointResult{URL: apiURL, Response: response, Err: err})
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", apiURL, err))
+            continue
+        }
+        multi.Total.CouchDBInstances += response.CouchDBInstances
+        multi.Total.Instances = append(multi.Total.Instances, response.Instances...)
+    }
+
+    if len(errs) == len(apiURLs) {
+        return multi, errors.Join(errs...)
+    }
+    return multi, nil
+}
@@ -1,6 +1,7 @@
 package pulseapi
 
 import (
+    "fmt"
     "net/http"
     "net/http/httptest"
     "testing"
@@ -22,4 +23,110 @@ func TestGetCouchDBInstanceCount(t *testing.T) {
     if instances != expectedInstances {
         t.Errorf("Expected %d instances, got %d", expectedInstances, instances)
     }
-}
\ No newline at end of file
+}
+
+func TestGetCouchDBInstanceCountRetries(t *testing.T) {
+    attempts := 0
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts++
+        if attempts < 3 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(`{"couchdb_instances": 5}`))
+    }))
+    defer mockServer.Close()
+
+    instances, err := GetCouchDBInstanceCountWithOptions(mockServer.URL, Options{Retries: 2})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if instances != 5 {
+        t.Errorf("Expected 5 instances, got %d", instances)
+    }
+    if attempts != 3 {
+        t.Errorf("Expected 3 attempts, got %d", attempts)
+    }
+}
+
+func TestGetExpectedInstances(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+        w.Write([]byte(`{"instances": [{"ip": "10.0.0.1", "version": "3.3.3"}, {"ip": "10.0.0.2", "version": "2.3.1"}]}`))
+    }))
+    defer mockServer.Close()
+
+    response, err := GetExpectedInstances(mockServer.URL, Options{})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if response.CouchDBInstances != 2 {
+        t.Errorf("Expected 2 instances, got %d", response.CouchDBInstances)
+    }
+    if ips := response.IPs(); len(ips) != 2 || ips[0] != "10.0.0.1" || ips[1] != "10.0.0.2" {
+        t.Errorf("Expected IPs [10.0.0.1 10.0.0.2], got %v", ips)
+    }
+    if response.Instances[1].Version != "2.3.1" {
+        t.Errorf("Expected version 2.3.1, got %s", response.Instances[1].Version)
+    }
+}
+
+func TestReconcile(t *testing.T) {
+    found := []string{"10.0.0.3", "10.0.0.1", "10.0.0.1"}
+    expected := []string{"10.0.0.1", "10.0.0.2"}
+
+    result := Reconcile(found, expected)
+
+    if fmt.Sprint(result.Matched) != "[10.0.0.1]" {
+        t.Errorf("Expected matched [10.0.0.1], got %v", result.Matched)
+    }
+    if fmt.Sprint(result.Missing) != "[10.0.0.2]" {
+        t.Errorf("Expected missing [10.0.0.2], got %v", result.Missing)
+    }
+    if fmt.Sprint(result.Unexpected) != "[10.0.0.3]" {
+        t.Errorf("Expected unexpected [10.0.0.3], got %v", result.Unexpected)
+    }
+    if result.InSync() {
+        t.Errorf("Expected result not to be in sync")
+    }
+}
+
+func TestGetExpectedInstancesFrom(t *testing.T) {
+    eu := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"instances": [{"ip": "10.0.0.1"}, {"ip": "10.0.0.2"}]}`))
+    }))
+    defer eu.Close()
+    us := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"couchdb_instances": 3}`))
+    }))
+    defer us.Close()
+    down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer down.Close()
+
+    multi, err := GetExpectedInstancesFrom([]string{eu.URL, down.URL, us.URL}, Options{})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if multi.Total.CouchDBInstances != 5 {
+        t.Errorf("Expected 5 instances in total, got %d", multi.Total.CouchDBInstances)
+    }
+    if len(multi.Total.Instances) != 2 {
+        t.Errorf("Expected 2 listed instances, got %v", multi.Total.Instances)
+    }
+    if failed := multi.Failed(); len(failed) != 1 || failed[0].URL != down.URL {
+        t.Errorf("Expected only %s to fail, got %v", down.URL, failed)
+    }
+    if !multi.Partial() {
+        t.Errorf("Expected the result to be partial")
+    }
+
+    if _, err := GetExpectedInstancesFrom([]string{down.URL}, Options{}); err == nil {
+        t.Errorf("Expected an error when every endpoint fails")
+    }
+}
@@ -0,0 +1,53 @@
+package pulseapi
+
+import (
+    "sort"
+)
+
+// ReconcileResult compares the instances found on the network with the
+// instances the Pulse API expects.
+type ReconcileResult struct {
+    // Matched are found and expected.
+    Matched []string `json:"matched"`
+    // Missing are expected but were not found.
+    Missing []string `json:"missing"`
+    // Unexpected were found but are not expected.
+    Unexpected []string `json:"unexpected"`
+}
+
+// InSync reports whether every expected instance was found and nothing else.
+func (r ReconcileResult) InSync() bool {
+    return len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+// Reconcile diffs the found IPs against the expected IPs. Each list in the
+// result is sorted and free of duplicates.
+func Reconcile(found []string, expected []string) ReconcileResult {
+    foundSet := make(map[string]bool, len(found))
+    for _, ip := range found {
+        foundSet[ip] = true
+    }
+    expectedSet := make(map[string]bool, len(expected))
+    for _, ip := range expected {
+        expectedSet[ip] = true
+    }
+
+    result := ReconcileResult{Matched: []string{}, Missing: []string{}, Unexpected: []string{}}
+    for ip := range foundSet {
+        if expectedSet[ip] {
+            result.Matched = append(result.Matched, ip)
+        } else {
+            result.Unexpected = append(result.Unexpected, ip)
+        }
+    }
+    for ip := range expectedSet {
+        if !foundSet[ip] {
+            result.Missing = append(result.Missing, ip)
+        }
+    }
+
+    sort.Strings(result.Matched)
+    sort.Strings(result.Missing)
+    sort.Strings(result.Unexpected)
+    return result
+}
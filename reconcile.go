@@ -0,0 +1,55 @@
+package main
+
+import (
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+    "github.com/pradeep-sanjaya/couch-revision-purge/pulseapi"
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+    "net"
+)
+
+// reconcileInstances compares the instances found on the network with those
+// the Pulse API endpoints expect, logging the differences and recording them
+// in s. When only some endpoints answered, the expected instances are
+// incomplete, so nothing is compared: every instance behind a failed endpoint
+// would otherwise be reported as unexpected.
+func reconcileInstances(logger *logger.Logger, s *summary.Summary, instances []string, multi *pulseapi.MultiResponse) {
+    for _, endpoint := range multi.Endpoints {
+        if endpoint.Err != nil {
+            logger.Warnf("Failed to get expected CouchDB instances from %s: %v", endpoint.URL, endpoint.Err)
+        } else if len(multi.Endpoints) > 1 {
+            logger.Printf("%s reports %d CouchDB instances.", endpoint.URL, endpoint.Response.CouchDBInstances)
+        }
+    }
+    if multi.Partial() {
+        logger.Warnf("%d of %d API endpoints failed; the expected instances are incomplete, so they are not compared with those found.", len(multi.Failed()), len(multi.Endpoints))
+        return
+    }
+
+    expected := &multi.Total
+    logger.Printf("API reports %d CouchDB instances.", expected.CouchDBInstances)
+    if len(expected.Instances) > 0 {
+        var foundHosts []string
+        for _, instance := range instances {
+            host, _, err := net.SplitHostPort(instance)
+            if err != nil {
+                host = instance
+            }
+            foundHosts = append(foundHosts, host)
+        }
+        reconcile := pulseapi.Reconcile(foundHosts, expected.IPs())
+        s.SetReconciliation(reconcile)
+        for _, ip := range reconcile.Missing {
+            logger.Printf("Missing: %s is expected by the API but was not found.", ip)
+        }
+        for _, ip := range reconcile.Unexpected {
+            logger.Printf("Unexpected: %s was found but is not expected by the API.", ip)
+        }
+        if reconcile.InSync() {
+            logger.Println("The CouchDB instances found match the API report.")
+        }
+    } else if len(instances) == expected.CouchDBInstances {
+        logger.Println("The number of CouchDB instances matches the API report.")
+    } else {
+        logger.Printf("Mismatch: found %d instances, but API reports %d instances.", len(instances), expected.CouchDBInstances)
+    }
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "errors"
+    "io"
+    "testing"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+    "github.com/pradeep-sanjaya/couch-revision-purge/pulseapi"
+    "github.com/pradeep-sanjaya/couch-revision-purge/summary"
+)
+
+// TestReconcileInstances checks that the instances found are reconciled
+// against a complete API report, and not against a partial one.
+func TestReconcileInstances(t *testing.T) {
+    log := logger.NewWriterLogger(io.Discard)
+    instances := []string{"10.0.0.1:5984", "10.1.0.1:5984"}
+    east := pulseapi.EndpointResult{URL: "http://east", Response: &pulseapi.Response{CouchDBInstances: 1, Instances: []pulseapi.Instance{{IP: "10.0.0.1"}}}}
+    west := pulseapi.EndpointResult{URL: "http://west", Response: &pulseapi.Response{CouchDBInstances: 1, Instances: []pulseapi.Instance{{IP: "10.1.0.1"}}}}
+
+    s := summary.New()
+    complete := &pulseapi.MultiResponse{
+        Endpoints: []pulseapi.EndpointResult{east, west},
+        Total:     pulseapi.Response{CouchDBInstances: 2, Instances: append(east.Response.Instances, west.Response.Instances...)},
+    }
+    reconcileInstances(log, s, instances, complete)
+    if reconcile := s.Report().Reconciliation; reconcile == nil || !reconcile.InSync() {
+        t.Errorf("Expected the found instances to be in sync, got %+v", reconcile)
+    }
+
+    s = summary.New()
+    west = pulseapi.EndpointResult{URL: "http://west", Err: errors.New("connection refused")}
+    partial := &pulseapi.MultiResponse{
+        Endpoints: []pulseapi.EndpointResult{east, west},
+        Total:     *east.Response,
+    }
+    reconcileInstances(log, s, instances, partial)
+    if reconcile := s.Report().Reconciliation; reconcile != nil {
+        t.Errorf("Expected no reconciliation against a partial report, got %+v", reconcile)
+    }
+}
@@ -5,7 +5,7 @@ package restclient
 import (
     "bytes"
     "encoding/json"
-    "errors"
+    "io"
     "io/ioutil"
     "net/http"
     "time"  // Import the time package
@@ -15,18 +15,149 @@ import (
 // a customizable timeout.
 type RestClient struct {
     Client *http.Client
+
+    // Retry controls how failed requests are retried. The zero value makes a
+    // single attempt.
+    Retry RetryPolicy
+}
+
+// DefaultRetryableStatusCodes are the response status codes retried when a
+// RetryPolicy does not list its own.
+var DefaultRetryableStatusCodes = []int{
+    http.StatusTooManyRequests,
+    http.StatusInternalServerError,
+    http.StatusBadGateway,
+    http.StatusServiceUnavailable,
+    http.StatusGatewayTimeout,
+}
+
+// RetryPolicy describes how a RestClient retries a request that failed with a
+// transport error or a retryable status code. Only idempotent requests (GET,
+// HEAD, PUT and DELETE) are retried unless RetryNonIdempotent is set, since a
+// POST that failed after reaching the server may already have taken effect.
+type RetryPolicy struct {
+    // Attempts is the total number of attempts, including the first. Values
+    // below 1 make a single attempt.
+    Attempts int
+    // Backoff is the delay before the first retry. It doubles after each
+    // further attempt.
+    Backoff time.Duration
+    // RetryableStatusCodes lists the status codes worth retrying. Nil means
+    // DefaultRetryableStatusCodes.
+    RetryableStatusCodes []int
+    // RetryNonIdempotent also retries POST and PATCH requests. Set it only
+    // when the server tolerates receiving the same request twice.
+    RetryNonIdempotent bool
+}
+
+// idempotent reports whether sending a request with method twice has the same
+// effect as sending it once.
+func idempotent(method string) bool {
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+        return true
+    }
+    return false
+}
+
+// retryable reports whether req, which returned resp and err, should be tried
+// again.
+func (p RetryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+    if !p.RetryNonIdempotent && !idempotent(req.Method) {
+        return false
+    }
+    if err != nil {
+        return true
+    }
+    codes := p.RetryableStatusCodes
+    if codes == nil {
+        codes = DefaultRetryableStatusCodes
+    }
+    for _, code := range codes {
+        if resp.StatusCode == code {
+            return true
+        }
+    }
+    return false
 }
 
-// NewRestClient initializes a new RestClient with a specified timeout.
+// Option configures a RestClient created by NewRestClient.
+type Option func(*RestClient)
+
+// WithRetries makes the RestClient retry failed requests according to policy.
+//
+// Example usage:
+//
+//     client := restclient.NewRestClient(10*time.Second, restclient.WithRetries(restclient.RetryPolicy{
+//         Attempts: 3,
+//         Backoff:  time.Second,
+//     }))
+//
+func WithRetries(policy RetryPolicy) Option {
+    return func(rc *RestClient) {
+        rc.Retry = policy
+    }
+}
+
+// StatusError is returned when a request completes with an unexpected HTTP
+// status code.
+type StatusError struct {
+    Message    string
+    StatusCode int
+    Status     string
+    Body       []byte
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+    msg := e.Message + ", status code: " + e.Status
+    if len(e.Body) > 0 {
+        msg += ": " + string(e.Body)
+    }
+    return msg
+}
+
+// NewRestClient initializes a new RestClient with a specified timeout and
+// any options, such as WithRetries.
 //
 // Example usage:
 //
 //     client := restclient.NewRestClient(10 * time.Second)
 //
-func NewRestClient(timeout time.Duration) *RestClient {
-    return &RestClient{
+func NewRestClient(timeout time.Duration, opts ...Option) *RestClient {
+    rc := &RestClient{
         Client: &http.Client{Timeout: timeout},
     }
+    for _, opt := range opts {
+        opt(rc)
+    }
+    return rc
+}
+
+// do sends req, retrying it as described by rc.Retry. The response of the
+// last attempt is returned.
+func (rc *RestClient) do(req *http.Request) (*http.Response, error) {
+    delay := rc.Retry.Backoff
+    for attempt := 1; ; attempt++ {
+        if attempt > 1 && req.GetBody != nil {
+            body, err := req.GetBody()
+            if err != nil {
+                return nil, err
+            }
+            req.Body = body
+        }
+
+        resp, err := rc.Client.Do(req)
+        if attempt >= rc.Retry.Attempts || !rc.Retry.retryable(req, resp, err) {
+            return resp, err
+        }
+        if resp != nil {
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }
+        time.Sleep(delay)
+        delay *= 2
+    }
 }
 
 // Get sends a GET request to the specified URL and returns the response body as bytes.
@@ -41,14 +172,19 @@ func NewRestClient(timeout time.Duration) *RestClient {
 //     fmt.Println(string(body))
 //
 func (rc *RestClient) Get(url string) ([]byte, error) {
-    resp, err := rc.Client.Get(url)
+    req, err := http.NewRequest(http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := rc.do(req)
     if err != nil {
         return nil, err
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
-        return nil, errors.New("failed to retrieve data from API, status code: " + resp.Status)
+        return nil, &StatusError{Message: "failed to retrieve data from API", StatusCode: resp.StatusCode, Status: resp.Status}
     }
 
     body, err := ioutil.ReadAll(resp.Body)
@@ -78,14 +214,20 @@ func (rc *RestClient) Post(url string, payload interface{}) ([]byte, error) {
         return nil, err
     }
 
-    resp, err := rc.Client.Post(url, "application/json", bytes.NewBuffer(jsonPayload))
+    req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonPayload))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := rc.do(req)
     if err != nil {
         return nil, err
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusCreated {
-        return nil, errors.New("failed to create resource, status code: " + resp.Status)
+        return nil, &StatusError{Message: "failed to create resource", StatusCode: resp.StatusCode, Status: resp.Status}
     }
 
     body, err := ioutil.ReadAll(resp.Body)
@@ -121,14 +263,14 @@ func (rc *RestClient) Put(url string, payload interface{}) ([]byte, error) {
     }
     req.Header.Set("Content-Type", "application/json")
 
-    resp, err := rc.Client.Do(req)
+    resp, err := rc.do(req)
     if err != nil {
         return nil, err
     }
     defer resp.Body.Close()
 
     if resp.StatusCode != http.StatusOK {
-        return nil, errors.New("failed to update resource, status code: " + resp.Status)
+        return nil, &StatusError{Message: "failed to update resource", StatusCode: resp.StatusCode, Status: resp.Status}
     }
 
     body, err := ioutil.ReadAll(resp.Body)
@@ -139,31 +281,39 @@ func (rc *RestClient) Put(url string, payload interface{}) ([]byte, error) {
     return body, nil
 }
 
-// Delete sends a DELETE request to the specified URL and returns an error
-// if the request fails or if the response status code is not 200 (OK).
+// Delete sends a DELETE request to the specified URL and returns the response
+// body as bytes. It returns an error if the request fails or if the response
+// status code is not 200 (OK); the error includes the response body so the
+// server's reason for rejecting the delete is not lost.
 //
 // Example usage:
 //
-//     err := client.Delete("http://example.com/api/resource/1")
+//     body, err := client.Delete("http://example.com/api/resource/1")
 //     if err != nil {
 //         log.Fatalf("Failed to make DELETE request: %v", err)
 //     }
+//     fmt.Println(string(body))
 //
-func (rc *RestClient) Delete(url string) error {
+func (rc *RestClient) Delete(url string) ([]byte, error) {
     req, err := http.NewRequest(http.MethodDelete, url, nil)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    resp, err := rc.Client.Do(req)
+    resp, err := rc.do(req)
     if err != nil {
-        return err
+        return nil, err
     }
     defer resp.Body.Close()
 
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+
     if resp.StatusCode != http.StatusOK {
-        return errors.New("failed to delete resource, status code: " + resp.Status)
+        return body, &StatusError{Message: "failed to delete resource", StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
     }
 
-    return nil
+    return body, nil
 }
@@ -1,8 +1,11 @@
 package restclient
 
 import (
+    "errors"
+    "io"
     "net/http"
     "net/http/httptest"
+    "strings"
     "testing"
     "time"
 )
@@ -24,4 +27,106 @@ func TestRestClientGet(t *testing.T) {
     if string(body) != expectedBody {
         t.Errorf("Expected body %s, got %s", expectedBody, string(body))
     }
-}
\ No newline at end of file
+}
+
+func TestRestClientDelete(t *testing.T) {
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodDelete {
+            t.Errorf("Expected DELETE request, got %s", r.Method)
+        }
+        w.WriteHeader(http.StatusConflict)
+        w.Write([]byte(`{"error": "conflict"}`))
+    }))
+    defer mockServer.Close()
+
+    client := NewRestClient(10 * time.Second)
+    body, err := client.Delete(mockServer.URL)
+    if err == nil {
+        t.Fatalf("Expected an error for a 409 response")
+    }
+
+    expectedBody := `{"error": "conflict"}`
+    if string(body) != expectedBody {
+        t.Errorf("Expected body %s, got %s", expectedBody, string(body))
+    }
+    if !strings.Contains(err.Error(), expectedBody) {
+        t.Errorf("Expected error to include the response body, got %v", err)
+    }
+}
+
+func TestRestClientRetries(t *testing.T) {
+    attempts := 0
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts++
+        if attempts < 3 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        body, _ := io.ReadAll(r.Body)
+        w.WriteHeader(http.StatusCreated)
+        w.Write(body)
+    }))
+    defer mockServer.Close()
+
+    client := NewRestClient(10*time.Second, WithRetries(RetryPolicy{Attempts: 3, Backoff: time.Millisecond, RetryNonIdempotent: true}))
+    body, err := client.Post(mockServer.URL, map[string]string{"name": "example"})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+
+    if attempts != 3 {
+        t.Errorf("Expected 3 attempts, got %d", attempts)
+    }
+    expectedBody := `{"name":"example"}`
+    if string(body) != expectedBody {
+        t.Errorf("Expected the payload to be resent, got %s", string(body))
+    }
+}
+
+func TestRestClientRetriesGiveUp(t *testing.T) {
+    attempts := 0
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts++
+        w.WriteHeader(http.StatusBadGateway)
+    }))
+    defer mockServer.Close()
+
+    client := NewRestClient(10*time.Second, WithRetries(RetryPolicy{
+        Attempts:             4,
+        Backoff:              time.Millisecond,
+        RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+    }))
+    _, err := client.Get(mockServer.URL)
+
+    var statusErr *StatusError
+    if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+        t.Fatalf("Expected a 502 StatusError, got %v", err)
+    }
+    if attempts != 1 {
+        t.Errorf("Expected a non-retryable status to be tried once, got %d attempts", attempts)
+    }
+}
+
+func TestRestClientRetriesIdempotentOnly(t *testing.T) {
+    attempts := map[string]int{}
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        attempts[r.Method]++
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer mockServer.Close()
+
+    client := NewRestClient(10*time.Second, WithRetries(RetryPolicy{Attempts: 3, Backoff: time.Millisecond}))
+    if _, err := client.Post(mockServer.URL, map[string]string{"name": "example"}); err == nil {
+        t.Fatalf("Expected an error")
+    }
+    if _, err := client.Get(mockServer.URL); err == nil {
+        t.Fatalf("Expected an error")
+    }
+
+    if attempts[http.MethodPost] != 1 {
+        t.Errorf("Expected POST to be tried once, got %d attempts", attempts[http.MethodPost])
+    }
+    if attempts[http.MethodGet] != 3 {
+        t.Errorf("Expected GET to be tried 3 times, got %d attempts", attempts[http.MethodGet])
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "sync"
+)
+
+// runState records, per instance, the database update sequence a run started
+// from, so an interrupted or repeated run can resume from it with --state-file.
+// While an instance is being processed it also records how far through the
+// candidate views the run has got, so an interrupted run picks up at the last
+// finished page rather than starting over.
+//
+// Resuming is an approximation: CouchDB sequences are per node and, on 2.x
+// clusters, opaque and not strictly ordered across shards, so a resumed run
+// may re-check some documents. It will not miss documents changed since the
+// recorded sequence.
+type runState struct {
+    mu        sync.Mutex
+    path      string
+    instances map[string]instanceState
+}
+
+// instanceState is what runState records for one instance.
+type instanceState struct {
+    // Seq is the update sequence the last completed run started from.
+    Seq string `json:"seq"`
+
+    // Progress is the position of a run that has not completed yet, or nil.
+    Progress *runProgress `json:"progress,omitempty"`
+
+    // DesignETag is the ETag of the rev_filter design document the last run
+    // installed or found, and DesignDigest the digest of its views, so the
+    // next run can revalidate it with If-None-Match instead of fetching it.
+    DesignETag   string `json:"designETag,omitempty"`
+    DesignDigest string `json:"designDigest,omitempty"`
+}
+
+// runProgress is how far an unfinished run got through the candidate views.
+type runProgress struct {
+    // StartSeq is the update sequence the unfinished run started from. It is
+    // recorded as Seq once the run completes, even if it is resumed later.
+    StartSeq string `json:"startSeq"`
+    // Since is the sequence the run handled changes from, "" for a full run.
+    // Progress recorded against a different Since is ignored.
+    Since string `json:"since,omitempty"`
+    // View is the candidate view being handled.
+    View string `json:"view"`
+    // Bookmark is where to continue View from: a view page bookmark for a
+    // full run, or the last document ID handled when resuming from Since.
+    // Empty means the start of the view.
+    Bookmark string `json:"bookmark,omitempty"`
+}
+
+// UnmarshalJSON also accepts the bare sequence string written by earlier
+// versions.
+func (s *instanceState) UnmarshalJSON(data []byte) error {
+    var seq string
+    if err := json.Unmarshal(data, &seq); err == nil {
+        *s = instanceState{Seq: seq}
+        return nil
+    }
+    type plain instanceState
+    return json.Unmarshal(data, (*plain)(s))
+}
+
+// loadRunState reads the state file at path. A missing file yields an empty
+// state that will be created on the first save.
+func loadRunState(path string) (*runState, error) {
+    state := &runState{path: path, instances: make(map[string]instanceState)}
+    content, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return state, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(content, &state.instances); err != nil {
+        return nil, err
+    }
+    return state, nil
+}
+
+// Since returns the sequence recorded for instance, or "" if there is none.
+func (s *runState) Since(instance string) string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.instances[instance].Seq
+}
+
+// Progress returns the position of an unfinished run on instance, or nil.
+func (s *runState) Progress(instance string) *runProgress {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.instances[instance].Progress
+}
+
+// Save records that a run of instance starting from seq completed, and writes
+// the state file.
+func (s *runState) Save(instance, seq string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    entry := s.instances[instance]
+    entry.Seq = seq
+    entry.Progress = nil
+    s.instances[instance] = entry
+    return s.write()
+}
+
+// Design returns the ETag and views digest of the design document recorded
+// for instance, or empty strings if there are none.
+func (s *runState) Design(instance string) (etag, digest string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    entry := s.instances[instance]
+    return entry.DesignETag, entry.DesignDigest
+}
+
+// SaveDesign records the ETag and views digest of the design document on
+// instance, and writes the state file.
+func (s *runState) SaveDesign(instance, etag, digest string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    entry := s.instances[instance]
+    entry.DesignETag = etag
+    entry.DesignDigest = digest
+    s.instances[instance] = entry
+    return s.write()
+}
+
+// SaveProgress records how far the current run of instance has got, and
+// writes the state file.
+func (s *runState) SaveProgress(instance string, progress runProgress) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    entry := s.instances[instance]
+    entry.Progress = &progress
+    s.instances[instance] = entry
+    return s.write()
+}
+
+// write writes the state file. The caller holds s.mu.
+func (s *runState) write() error {
+    content, err := json.MarshalIndent(s.instances, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(s.path, content, 0644)
+}
@@ -0,0 +1,326 @@
+// Package summary accumulates the results of a purge run across instances
+// and databases. A Summary is safe for concurrent use, so instances can be
+// processed sequentially or in parallel and reported on together at the end.
+package summary
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "github.com/pradeep-sanjaya/couch-revision-purge/pulseapi"
+)
+
+// Summary accumulates per-instance outcomes. The zero value is ready to use.
+type Summary struct {
+    mu sync.Mutex
+
+    succeeded        []string
+    failed           map[string]string
+    skipped          map[string]string
+    timedOut         int
+    docsHandled      int
+    conflictsDeleted int
+    conflictsFailed  int
+    docsOverRevCount int
+    resetResults     []*couchdb.ResetResult
+    fragmentation    map[string]float64
+    setupStates      map[string]string
+    strategies       map[string]string
+    reconcile        *pulseapi.ReconcileResult
+    aborted          string
+}
+
+// Report is a point-in-time copy of a Summary, suitable for printing or
+// encoding as JSON.
+type Report struct {
+    Succeeded        []string                  `json:"succeeded"`
+    Failed           map[string]string         `json:"failed"`
+    Skipped          map[string]string         `json:"skipped"`
+    TimedOut         int                       `json:"timedOut"`
+    DocsHandled      int                       `json:"docsHandled"`
+    ConflictsDeleted int                       `json:"conflictsDeleted"`
+    ConflictsFailed  int                       `json:"conflictsFailed"`
+    DocsOverRevCount int                       `json:"docsOverRevCount"`
+    RevisionsDeleted int                       `json:"revisionsDeleted"`
+    ResetResults     []*couchdb.ResetResult    `json:"resetResults"`
+    Fragmentation    map[string]float64        `json:"fragmentation"`
+    SetupStates      map[string]string         `json:"setupStates"`
+    Strategies       map[string]string         `json:"strategies,omitempty"`
+    Reconciliation   *pulseapi.ReconcileResult `json:"reconciliation,omitempty"`
+    Aborted          string                    `json:"aborted,omitempty"`
+}
+
+// New creates an empty Summary.
+func New() *Summary {
+    return &Summary{}
+}
+
+// AddSuccess records that instance was processed successfully.
+func (s *Summary) AddSuccess(instance string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.succeeded = append(s.succeeded, instance)
+}
+
+// AddFailure records that processing instance failed with err. Failures
+// caused by a request timing out are also counted in TimedOut.
+func (s *Summary) AddFailure(instance string, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.failed == nil {
+        s.failed = make(map[string]string)
+    }
+    s.failed[instance] = err.Error()
+
+    if couchdb.IsTimeout(err) {
+        s.timedOut++
+    }
+}
+
+// AddTimeouts adds n to the number of operations that timed out without
+// failing their instance, such as a single conflict delete.
+func (s *Summary) AddTimeouts(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.timedOut += n
+}
+
+// AddSkipped records that instance was skipped and why.
+func (s *Summary) AddSkipped(instance, reason string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.skipped == nil {
+        s.skipped = make(map[string]string)
+    }
+    s.skipped[instance] = reason
+}
+
+// AddDocsHandled adds n to the number of documents handled.
+func (s *Summary) AddDocsHandled(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.docsHandled += n
+}
+
+// AddConflicts adds to the numbers of conflict revisions deleted and of
+// conflict revisions that failed to delete.
+func (s *Summary) AddConflicts(deleted, failed int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.conflictsDeleted += deleted
+    s.conflictsFailed += failed
+}
+
+// AddDocsOverRevCount adds n to the number of documents found at or above the
+// revision count warning threshold.
+func (s *Summary) AddDocsOverRevCount(n int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.docsOverRevCount += n
+}
+
+// AddResetResult records the outcome of a document reset.
+func (s *Summary) AddResetResult(result *couchdb.ResetResult) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.resetResults = append(s.resetResults, result)
+}
+
+// AddFragmentation records the fragmentation ratio measured on instance.
+func (s *Summary) AddFragmentation(instance string, ratio float64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.fragmentation == nil {
+        s.fragmentation = make(map[string]float64)
+    }
+    s.fragmentation[instance] = ratio
+}
+
+// AddSetupState records the /_cluster_setup state reported by instance.
+func (s *Summary) AddSetupState(instance, state string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.setupStates == nil {
+        s.setupStates = make(map[string]string)
+    }
+    s.setupStates[instance] = state
+}
+
+// AddStrategy records how deleted documents were removed on instance, such as
+// "purge", or "recreate" when _purge was disabled and the run fell back to
+// resetting the document.
+func (s *Summary) AddStrategy(instance, strategy string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.strategies == nil {
+        s.strategies = make(map[string]string)
+    }
+    s.strategies[instance] = strategy
+}
+
+// SetReconciliation records the comparison of found and expected instances.
+func (s *Summary) SetReconciliation(result pulseapi.ReconcileResult) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.reconcile = &result
+}
+
+// Abort records why the run stopped early. Only the first reason is kept.
+func (s *Summary) Abort(reason string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.aborted == "" {
+        s.aborted = reason
+    }
+}
+
+// Aborted returns why the run was aborted, or "" if it was not.
+func (s *Summary) Aborted() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.aborted
+}
+
+// DocsHandled returns the number of documents handled so far.
+func (s *Summary) DocsHandled() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.docsHandled
+}
+
+// Merge adds everything recorded in other to s.
+func (s *Summary) Merge(other *Summary) {
+    report := other.Report()
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.succeeded = append(s.succeeded, report.Succeeded...)
+    for instance, reason := range report.Failed {
+        if s.failed == nil {
+            s.failed = make(map[string]string)
+        }
+        s.failed[instance] = reason
+    }
+    for instance, reason := range report.Skipped {
+        if s.skipped == nil {
+            s.skipped = make(map[string]string)
+        }
+        s.skipped[instance] = reason
+    }
+    s.timedOut += report.TimedOut
+    s.docsHandled += report.DocsHandled
+    s.conflictsDeleted += report.ConflictsDeleted
+    s.conflictsFailed += report.ConflictsFailed
+    s.docsOverRevCount += report.DocsOverRevCount
+    s.resetResults = append(s.resetResults, report.ResetResults...)
+    for instance, ratio := range report.Fragmentation {
+        if s.fragmentation == nil {
+            s.fragmentation = make(map[string]float64)
+        }
+        s.fragmentation[instance] = ratio
+    }
+    for instance, state := range report.SetupStates {
+        if s.setupStates == nil {
+            s.setupStates = make(map[string]string)
+        }
+        s.setupStates[instance] = state
+    }
+    for instance, strategy := range report.Strategies {
+        if s.strategies == nil {
+            s.strategies = make(map[string]string)
+        }
+        s.strategies[instance] = strategy
+    }
+    if s.aborted == "" {
+        s.aborted = report.Aborted
+    }
+}
+
+// Report returns a copy of the accumulated results.
+func (s *Summary) Report() Report {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    report := Report{
+        Succeeded:        append([]string{}, s.succeeded...),
+        Failed:           make(map[string]string, len(s.failed)),
+        Skipped:          make(map[string]string, len(s.skipped)),
+        TimedOut:         s.timedOut,
+        DocsHandled:      s.docsHandled,
+        ConflictsDeleted: s.conflictsDeleted,
+        ConflictsFailed:  s.conflictsFailed,
+        DocsOverRevCount: s.docsOverRevCount,
+        ResetResults:     append([]*couchdb.ResetResult{}, s.resetResults...),
+        Fragmentation:    make(map[string]float64, len(s.fragmentation)),
+        SetupStates:      make(map[string]string, len(s.setupStates)),
+        Aborted:          s.aborted,
+    }
+    for instance, ratio := range s.fragmentation {
+        report.Fragmentation[instance] = ratio
+    }
+    for instance, state := range s.setupStates {
+        report.SetupStates[instance] = state
+    }
+    if len(s.strategies) > 0 {
+        report.Strategies = make(map[string]string, len(s.strategies))
+        for instance, strategy := range s.strategies {
+            report.Strategies[instance] = strategy
+        }
+    }
+    if s.reconcile != nil {
+        reconcile := *s.reconcile
+        report.Reconciliation = &reconcile
+    }
+    for instance, reason := range s.failed {
+        report.Failed[instance] = reason
+    }
+    for instance, reason := range s.skipped {
+        report.Skipped[instance] = reason
+    }
+    for _, result := range s.resetResults {
+        report.RevisionsDeleted += result.RevisionsDeleted
+    }
+    return report
+}
+
+// String renders the report as a short human-readable summary.
+func (r Report) String() string {
+    var b strings.Builder
+    if r.Aborted != "" {
+        fmt.Fprintf(&b, "ABORTED: %s\n", r.Aborted)
+    }
+    fmt.Fprintf(&b, "%d succeeded, %d failed, %d skipped; %d documents handled, %d revisions deleted",
+        len(r.Succeeded), len(r.Failed), len(r.Skipped), r.DocsHandled, r.RevisionsDeleted)
+    if r.ConflictsDeleted > 0 || r.ConflictsFailed > 0 {
+        fmt.Fprintf(&b, "\n  %d conflict revisions deleted, %d failed", r.ConflictsDeleted, r.ConflictsFailed)
+    }
+    if r.DocsOverRevCount > 0 {
+        fmt.Fprintf(&b, "\n  %d documents at or above the revision count warning threshold", r.DocsOverRevCount)
+    }
+    if r.TimedOut > 0 {
+        fmt.Fprintf(&b, "\n  %d operations timed out", r.TimedOut)
+    }
+    for instance, reason := range r.Failed {
+        fmt.Fprintf(&b, "\n  failed %s: %s", instance, reason)
+    }
+    for instance, reason := range r.Skipped {
+        fmt.Fprintf(&b, "\n  skipped %s: %s", instance, reason)
+    }
+    for instance, ratio := range r.Fragmentation {
+        fmt.Fprintf(&b, "\n  fragmentation %s: %.1f%%", instance, ratio*100)
+    }
+    for instance, state := range r.SetupStates {
+        if !couchdb.SetupFinished(state) {
+            fmt.Fprintf(&b, "\n  setup unfinished %s: %s", instance, state)
+        }
+    }
+    for instance, strategy := range r.Strategies {
+        fmt.Fprintf(&b, "\n  strategy %s: %s", instance, strategy)
+    }
+    if r.Reconciliation != nil {
+        fmt.Fprintf(&b, "\n  reconciliation: %d matched, missing %v, unexpected %v",
+            len(r.Reconciliation.Matched), r.Reconciliation.Missing, r.Reconciliation.Unexpected)
+    }
+    return b.String()
+}
@@ -0,0 +1,90 @@
+package summary
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+)
+
+// TestSummaryConcurrentUpdates records results from many goroutines at once and
+// checks that nothing is lost. Run with -race to detect unsynchronised access.
+func TestSummaryConcurrentUpdates(t *testing.T) {
+    s := New()
+    workers := 50
+
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            instance := fmt.Sprintf("10.0.0.%d:5984", i)
+            switch i % 3 {
+            case 0:
+                s.AddSuccess(instance)
+            case 1:
+                s.AddFailure(instance, errors.New("boom"))
+            case 2:
+                s.AddSkipped(instance, "not found")
+            }
+            s.AddDocsHandled(2)
+            s.AddResetResult(&couchdb.ResetResult{Instance: instance, RevisionsDeleted: 1})
+            _ = s.Report()
+        }(i)
+    }
+    wg.Wait()
+
+    report := s.Report()
+    if total := len(report.Succeeded) + len(report.Failed) + len(report.Skipped); total != workers {
+        t.Errorf("Expected %d instances recorded, got %d", workers, total)
+    }
+    if report.DocsHandled != workers*2 {
+        t.Errorf("Expected %d documents handled, got %d", workers*2, report.DocsHandled)
+    }
+    if report.RevisionsDeleted != workers {
+        t.Errorf("Expected %d revisions deleted, got %d", workers, report.RevisionsDeleted)
+    }
+}
+
+// TestSummaryMerge verifies that Merge folds one summary into another.
+func TestSummaryMerge(t *testing.T) {
+    a := New()
+    a.AddSuccess("a:5984")
+    a.AddDocsHandled(1)
+
+    b := New()
+    b.AddFailure("b:5984", errors.New("boom"))
+    b.AddDocsHandled(3)
+
+    a.Merge(b)
+    report := a.Report()
+    if len(report.Succeeded) != 1 || len(report.Failed) != 1 {
+        t.Errorf("Expected 1 success and 1 failure, got %v", report)
+    }
+    if report.DocsHandled != 4 {
+        t.Errorf("Expected 4 documents handled, got %d", report.DocsHandled)
+    }
+}
+
+// TestSummaryCountsTimeouts checks that failures caused by a timeout are
+// counted separately while still being recorded as failures.
+func TestSummaryCountsTimeouts(t *testing.T) {
+    s := New()
+    timeoutErr := &couchdb.TimeoutError{Op: "GET", URL: "http://10.0.0.1:5984/db", Err: errors.New("deadline exceeded")}
+    s.AddFailure("10.0.0.1:5984", fmt.Errorf("failed to get server version: %w", timeoutErr))
+    s.AddFailure("10.0.0.2:5984", errors.New("boom"))
+
+    report := s.Report()
+    if len(report.Failed) != 2 {
+        t.Errorf("Expected 2 failures, got %d", len(report.Failed))
+    }
+    if report.TimedOut != 1 {
+        t.Errorf("Expected 1 timeout, got %d", report.TimedOut)
+    }
+
+    s.AddTimeouts(3)
+    if report := s.Report(); report.TimedOut != 4 {
+        t.Errorf("Expected operation timeouts to be added, got %d", report.TimedOut)
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/pradeep-sanjaya/couch-revision-purge/config"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+    "io"
+    "net"
+    "strings"
+)
+
+// confirmDatabaseName checks that the operator typed the name of the database
+// about to be deleted. confirmation is the value of --confirm-dbname; when it
+// is empty the name is read from in after printing a prompt to out.
+func confirmDatabaseName(dbName, confirmation string, in io.Reader, out io.Writer) error {
+    if confirmation == "" {
+        fmt.Fprintf(out, "This permanently deletes database %s on every instance. Type its name to confirm: ", dbName)
+        line, err := bufio.NewReader(in).ReadString('\n')
+        if err != nil && err != io.EOF {
+            return err
+        }
+        confirmation = strings.TrimSpace(line)
+    }
+    if confirmation != dbName {
+        return fmt.Errorf("confirmation %q does not match database name %q", confirmation, dbName)
+    }
+    return nil
+}
+
+// deleteDatabases deletes dbName on every instance. It runs instead of the
+// purge pipeline and only after confirmDatabaseName has succeeded. It returns
+// the number of instances the deletion failed on. A database outside
+// cfg.SafeDBPrefix is not deleted anywhere and is reported as an error.
+func deleteDatabases(cfg *config.Config, clientOpts couchdb.ClientOptions, logger *logger.Logger, dbName string, instances []string) (int, error) {
+    if !cfg.AllowsDatabase(dbName) {
+        return 0, fmt.Errorf("database %s does not start with safeDBPrefix %q", dbName, cfg.SafeDBPrefix)
+    }
+    failed := 0
+    for _, instance := range instances {
+        ip, port, err := net.SplitHostPort(instance)
+        if err != nil {
+            logger.Errorf("Failed to delete database %s on %s: %v", dbName, instance, err)
+            failed++
+            continue
+        }
+        client := couchdb.NewCouchDBClient(couchdb.BuildBaseURL(cfg.CouchDBScheme, ip, port, cfg.CouchDBPathPrefix), dbName, clientOpts)
+        if err := client.DeleteDatabase(); err != nil {
+            logger.Errorf("Failed to delete database %s on %s: %v", dbName, instance, err)
+            failed++
+            continue
+        }
+        logger.Printf("Deleted database %s on %s", dbName, instance)
+    }
+    return failed, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/pradeep-sanjaya/couch-revision-purge/config"
+    "github.com/pradeep-sanjaya/couch-revision-purge/couchdb"
+    "github.com/pradeep-sanjaya/couch-revision-purge/logger"
+)
+
+// TestConfirmDatabaseName checks that deletion is only confirmed by the exact
+// database name, whether given as a flag or typed at the prompt.
+func TestConfirmDatabaseName(t *testing.T) {
+    if err := confirmDatabaseName("testdb", "testdb", strings.NewReader(""), io.Discard); err != nil {
+        t.Errorf("Expected the flag to confirm, got %v", err)
+    }
+    if err := confirmDatabaseName("testdb", "", strings.NewReader("testdb\n"), io.Discard); err != nil {
+        t.Errorf("Expected the typed name to confirm, got %v", err)
+    }
+    if err := confirmDatabaseName("testdb", "", strings.NewReader("yes\n"), io.Discard); err == nil {
+        t.Errorf("Expected a mismatched name to be rejected")
+    }
+    if err := confirmDatabaseName("testdb", "", strings.NewReader(""), io.Discard); err == nil {
+        t.Errorf("Expected no input to be rejected")
+    }
+}
+
+// TestDeleteDatabases checks that failing instances are counted and that a
+// database outside safeDBPrefix is refused without contacting any instance.
+func TestDeleteDatabases(t *testing.T) {
+    var deletes []string
+    mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        deletes = append(deletes, r.Method+" "+r.URL.Path)
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, `{"ok": true}`)
+    }))
+    defer mockServer.Close()
+
+    log := logger.NewWriterLogger(io.Discard)
+    instance := strings.TrimPrefix(mockServer.URL, "http://")
+    cfg := &config.Config{SafeDBPrefix: "sandbox_"}
+
+    failed, err := deleteDatabases(cfg, couchdb.ClientOptions{}, log, "sandbox_db", []string{instance, "no-port"})
+    if err != nil {
+        t.Fatalf("Expected no error, got %v", err)
+    }
+    if failed != 1 || len(deletes) != 1 || deletes[0] != "DELETE /sandbox_db" {
+        t.Errorf("Expected one deletion and one failure, got %d failed and %v", failed, deletes)
+    }
+
+    deletes = nil
+    if _, err := deleteDatabases(cfg, couchdb.ClientOptions{}, log, "production", []string{instance}); err == nil {
+        t.Errorf("Expected a database outside safeDBPrefix to be refused")
+    }
+    if len(deletes) != 0 {
+        t.Errorf("Expected no request for a refused database, got %v", deletes)
+    }
+}